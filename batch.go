@@ -0,0 +1,317 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// batchConcurrency bounds the nodes a batch is sent to at once.
+const batchConcurrency = 8
+
+// BatchError reports the keys of a batch that failed, each with its error. The rest of
+// the batch succeeded.
+type BatchError map[uint64]error
+
+func (e BatchError) Error() string {
+	if len(e) == 0 {
+		return "0 keys failed"
+	}
+	keys := make([]uint64, 0, len(e))
+	for key := range e {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return fmt.Sprintf("%d keys failed, first %x: %v", len(e), keys[0], e[keys[0]])
+}
+
+// err returns e as an error, or nil if no key failed.
+func (e BatchError) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// batchEntry is one key's outcome in a batch response, carrying either its value or the
+// error it ran into.
+type batchEntry struct {
+	Key      uint64  `json:"key"`
+	Value    []byte  `json:"value,omitempty"`
+	Version  Version `json:"version"`
+	Error    string  `json:"error,omitempty"`
+	NotFound bool    `json:"notFound,omitempty"`
+}
+
+// SetBatch writes every value, sending each node the keys it owns in one request. Failed
+// keys are reported in a BatchError without affecting the others.
+func (s *DHTServer) SetBatch(values map[uint64]io.Reader) error {
+	records := make([]record, 0, len(values))
+	for key, value := range values {
+		b, err := io.ReadAll(value)
+		if err != nil {
+			return err
+		}
+		records = append(records, record{Key: key, Value: b, Checksum: checksum(b)})
+	}
+	return s.setBatch(records).err()
+}
+
+func (s *DHTServer) setBatch(records []record) BatchError {
+	byKey := make(map[uint64]record, len(records))
+	for _, rec := range records {
+		byKey[rec.Key] = rec
+		s.InvalidateCached(rec.Key)
+	}
+	failed := BatchError{}
+	s.eachOwner(keysOf(byKey), failed, func(owner Node, keys []uint64) BatchError {
+		group := make([]record, len(keys))
+		for i, key := range keys {
+			group[i] = byKey[key]
+		}
+		if owner.ID() == s.node.ID() {
+			return s.setBatchLocal(group)
+		}
+		var body bytes.Buffer
+		enc := json.NewEncoder(&body)
+		for _, rec := range group {
+			enc.Encode(rec)
+		}
+		return s.postBatch(owner, "SetBatch", keys, &body, nil)
+	})
+	return failed
+}
+
+// setBatchLocal writes records owned by this node, then sends them to each replica in a
+// single transfer. Keys that could not be replicated to Quorum nodes are reported failed.
+func (s *DHTServer) setBatchLocal(records []record) BatchError {
+	failed := BatchError{}
+	var written []uint64
+	for _, rec := range records {
+		version := rec.Version
+		if version.IsZero() {
+			current, prev, err := s.store.GetVersioned(rec.Key)
+			if err != nil && !errors.Is(err, ErrKeyNotFound) {
+				failed[rec.Key] = err
+				continue
+			}
+			closeReader(current)
+			version = nextVersion(s.node.ID(), prev)
+		}
+		if err := s.store.SetVersionedWithTTL(rec.Key, bytes.NewReader(rec.Value), version, rec.TTL); err != nil {
+			failed[rec.Key] = err
+			continue
+		}
+		written = append(written, rec.Key)
+		s.publish(Change{Type: KeySet, Key: rec.Key, Version: version})
+	}
+	if len(written) == 0 {
+		return failed
+	}
+	sort.Slice(written, func(i, j int) bool { return written[i] < written[j] })
+	err := s.replicate(s.replicas(), func(_ int, m Node) error {
+		return pushBatch(context.Background(), s.client, m.Host(), s.store, written, s.TransferCodec)
+	})
+	if err != nil {
+		for _, key := range written {
+			failed[key] = err
+		}
+	}
+	return failed
+}
+
+// GetBatch reads every key, asking each node for the keys it owns in one request. Keys
+// that are absent or could not be read are reported in a BatchError, absent ones with
+// ErrKeyNotFound, alongside the values that were read.
+func (s *DHTServer) GetBatch(keys []uint64) (map[uint64]io.Reader, error) {
+	entries, failed := s.getBatch(keys)
+	out := make(map[uint64]io.Reader, len(entries))
+	for key, entry := range entries {
+		out[key] = bytes.NewReader(entry.Value)
+	}
+	return out, failed.err()
+}
+
+func (s *DHTServer) getBatch(keys []uint64) (map[uint64]batchEntry, BatchError) {
+	var mu sync.Mutex
+	entries := make(map[uint64]batchEntry, len(keys))
+	failed := BatchError{}
+	s.eachOwner(keys, failed, func(owner Node, keys []uint64) BatchError {
+		if owner.ID() != s.node.ID() {
+			body, _ := json.Marshal(keys)
+			return s.postBatch(owner, "GetBatch", keys, bytes.NewReader(body), func(entry batchEntry) {
+				mu.Lock()
+				defer mu.Unlock()
+				entries[entry.Key] = entry
+			})
+		}
+		failed := BatchError{}
+		for _, key := range keys {
+			value, version, err := s.store.GetVersioned(key)
+			if err == nil {
+				var b []byte
+				b, err = io.ReadAll(value)
+				closeReader(value)
+				mu.Lock()
+				entries[key] = batchEntry{Key: key, Value: b, Version: version}
+				mu.Unlock()
+			}
+			if err != nil {
+				failed[key] = err
+			}
+		}
+		return failed
+	})
+	return entries, failed
+}
+
+// eachOwner groups keys by the node that owns them and calls fn for each group,
+// batchConcurrency at a time, collecting the keys that failed into failed.
+func (s *DHTServer) eachOwner(keys []uint64, failed BatchError, fn func(Node, []uint64) BatchError) {
+	owners, err := s.LocateAll(keys)
+	if err != nil {
+		for _, key := range keys {
+			failed[key] = err
+		}
+		return
+	}
+	groups := map[uint64][]uint64{}
+	nodes := map[uint64]Node{}
+	for key, owner := range owners {
+		groups[owner.ID()] = append(groups[owner.ID()], key)
+		nodes[owner.ID()] = owner
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchConcurrency)
+	for id, group := range groups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(owner Node, group []uint64) {
+			defer func() { <-sem; wg.Done() }()
+			errs := fn(owner, group)
+			mu.Lock()
+			defer mu.Unlock()
+			for key, err := range errs {
+				failed[key] = err
+			}
+		}(nodes[id], group)
+	}
+	wg.Wait()
+}
+
+// postBatch sends body, the batch of keys, to owner's op endpoint, passing each entry of
+// the response to yield. Entries carrying an error, and every key if the request fails,
+// are reported.
+func (s *DHTServer) postBatch(owner Node, op string, keys []uint64, body io.Reader, yield func(batchEntry)) BatchError {
+	failed := BatchError{}
+	fail := func(err error) BatchError {
+		for _, key := range keys {
+			failed[key] = err
+		}
+		return failed
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/store?op=%s&vnode=%x", owner.Host(), op, owner.ID()), body)
+	if err != nil {
+		return fail(err)
+	}
+	req.Header.Set("Content-Type", ndjsonContentType)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fail(fmt.Errorf("%w: %v", ErrNodeUnreachable, err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fail(statusError(resp))
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var entry batchEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(err)
+		}
+		switch {
+		case entry.NotFound:
+			failed[entry.Key] = ErrKeyNotFound
+		case entry.Error != "":
+			failed[entry.Key] = fmt.Errorf("%s: %s", owner.Host(), entry.Error)
+		case yield != nil:
+			yield(entry)
+		}
+	}
+	return failed
+}
+
+// serveBatch answers op=SetBatch, whose body is newline-delimited records, with an entry
+// for each key that failed, and op=GetBatch, whose body is a JSON array of keys, with an
+// entry for every key. Keys this node no longer owns are forwarded to their owner.
+func (s *DHTServer) serveBatch(w http.ResponseWriter, req *http.Request) {
+	var entries []batchEntry
+	var failed BatchError
+	switch req.URL.Query().Get("op") {
+	case "SetBatch":
+		var records []record
+		corrupt := BatchError{}
+		dec := json.NewDecoder(req.Body)
+		for {
+			var rec record
+			if err := dec.Decode(&rec); err == io.EOF {
+				break
+			} else if err != nil {
+				w.WriteHeader(bodyStatus(err))
+				return
+			}
+			if err := rec.verify(); err != nil {
+				corrupt[rec.Key] = err
+				continue
+			}
+			records = append(records, rec)
+		}
+		failed = s.setBatch(records)
+		for key, err := range corrupt {
+			failed[key] = err
+		}
+	case "GetBatch":
+		var keys []uint64
+		if err := json.NewDecoder(req.Body).Decode(&keys); err != nil {
+			w.WriteHeader(bodyStatus(err))
+			return
+		}
+		var found map[uint64]batchEntry
+		found, failed = s.getBatch(keys)
+		for _, entry := range found {
+			entries = append(entries, entry)
+		}
+	}
+	for key, err := range failed {
+		entry := batchEntry{Key: key, NotFound: errors.Is(err, ErrKeyNotFound)}
+		if !entry.NotFound {
+			entry.Error = err.Error()
+		}
+		entries = append(entries, entry)
+	}
+	w.Header().Set("Content-Type", ndjsonContentType)
+	enc := json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			s.node.logger.Warn("writing batch failed", "err", err)
+			return
+		}
+	}
+}
+
+func keysOf(records map[uint64]record) []uint64 {
+	keys := make([]uint64, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,23 @@
+package chord
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBatchErrorMessage(t *testing.T) {
+	if got := (BatchError{}).Error(); got != "0 keys failed" {
+		t.Errorf("empty BatchError = %q", got)
+	}
+	e := BatchError{0x20: ErrKeyNotFound, 0x10: ErrNodeUnreachable}
+	if got, want := e.Error(), "2 keys failed, first 10: node unreachable"; got != want {
+		t.Errorf("BatchError = %q, want %q", got, want)
+	}
+	if err := (BatchError{}).err(); err != nil {
+		t.Errorf("empty BatchError.err() = %v, want nil", err)
+	}
+	var be BatchError
+	if !errors.As(e.err(), &be) || len(be) != 2 {
+		t.Errorf("BatchError.err() = %v, want the BatchError", e.err())
+	}
+}
@@ -0,0 +1,66 @@
+package chord
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBetween(t *testing.T) {
+	const last = math.MaxUint64
+	tests := []struct {
+		name       string
+		n1, n2, n3 uint64
+		want       bool
+	}{
+		{"inside", 10, 15, 20, true},
+		{"start excluded", 10, 10, 20, false},
+		{"end included", 10, 20, 20, true},
+		{"before start", 10, 5, 20, false},
+		{"after end", 10, 25, 20, false},
+		{"wraps past last", last - 10, last, 10, true},
+		{"wraps to zero", last - 10, 0, 10, true},
+		{"wraps to end", last - 10, 10, 10, true},
+		{"wrapping start excluded", last - 10, last - 10, 10, false},
+		{"wrapping gap", last - 10, 20, 10, false},
+		{"wrapping gap below start", last - 10, last - 11, 10, false},
+		{"zero start", 0, 1, 10, true},
+		{"zero start excluded", 0, 0, 10, false},
+		{"last end", 10, last, last, true},
+		{"last start", last, 0, 10, true},
+		{"last start excluded", last, last, 10, false},
+		{"full circle", 10, 15, 10, true},
+		{"full circle at end", 10, 10, 10, true},
+		{"full circle wrapped", 10, 5, 10, true},
+		{"full circle at zero", 0, 0, 0, true},
+		{"adjacent", 10, 11, 11, true},
+		{"adjacent gap", 11, 10, 10, true},
+	}
+	for _, tt := range tests {
+		if got := between(tt.n1, tt.n2, tt.n3); got != tt.want {
+			t.Errorf("%s: between(%d, %d, %d) = %v, want %v", tt.name, tt.n1, tt.n2, tt.n3, got, tt.want)
+		}
+	}
+}
+
+func TestStrictlyBetween(t *testing.T) {
+	const last = math.MaxUint64
+	tests := []struct {
+		name       string
+		n1, n2, n3 uint64
+		want       bool
+	}{
+		{"inside", 10, 15, 20, true},
+		{"start excluded", 10, 10, 20, false},
+		{"end excluded", 10, 20, 20, false},
+		{"wraps to zero", last - 10, 0, 10, true},
+		{"wrapping end excluded", last - 10, 10, 10, false},
+		{"full circle", 10, 15, 10, true},
+		{"full circle wrapped", 10, 5, 10, true},
+		{"full circle end excluded", 10, 10, 10, false},
+	}
+	for _, tt := range tests {
+		if got := strictlyBetween(tt.n1, tt.n2, tt.n3); got != tt.want {
+			t.Errorf("%s: strictlyBetween(%d, %d, %d) = %v, want %v", tt.name, tt.n1, tt.n2, tt.n3, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,395 @@
+package chord
+
+import (
+	"bytes"
+	"container/heap"
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy chooses which key a BoundedStore evicts when it is over its limits. A
+// BoundedStore serializes its calls, so implementations need not be safe for concurrent use.
+type EvictionPolicy interface {
+	// Add records that key was written, Touch that it was read, and Remove that it is gone.
+	Add(key uint64)
+	Touch(key uint64)
+	Remove(key uint64)
+	// Victim returns the key to evict next, or false if no key is held.
+	Victim() (uint64, bool)
+}
+
+// BoundedStore wraps a Store so that it holds at most MaxKeys keys and MaxBytes bytes of
+// values, evicting keys chosen by its policy on writes that exceed either limit, or with
+// NewRejectPolicy refusing such writes with ErrStoreFull. A zero
+// limit is unlimited. Limits apply to this node's store alone, and an evicted key is lost
+// from this node only, so it suits caches rather than data that must be kept.
+//
+// Expired keys count against the limits until they are evicted or deleted. Writes are
+// checked against the limits as they start, so concurrent writes can overshoot a rejecting
+// store by the writes in flight.
+type BoundedStore struct {
+	Store
+	MaxKeys  int
+	MaxBytes int64
+
+	mu        sync.Mutex
+	policy    EvictionPolicy
+	sizes     map[uint64]int64
+	size      int64
+	evictions uint64
+}
+
+var _ Store = (*BoundedStore)(nil)
+
+// NewBoundedStore wraps store, accounting for the values it already holds. A nil policy
+// evicts the least recently used key.
+func NewBoundedStore(store Store, maxKeys int, maxBytes int64, policy EvictionPolicy) *BoundedStore {
+	if policy == nil {
+		policy = NewLRU()
+	}
+	s := &BoundedStore{Store: store, MaxKeys: maxKeys, MaxBytes: maxBytes, policy: policy, sizes: map[uint64]int64{}}
+	for key, value := range store.All() {
+		s.sizes[key] = int64(len(value))
+		s.size += int64(len(value))
+		policy.Add(key)
+	}
+	s.mu.Lock()
+	s.evict()
+	s.mu.Unlock()
+	return s
+}
+
+// Len returns the number of keys held.
+func (s *BoundedStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sizes)
+}
+
+// Size returns the total size of the values held in bytes.
+func (s *BoundedStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Evictions returns the number of keys evicted so far.
+func (s *BoundedStore) Evictions() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.evictions
+}
+
+// written records that key now holds size bytes and evicts until the store is within its
+// limits.
+func (s *BoundedStore) written(key uint64, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.sizes[key]; ok {
+		s.size -= old
+	}
+	s.sizes[key] = size
+	s.size += size
+	s.policy.Add(key)
+	s.evict()
+}
+
+// removed forgets key.
+func (s *BoundedStore) removed(key uint64) {
+	if size, ok := s.sizes[key]; ok {
+		s.size -= size
+		delete(s.sizes, key)
+		s.policy.Remove(key)
+	}
+}
+
+// evict deletes victims until the store is within its limits. s.mu must be held.
+func (s *BoundedStore) evict() {
+	for (s.MaxKeys > 0 && len(s.sizes) > s.MaxKeys) || (s.MaxBytes > 0 && s.size > s.MaxBytes) {
+		key, ok := s.policy.Victim()
+		if !ok {
+			return
+		}
+		if err := s.Store.Delete(key); err != nil {
+			return
+		}
+		s.removed(key)
+		s.evictions++
+	}
+}
+
+// admit returns ErrStoreFull if the store rejects writes when full and writing size bytes
+// to key would take it over a limit.
+func (s *BoundedStore) admit(key uint64, size int64) error {
+	if _, ok := s.policy.(reject); !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.sizes[key]
+	keys := len(s.sizes)
+	if !ok {
+		keys++
+	}
+	if (s.MaxKeys > 0 && keys > s.MaxKeys) || (s.MaxBytes > 0 && s.size-old+size > s.MaxBytes) {
+		return fmt.Errorf("%w: writing %d bytes to %x", ErrStoreFull, size, key)
+	}
+	return nil
+}
+
+// read buffers value so that its size is known before it is written.
+func read(value io.Reader) ([]byte, error) {
+	defer closeReader(value)
+	return io.ReadAll(value)
+}
+
+func (s *BoundedStore) Set(key uint64, value io.Reader) error {
+	b, err := read(value)
+	if err != nil {
+		return err
+	}
+	if err := s.admit(key, int64(len(b))); err != nil {
+		return err
+	}
+	if err := s.Store.Set(key, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	s.written(key, int64(len(b)))
+	return nil
+}
+
+func (s *BoundedStore) SetWithTTL(key uint64, value io.Reader, ttl time.Duration) error {
+	b, err := read(value)
+	if err != nil {
+		return err
+	}
+	if err := s.admit(key, int64(len(b))); err != nil {
+		return err
+	}
+	if err := s.Store.SetWithTTL(key, bytes.NewReader(b), ttl); err != nil {
+		return err
+	}
+	s.written(key, int64(len(b)))
+	return nil
+}
+
+func (s *BoundedStore) SetVersioned(key uint64, value io.Reader, version Version) error {
+	return s.SetVersionedWithTTL(key, value, version, 0)
+}
+
+func (s *BoundedStore) SetVersionedWithTTL(key uint64, value io.Reader, version Version, ttl time.Duration) error {
+	b, err := read(value)
+	if err != nil {
+		return err
+	}
+	if err := s.admit(key, int64(len(b))); err != nil {
+		return err
+	}
+	if err := s.Store.SetVersionedWithTTL(key, bytes.NewReader(b), version, ttl); err != nil {
+		return err
+	}
+	// a newer version may have been kept instead, in which case its size is already known.
+	if current, stored, err := s.Store.GetVersioned(key); err == nil {
+		closeReader(current)
+		if stored != version {
+			return nil
+		}
+	}
+	s.written(key, int64(len(b)))
+	return nil
+}
+
+func (s *BoundedStore) Get(key uint64) (io.Reader, error) {
+	value, _, err := s.GetVersioned(key)
+	return value, err
+}
+
+func (s *BoundedStore) GetVersioned(key uint64) (io.Reader, Version, error) {
+	value, version, err := s.Store.GetVersioned(key)
+	if err == nil {
+		s.mu.Lock()
+		if _, ok := s.sizes[key]; ok {
+			s.policy.Touch(key)
+		}
+		s.mu.Unlock()
+	}
+	return value, version, err
+}
+
+func (s *BoundedStore) CompareAndSwap(key uint64, old, new []byte, version Version) (bool, error) {
+	if err := s.admit(key, int64(len(new))); err != nil {
+		return false, err
+	}
+	swapped, err := s.Store.CompareAndSwap(key, old, new, version)
+	if swapped {
+		s.written(key, int64(len(new)))
+	}
+	return swapped, err
+}
+
+func (s *BoundedStore) Delete(key uint64) error {
+	if err := s.Store.Delete(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removed(key)
+	return nil
+}
+
+func (s *BoundedStore) Constrain(a, b uint64) error {
+	if err := s.Store.Constrain(a, b); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.sizes {
+		if !between(a, key, b) {
+			s.removed(key)
+		}
+	}
+	return nil
+}
+
+func (s *BoundedStore) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("bounded[%d keys, %d bytes]", len(s.sizes), s.size)
+}
+
+// reject never evicts, so that a BoundedStore using it refuses writes when full.
+type reject struct{}
+
+// NewRejectPolicy returns a policy that evicts nothing, for stores whose keys must not be
+// lost. Writes that would take the store over a limit fail with ErrStoreFull instead.
+func NewRejectPolicy() EvictionPolicy {
+	return reject{}
+}
+
+func (reject) Add(key uint64)         {}
+func (reject) Touch(key uint64)       {}
+func (reject) Remove(key uint64)      {}
+func (reject) Victim() (uint64, bool) { return 0, false }
+
+// lru evicts the key least recently written or read.
+type lru struct {
+	order    *list.List
+	elements map[uint64]*list.Element
+}
+
+// NewLRU returns a policy that evicts the least recently used key.
+func NewLRU() EvictionPolicy {
+	return &lru{order: list.New(), elements: map[uint64]*list.Element{}}
+}
+
+func (p *lru) Add(key uint64) {
+	p.Touch(key)
+}
+
+func (p *lru) Touch(key uint64) {
+	if e, ok := p.elements[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *lru) Remove(key uint64) {
+	if e, ok := p.elements[key]; ok {
+		p.order.Remove(e)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lru) Victim() (uint64, bool) {
+	e := p.order.Back()
+	if e == nil {
+		return 0, false
+	}
+	return e.Value.(uint64), true
+}
+
+// lfu evicts the key used least often, breaking ties by evicting the one used least recently.
+type lfu struct {
+	entries lfuHeap
+	byKey   map[uint64]*lfuEntry
+	tick    uint64
+}
+
+type lfuEntry struct {
+	key   uint64
+	count uint64
+	last  uint64
+	index int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count < h[j].count
+	}
+	return h[i].last < h[j].last
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *lfuHeap) Push(x any) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *lfuHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// NewLFU returns a policy that evicts the least frequently used key. Writes and reads both
+// count as uses, and ties go to the key used least recently.
+func NewLFU() EvictionPolicy {
+	return &lfu{byKey: map[uint64]*lfuEntry{}}
+}
+
+func (p *lfu) Add(key uint64) {
+	p.Touch(key)
+}
+
+func (p *lfu) Touch(key uint64) {
+	p.tick++
+	if e, ok := p.byKey[key]; ok {
+		e.count++
+		e.last = p.tick
+		heap.Fix(&p.entries, e.index)
+		return
+	}
+	// start at the count of the least used key rather than at one, so that a new key is
+	// not evicted ahead of keys that have been used no more than it since it arrived.
+	count := uint64(1)
+	if len(p.entries) > 0 {
+		count = p.entries[0].count
+	}
+	e := &lfuEntry{key: key, count: count, last: p.tick}
+	p.byKey[key] = e
+	heap.Push(&p.entries, e)
+}
+
+func (p *lfu) Remove(key uint64) {
+	if e, ok := p.byKey[key]; ok {
+		heap.Remove(&p.entries, e.index)
+		delete(p.byKey, key)
+	}
+}
+
+func (p *lfu) Victim() (uint64, bool) {
+	if len(p.entries) == 0 {
+		return 0, false
+	}
+	return p.entries[0].key, true
+}
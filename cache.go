@@ -0,0 +1,127 @@
+package chord
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultLookupCacheTTL is how long a cached lookup is trusted when Config.LookupCacheTTL is unset.
+const DefaultLookupCacheTTL = time.Second
+
+// cacheBucketBits is the number of high bits of an id that select its cache bucket.
+const cacheBucketBits = 16
+
+// lookupCache remembers recent FindSuccessor results by key-range bucket. Finding that node
+// succeeds start means no node lies in [start, node), so the entry answers any id in
+// [start, node] until it expires or the routing state changes.
+type lookupCache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[uint64]lookupEntry
+}
+
+type lookupEntry struct {
+	start   uint64
+	node    Node
+	expires time.Time
+}
+
+// newLookupCache returns a cache of at most size buckets, or nil if size is zero. A nil
+// cache misses every lookup.
+func newLookupCache(size int, ttl time.Duration) *lookupCache {
+	if size <= 0 {
+		return nil
+	}
+	if ttl <= 0 {
+		ttl = DefaultLookupCacheTTL
+	}
+	return &lookupCache{size: size, ttl: ttl, entries: map[uint64]lookupEntry{}}
+}
+
+func (c *lookupCache) get(id uint64) Node {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[id>>(M-cacheBucketBits)]
+	if !ok || !between(e.start-1, id, e.node.ID()) {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, id>>(M-cacheBucketBits))
+		return nil
+	}
+	return e.node
+}
+
+func (c *lookupCache) put(id uint64, node Node) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	bucket := id >> (M - cacheBucketBits)
+	if _, ok := c.entries[bucket]; !ok && len(c.entries) >= c.size {
+		// evict an arbitrary entry, preferring an expired one.
+		now := time.Now()
+		var victim uint64
+		for b, e := range c.entries {
+			victim = b
+			if now.After(e.expires) {
+				break
+			}
+		}
+		delete(c.entries, victim)
+	}
+	c.entries[bucket] = lookupEntry{start: id, node: node, expires: time.Now().Add(c.ttl)}
+}
+
+// clear drops every entry, called whenever the fingers or successors change.
+func (c *lookupCache) clear() {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.entries = map[uint64]lookupEntry{}
+}
+
+// flightGroup coalesces concurrent lookups for the same id, so that a hotspot costs one
+// walk rather than one per request. Calls are forgotten as soon as they complete, so a
+// failed lookup is only shared with the callers that were already waiting on it.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[uint64]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	node Node
+	err  error
+}
+
+// do returns the result of fn, or of the call to fn already in flight for id.
+func (g *flightGroup) do(id uint64, fn func() (Node, error)) (Node, error) {
+	g.mu.Lock()
+	if f, ok := g.calls[id]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.node, f.err
+	}
+	if g.calls == nil {
+		g.calls = map[uint64]*flight{}
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[id] = f
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, id)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.node, f.err = fn()
+	return f.node, f.err
+}
@@ -0,0 +1,104 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// casRequest is the body of a /store?op=CompareAndSwap request. A null Old expects the
+// key to be absent.
+type casRequest struct {
+	Old []byte `json:"old"`
+	New []byte `json:"new"`
+}
+
+// CompareAndSwap sets key to new if it holds old, or is absent if old is nil, reporting
+// whether it did. The check runs against the owner's store, which serializes concurrent
+// swaps of the same key, and a successful swap is replicated like any other write.
+func (s *DHTServer) CompareAndSwap(key uint64, old, new []byte) (bool, error) {
+	return s.compareAndSwap(context.Background(), key, old, new)
+}
+
+// compareAndSwap is CompareAndSwap made with ctx.
+func (s *DHTServer) compareAndSwap(ctx context.Context, key uint64, old, new []byte) (bool, error) {
+	s.InvalidateCached(key)
+	node, err := s.lookupContext(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if node.ID() == s.node.ID() {
+		return s.compareAndSwapLocal(ctx, key, old, new)
+	}
+	body, err := json.Marshal(casRequest{Old: old, New: new})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s/store?key=%x&op=CompareAndSwap&vnode=%x", node.Host(), key, node.ID()), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 200:
+		return true, nil
+	case 412:
+		return false, nil
+	}
+	return false, statusError(resp)
+}
+
+func (s *DHTServer) compareAndSwapLocal(ctx context.Context, key uint64, old, new []byte) (bool, error) {
+	current, prev, err := s.store.GetVersioned(key)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return false, err
+	}
+	closeReader(current)
+	// a write landing after prev was read has a newer version, failing the swap.
+	version := nextVersion(s.node.ID(), prev)
+	if ok, err := s.store.CompareAndSwap(key, old, new, version); err != nil || !ok {
+		return false, err
+	}
+	s.publish(Change{Type: KeySet, Key: key, Version: version})
+	return true, s.replicate(s.replicas(), func(_ int, m Node) error {
+		return s.setReplica(ctx, m, key, bytes.NewReader(new), version, 0)
+	})
+}
+
+// serveCompareAndSwap answers 200 if the swap happened and 412 if the key did not hold
+// the expected value.
+func (s *DHTServer) serveCompareAndSwap(w http.ResponseWriter, req *http.Request) {
+	key, err := strconv.ParseUint(req.URL.Query().Get("key"), 16, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	var body casRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.WriteHeader(bodyStatus(err))
+		return
+	}
+	if s.MaxValueSize > 0 && int64(max(len(body.Old), len(body.New))) > s.MaxValueSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	ok, err := s.compareAndSwap(req.Context(), key, body.Old, body.New)
+	if err != nil {
+		writeStoreError(w, s.node.logger.With("key", fmt.Sprintf("%x", key)), err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(412)
+		return
+	}
+	w.WriteHeader(200)
+}
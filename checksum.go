@@ -0,0 +1,229 @@
+package chord
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ChecksumHeader carries the hex CRC-32C of a value on /store requests and responses.
+// Values are streamed, so it is sent as a trailer once the value has been read, or as a
+// header by clients that know it up front. Values arriving without one are not checked.
+const ChecksumHeader = "X-Chord-Checksum"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the hex CRC-32C of b.
+func checksum(b []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(b, castagnoli))
+}
+
+// checksumReader computes the CRC-32C of everything read through it, calling done with
+// it on EOF. An error from done is returned in place of EOF, and by every later read.
+type checksumReader struct {
+	io.Reader
+	crc  uint32
+	done func(sum string) error
+	err  error
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.Reader.Read(p)
+	r.crc = crc32.Update(r.crc, castagnoli, p[:n])
+	if err == io.EOF {
+		if derr := r.done(fmt.Sprintf("%08x", r.crc)); derr != nil {
+			r.err = derr
+			return n, derr
+		}
+	}
+	return n, err
+}
+
+func (r *checksumReader) Close() error {
+	if c, ok := r.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// newChecksumRequest is http.NewRequest sending the checksum of body as a trailer.
+func newChecksumRequest(method, url string, body io.Reader) (*http.Request, error) {
+	trailer := http.Header{ChecksumHeader: nil}
+	req, err := http.NewRequest(method, url, &checksumReader{Reader: body, done: func(sum string) error {
+		trailer.Set(ChecksumHeader, sum)
+		return nil
+	}})
+	if err != nil {
+		return nil, err
+	}
+	req.Trailer = trailer
+	return req, nil
+}
+
+// cloneRequest clones req for a transport to modify, keeping its Trailer so that trailers
+// set while the body is being sent, such as the checksum, still reach the peer.
+func cloneRequest(req *http.Request) *http.Request {
+	clone := req.Clone(req.Context())
+	clone.Trailer = req.Trailer
+	return clone
+}
+
+// verifyChecksum makes body fail with ErrCorrupt at its end if it does not match the
+// checksum in header, or failing that in the trailer, which is only complete by then. A
+// trailer that was announced but never sent means the sender failed partway through.
+func verifyChecksum(body io.ReadCloser, header, trailer *http.Header) io.ReadCloser {
+	return &checksumReader{Reader: body, done: func(sum string) error {
+		want := header.Get(ChecksumHeader)
+		if _, announced := (*trailer)[ChecksumHeader]; want == "" && announced {
+			if want = trailer.Get(ChecksumHeader); want == "" {
+				return fmt.Errorf("%w: checksum trailer missing", ErrCorrupt)
+			}
+		}
+		if want != "" && want != sum {
+			return fmt.Errorf("%w: checksum %s, expected %s", ErrCorrupt, sum, want)
+		}
+		return nil
+	}}
+}
+
+// verifyResponse checks the value in resp's body against its checksum as it is read.
+func verifyResponse(resp *http.Response) io.ReadCloser {
+	return verifyChecksum(resp.Body, &resp.Header, &resp.Trailer)
+}
+
+// verify checks rec's value against its checksum, if the sender included one.
+func (rec *record) verify() error {
+	if rec.Checksum != "" && rec.Checksum != checksum(rec.Value) {
+		return fmt.Errorf("%w: key %x", ErrCorrupt, rec.Key)
+	}
+	return nil
+}
+
+// checksumSize is the length of the checksum ChecksumStore stores before each value.
+const checksumSize = 4
+
+// ChecksumStore wraps a Store, keeping a CRC-32C with each value and checking it on every
+// read, so that a value damaged at rest, such as by a failing disk, is reported with
+// ErrCorrupt rather than served. DHTServer answers a corrupt owner's reads from its
+// replicas, and with ReadRepair set writes the value back to it. Values written before
+// the store was wrapped have no checksum and read as corrupt.
+type ChecksumStore struct {
+	Store
+}
+
+var _ Store = (*ChecksumStore)(nil)
+
+// NewChecksumStore wraps store with checksums.
+func NewChecksumStore(store Store) *ChecksumStore {
+	return &ChecksumStore{Store: store}
+}
+
+// sum prefixes value with its checksum.
+func (s *ChecksumStore) sum(value []byte) []byte {
+	if value == nil {
+		return nil
+	}
+	return append(binary.BigEndian.AppendUint32(make([]byte, 0, checksumSize+len(value)), crc32.Checksum(value, castagnoli)), value...)
+}
+
+// sumReader reads value and prefixes it with its checksum.
+func (s *ChecksumStore) sumReader(value io.Reader) (io.Reader, error) {
+	b, err := io.ReadAll(value)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(s.sum(b)), nil
+}
+
+// check strips the checksum from a stored value, failing if it does not match.
+func (s *ChecksumStore) check(key uint64, stored []byte) ([]byte, error) {
+	if len(stored) < checksumSize {
+		return nil, fmt.Errorf("%w: key %x has no checksum", ErrCorrupt, key)
+	}
+	value := stored[checksumSize:]
+	if binary.BigEndian.Uint32(stored) != crc32.Checksum(value, castagnoli) {
+		return nil, fmt.Errorf("%w: key %x", ErrCorrupt, key)
+	}
+	return value, nil
+}
+
+func (s *ChecksumStore) Set(key uint64, value io.Reader) error {
+	summed, err := s.sumReader(value)
+	if err != nil {
+		return err
+	}
+	return s.Store.Set(key, summed)
+}
+
+func (s *ChecksumStore) Get(key uint64) (io.Reader, error) {
+	value, _, err := s.GetVersioned(key)
+	return value, err
+}
+
+func (s *ChecksumStore) SetVersioned(key uint64, value io.Reader, version Version) error {
+	summed, err := s.sumReader(value)
+	if err != nil {
+		return err
+	}
+	return s.Store.SetVersioned(key, summed, version)
+}
+
+func (s *ChecksumStore) SetWithTTL(key uint64, value io.Reader, ttl time.Duration) error {
+	summed, err := s.sumReader(value)
+	if err != nil {
+		return err
+	}
+	return s.Store.SetWithTTL(key, summed, ttl)
+}
+
+func (s *ChecksumStore) SetVersionedWithTTL(key uint64, value io.Reader, version Version, ttl time.Duration) error {
+	summed, err := s.sumReader(value)
+	if err != nil {
+		return err
+	}
+	return s.Store.SetVersionedWithTTL(key, summed, version, ttl)
+}
+
+func (s *ChecksumStore) GetVersioned(key uint64) (io.Reader, Version, error) {
+	value, version, err := s.Store.GetVersioned(key)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	b, err := io.ReadAll(value)
+	closeReader(value)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	if b, err = s.check(key, b); err != nil {
+		return nil, Version{}, err
+	}
+	return bytes.NewReader(b), version, nil
+}
+
+// CompareAndSwap compares the stored values with their checksums, which are determined by
+// the values, so that a corrupt value never matches.
+func (s *ChecksumStore) CompareAndSwap(key uint64, old, new []byte, version Version) (bool, error) {
+	return s.Store.CompareAndSwap(key, s.sum(old), s.sum(new), version)
+}
+
+// All returns every value whose checksum matches.
+func (s *ChecksumStore) All() map[uint64][]byte {
+	out := map[uint64][]byte{}
+	for key, stored := range s.Store.All() {
+		if value, err := s.check(key, stored); err == nil {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+func (s *ChecksumStore) String() string {
+	return fmt.Sprintf("checksummed[%d keys]", s.Store.Len())
+}
@@ -2,20 +2,77 @@ package chord
 
 import (
 	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const M = 64
-const R = 4 // 32 for production
+const R = 4 // default replication factor, 32 for production
 
+// DefaultTimeout bounds each RPC made with the default client.
+const DefaultTimeout = 5 * time.Second
+
+// DefaultMaxIdleConnsPerHost caps the keep-alive connections held open to each peer. The
+// standard library keeps two, so under heavy lookup load most RPCs would otherwise pay
+// for a new connection.
+const DefaultMaxIdleConnsPerHost = 32
+
+// sharedTransport carries every RPC made without an explicitly configured transport, so
+// that all the RemoteNodes minted for a host draw on one pool of connections to it.
+var sharedTransport = newSharedTransport()
+
+func newSharedTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 0
+	t.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	return t
+}
+
+// defaultClient returns a client with DefaultTimeout on the shared transport.
+func defaultClient() *http.Client {
+	return &http.Client{Timeout: DefaultTimeout, Transport: sharedTransport}
+}
+
+// DefaultStabilizeInterval and DefaultFixFingersInterval are how often a node stabilizes
+// and repairs a finger. Shorter intervals heal the ring sooner after joins and failures,
+// but every stabilization costs a few RPCs to the successor and every finger repair a
+// lookup, so background traffic grows with both ring size and tick rate.
+const (
+	DefaultStabilizeInterval  = 1 * time.Second
+	DefaultFixFingersInterval = 100 * time.Millisecond
+)
+
+// DefaultJitter is the fraction each stabilization interval is randomly lengthened or
+// shortened by, so that nodes started together do not keep ticking in lockstep.
+const DefaultJitter = 0.2
+
+// jitter returns d varied randomly by up to the given fraction in either direction.
+func jitter(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
+
+// between reports whether n2 lies in the half-open interval (n1, n3] walking clockwise,
+// so the interval wraps around zero when n1 > n3 and is the whole circle when n1 == n3.
+// This matches ownership: a node owns the keys after its predecessor up to its own id.
 func between(n1, n2, n3 uint64) bool {
 	if n1 < n3 {
 		return n1 < n2 && n2 <= n3
@@ -23,78 +80,508 @@ func between(n1, n2, n3 uint64) bool {
 	return n1 < n2 || n2 <= n3 || n1 == n3
 }
 
+// strictlyBetween reports whether n2 lies in the open interval (n1, n3) walking clockwise,
+// which is the whole circle except n3 when n1 == n3. A node strictly between another and a
+// key precedes the key rather than owning it.
+func strictlyBetween(n1, n2, n3 uint64) bool {
+	return n2 != n3 && between(n1, n2, n3)
+}
+
+// canonicalHost validates a host:port pair and rewrites it in the form net.JoinHostPort
+// produces, bracketing IPv6 literals so the host can be embedded directly in a URL. The
+// pair may be followed by the base path a node's handlers are mounted under, such as
+// 10.0.0.5:5001/chord, which is kept without a trailing slash.
+func canonicalHost(host string) (string, error) {
+	path := ""
+	if i := strings.Index(host, "/"); i >= 0 {
+		host, path = host[:i], strings.TrimRight(host[i:], "/")
+	}
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(h, port) + path, nil
+}
+
+// basePath returns the path a canonical host's handlers are mounted under, if any.
+func basePath(host string) string {
+	if i := strings.Index(host, "/"); i >= 0 {
+		return host[i:]
+	}
+	return ""
+}
+
+// HashKey maps a string into the identifier space using the top M bits of its SHA-1 digest.
+func HashKey(key string) uint64 {
+	sum := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// hashWith maps key into the identifier space with hash, or with HashKey if hash is nil.
+func hashWith(hash func(string) uint64, key string) uint64 {
+	if hash == nil {
+		return HashKey(key)
+	}
+	return hash(key)
+}
+
+// HostID derives a node id from the address it advertises, hashed as HashKey hashes keys,
+// so that a node restarted on the same host takes back its place in the ring along with
+// the keys it held. host is canonicalized first, so spellings of the same address agree.
+func HostID(host string) (uint64, error) {
+	host, err := canonicalHost(host)
+	if err != nil {
+		return 0, err
+	}
+	return HashKey(host), nil
+}
+
 type Node interface {
 	ID() uint64
 	Host() string
-	Successors() ([R]Node, error)
-	Predecessor() (Node, error)
-	FindSuccessor(uint64) (Node, error)
-	Notify(Node) error
+	Successors(context.Context) ([]Node, error)
+	Predecessor(context.Context) (Node, error)
+	// Predecessors returns the predecessor followed by the nodes preceding it, nearest
+	// first, or nothing if there is no predecessor yet.
+	Predecessors(context.Context) ([]Node, error)
+	FindSuccessor(context.Context, uint64) (Node, error)
+	ClosestPrecedingNode(context.Context, uint64) (Node, error)
+	// NextHop performs one step of a lookup for id, returning either the successor of id
+	// with done set or the next node to ask.
+	NextHop(context.Context, uint64) (next Node, done bool, err error)
+	Notify(context.Context, Node) error
+	Ping(context.Context) error
+	NotifyLeave(context.Context, Node, Node) error
 	Serialize() string
 }
 
+// WireFormat selects how nodes are serialized in RPC responses.
+type WireFormat int
+
+const (
+	// WireLegacy encodes a node as "<id>:<host>".
+	WireLegacy WireFormat = iota
+	// WireJSON encodes a node as {"id": "<id>", "host": "<host>"}.
+	WireJSON
+)
+
+// JoinStrategy selects how a joining node fills its successor list.
+type JoinStrategy int
+
+const (
+	// JoinCopy takes the successor's own successor list, which costs one RPC but is only
+	// as complete as the successor's view. In a small or growing ring that view may not
+	// yet include the nodes that joined just before, leaving the list padded with repeats
+	// until stabilization fills it in.
+	JoinCopy JoinStrategy = iota
+	// JoinLookup builds the list with a lookup per entry through the node joined through,
+	// walking clockwise from the successor until the list is full or comes back around,
+	// so that it holds every node the ring already routes to.
+	JoinLookup
+)
+
+// nodeJSON is the WireJSON representation of a node.
+type nodeJSON struct {
+	ID   string `json:"id"`
+	Host string `json:"host"`
+}
+
+// Config tunes a LocalNode. The zero value is valid and yields the defaults.
+type Config struct {
+	// Replicas is the length of the successor list, defaulting to R.
+	Replicas int
+	// Client is used for all RPCs to remote nodes, defaulting to a client with DefaultTimeout
+	// that shares its connections with every other default client.
+	Client *http.Client
+	// WireFormat is the format nodes are served in. Either format is accepted from peers,
+	// so a ring can be upgraded one node at a time.
+	WireFormat WireFormat
+	// JoinStrategy is how the successor list is filled on join, defaulting to JoinCopy.
+	JoinStrategy JoinStrategy
+	// FingerSweep repairs the whole finger table with FixAllFingers on join and every
+	// stabilization instead of fixing one finger per tick.
+	FingerSweep bool
+	// LookupCacheSize is the number of key-range buckets whose FindSuccessor results are
+	// cached. Zero disables the cache.
+	LookupCacheSize int
+	// LookupCacheTTL bounds how long a cached result is used, defaulting to DefaultLookupCacheTTL.
+	LookupCacheTTL time.Duration
+	// JoinBackoff, when set, makes NewLocalNodeWithSeeds retry the join with JoinWithRetry
+	// starting from this delay, rather than failing on the first unsuccessful attempt.
+	JoinBackoff time.Duration
+	// JoinTimeout, when set, bounds the whole join, retries included, so that a seed that
+	// accepts connections but never answers cannot hang startup. A join that runs out of
+	// time fails with ErrJoinTimeout. It does not limit the node once it has joined.
+	JoinTimeout time.Duration
+	// Snapshot, when set, is routing state saved by an earlier run of the node with
+	// LocalNode.Snapshot. NewLocalNodeWithSeeds restores it with Restore rather than
+	// joining through the seeds, which it falls back to if the snapshot is stale.
+	Snapshot *Snapshot
+	// TLS, when set, makes every RPC to remote nodes over https with this configuration,
+	// including the Client's. Serve HTTPServeMux with the same configuration, such as one
+	// from MutualTLSConfig, for peers to authenticate each other.
+	TLS *tls.Config
+	// Secret, when set, is the shared cluster secret every RPC is signed with. Requests that
+	// change the ring or the store are refused with 401 unless signed with it.
+	Secret []byte
+	// AuthenticateReads extends Secret to read-only requests too.
+	AuthenticateReads bool
+	// StabilizeInterval is how often the successor list and predecessor are refreshed,
+	// defaulting to DefaultStabilizeInterval.
+	StabilizeInterval time.Duration
+	// FixFingersInterval is how often one finger is repaired, defaulting to
+	// DefaultFixFingersInterval. With FingerSweep fingers are repaired on stabilization instead.
+	FixFingersInterval time.Duration
+	// Jitter is the fraction, between 0 and 1, that each stabilization and finger repair
+	// interval is randomly varied by, defaulting to DefaultJitter. A negative value disables it.
+	Jitter float64
+	// Logger receives the node's log output, annotated with its id. Nothing is logged if nil.
+	Logger *slog.Logger
+	// Weight is the capacity of the host relative to the others in the ring, defaulting to
+	// 1. NewWeightedVirtualHost runs proportionally more vnodes on hosts with more weight.
+	Weight float64
+	// Tracer, when set, records a span for every RPC this node makes and serves and for
+	// each Get and Set through its DHTServer, propagating the trace between nodes in the
+	// request headers so that a lookup shows up as one trace across its hops. The RPCs
+	// made to serve a /store request join its trace; those made by calls without a
+	// context, and by background work such as stabilization, start traces of their own.
+	Tracer Tracer
+	// Middleware wraps the /node and /store handlers of HTTPServeMux, for behaviour such as
+	// logging or tracing around every RPC. It sees each request as it arrives, before the
+	// node's own authentication, rate limiting and decompression. The first is outermost,
+	// so Middleware{a, b} serves a(b(handler)). The probe and metrics handlers are left
+	// unwrapped.
+	Middleware []func(http.Handler) http.Handler
+	// HostIDs makes NewWeightedVirtualHost derive its vnode ids from the host, as HostID
+	// does, rather than drawing them at random, so that a restarted host keeps its vnodes'
+	// places in the ring.
+	HostIDs bool
+}
+
 type LocalNode struct {
-	id            uint64
-	host          string
-	finger        [M]Node
-	successors    [R]Node
-	predecessor   Node
+	id   uint64
+	host string
+	// mu guards the routing state: finger, successors, predecessor, predecessors, siblings
+	// and the onPredecessor and onEvent handlers. It is never held across an RPC, so lookups
+	// are not blocked by a slow peer.
+	mu          sync.RWMutex
+	finger      [M]Node
+	successors  []Node
+	predecessor Node
+	// predecessors holds the nodes preceding the predecessor, nearest first.
+	predecessors  []Node
 	onPredecessor func(Node)
+	onEvent       []func(Event)
+	client        *http.Client
+	ctx           context.Context
+	cancel        context.CancelFunc
+	leave         sync.Once
+	metrics       *Metrics
+	wireFormat    WireFormat
+	joinStrategy  JoinStrategy
+	middleware    []func(http.Handler) http.Handler
+	tracer        Tracer
+	cache         *lookupCache
+	// siblings holds the other vnodes on this host so they can be reached without HTTP. It
+	// is set once every vnode has joined, while they are already stabilizing.
+	siblings map[uint64]*LocalNode
+	// lastStabilized is the time of the last successful Stabilize in unix nanoseconds.
+	lastStabilized int64
+	secret         []byte
+	authReads      bool
+	logger         *slog.Logger
+	// founder is set if the node started a new ring rather than joining one.
+	founder bool
+	health  health
+	// routes holds the most recent lookups made from this node for Info.
+	routes recentRoutes
+	// forceMu is held while a round forced through op=Stabilize runs, and guards lastForced,
+	// the time the last one started.
+	forceMu    sync.Mutex
+	lastForced time.Time
+	// drain is notDraining, draining or drained, read and written atomically.
+	drain int32
 }
 
+// The drain states of a LocalNode. A draining node refuses to take over a dead
+// predecessor's keys, and a drained one has been spliced out of the ring, which no longer
+// routes keys to it, but still answers RPCs.
+const (
+	notDraining int32 = iota
+	draining
+	drained
+)
+
 var _ Node = (*LocalNode)(nil)
 
+// NewLocalNode creates a node that joins the ring through m, or starts a new ring if m is
+// nil. host is the address peers dial to reach the node and is what it advertises; it can
+// differ from the address the server for HTTPServeMux listens on, for instance behind NAT.
 func NewLocalNode(ctx context.Context, id uint64, host string, m Node) (*LocalNode, error) {
-	n := &LocalNode{id: id, host: host}
+	return NewLocalNodeWithConfig(ctx, id, host, m, Config{})
+}
+
+func NewLocalNodeWithConfig(ctx context.Context, id uint64, host string, m Node, config Config) (*LocalNode, error) {
+	return newLocalNode(ctx, id, host, config, func(ctx context.Context, n *LocalNode) error {
+		if m == nil {
+			n.predecessor, n.founder = n, true
+			return nil
+		}
+		return n.join(ctx, m)
+	})
+}
+
+// NewLocalNodeWithSeeds creates a node that joins the ring through the first of the seed
+// addresses that responds, or starts a new ring if there are none.
+func NewLocalNodeWithSeeds(ctx context.Context, id uint64, host string, seeds []string, config Config) (*LocalNode, error) {
+	return newLocalNode(ctx, id, host, config, func(ctx context.Context, n *LocalNode) error {
+		if config.Snapshot != nil {
+			err := n.Restore(ctx, *config.Snapshot)
+			if err == nil || ctx.Err() != nil {
+				return err
+			}
+			n.logger.Warn("restoring routing state failed, joining through the seeds", "err", err)
+		}
+		if len(seeds) == 0 {
+			n.predecessor, n.founder = n, true
+			return nil
+		}
+		if config.JoinBackoff > 0 {
+			return n.JoinWithRetry(ctx, seeds, config.JoinBackoff)
+		}
+		return n.Join(ctx, seeds)
+	})
+}
+
+// joinIDAttempts is how many random ids are tried before giving up on a ring whose ids
+// keep colliding, which in practice means the random source is broken.
+const joinIDAttempts = 3
+
+// NewLocalNodeWithRandomID is NewLocalNodeWithSeeds with a random id, drawing a fresh one
+// if the ring already has a node with the id.
+func NewLocalNodeWithRandomID(ctx context.Context, host string, seeds []string, config Config) (*LocalNode, error) {
+	for attempt := 1; ; attempt++ {
+		n, err := NewLocalNodeWithSeeds(ctx, rand.Uint64(), host, seeds, config)
+		if !errors.Is(err, ErrDuplicateID) || attempt == joinIDAttempts {
+			return n, err
+		}
+		if config.Logger != nil {
+			config.Logger.Warn("node id taken, retrying with another", "err", err)
+		}
+	}
+}
+
+func newLocalNode(ctx context.Context, id uint64, host string, config Config, join func(context.Context, *LocalNode) error) (*LocalNode, error) {
+	if config.Replicas == 0 {
+		config.Replicas = R
+	} else if config.Replicas < 1 {
+		return nil, fmt.Errorf("%w: replication factor %d", ErrInvalidConfig, config.Replicas)
+	}
+	if config.Client == nil {
+		config.Client = defaultClient()
+	}
+	if config.StabilizeInterval == 0 {
+		config.StabilizeInterval = DefaultStabilizeInterval
+	}
+	if config.FixFingersInterval == 0 {
+		config.FixFingersInterval = DefaultFixFingersInterval
+	}
+	if config.Jitter == 0 {
+		config.Jitter = DefaultJitter
+	} else if config.Jitter > 1 {
+		return nil, fmt.Errorf("%w: jitter %v", ErrInvalidConfig, config.Jitter)
+	}
+	if config.StabilizeInterval < 0 || config.FixFingersInterval < 0 {
+		return nil, fmt.Errorf("%w: stabilization intervals %v and %v", ErrInvalidConfig, config.StabilizeInterval, config.FixFingersInterval)
+	}
+	host, err := canonicalHost(host)
+	if err != nil {
+		return nil, err
+	}
+	metrics := NewMetrics()
+	client := securedClient(config.Client, config.TLS, config.Secret)
+	client.Transport = metrics.Transport(client.Transport)
+	if config.Tracer != nil {
+		client.Transport = &tracingTransport{next: client.Transport, tracer: config.Tracer}
+	} else {
+		config.Tracer = noopTracer{}
+	}
+	if config.Logger == nil {
+		config.Logger = discardLogger
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	n := &LocalNode{
+		logger:       config.Logger.With("node", fmt.Sprintf("%x", id)),
+		id:           id,
+		host:         host,
+		successors:   make([]Node, config.Replicas),
+		client:       client,
+		ctx:          ctx,
+		cancel:       cancel,
+		metrics:      metrics,
+		wireFormat:   config.WireFormat,
+		joinStrategy: config.JoinStrategy,
+		middleware:   config.Middleware,
+		tracer:       config.Tracer,
+		cache:        newLookupCache(config.LookupCacheSize, config.LookupCacheTTL),
+		secret:       config.Secret,
+		authReads:    config.AuthenticateReads,
+	}
 	for i := 0; i < M; i++ {
 		n.finger[i] = n
 	}
-	for i := 0; i < R; i++ {
+	for i := range n.successors {
 		n.successors[i] = n
 	}
-	if m == nil {
-		n.predecessor = n
-	} else {
-		s, err := m.FindSuccessor(n.id)
-		if err != nil {
-			return nil, err
-		}
-		t, err := s.Successors()
-		if err != nil {
-			return nil, err
-		}
-		n.successors[0] = s
-		if copy(n.successors[1:], t[:(R-1)]) != R-1 {
-			return nil, io.ErrShortWrite
+	joinCtx := ctx
+	if config.JoinTimeout > 0 {
+		var cancelJoin context.CancelFunc
+		joinCtx, cancelJoin = context.WithTimeout(ctx, config.JoinTimeout)
+		defer cancelJoin()
+	} else if config.JoinTimeout < 0 {
+		cancel()
+		return nil, fmt.Errorf("%w: join timeout %v", ErrInvalidConfig, config.JoinTimeout)
+	}
+	if err := join(joinCtx, n); err != nil {
+		cancel()
+		if errors.Is(joinCtx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w: %w", ErrJoinTimeout, err)
 		}
+		return nil, err
 	}
 	go func() {
 		// start stabilization loops
-		stabilize := time.NewTicker(1 * time.Second)
-		fixFingers := time.NewTicker(100 * time.Millisecond)
+		stabilize := time.NewTimer(jitter(config.StabilizeInterval, config.Jitter))
+		fixFingers := time.NewTimer(jitter(config.FixFingersInterval, config.Jitter))
 		defer stabilize.Stop()
 		defer fixFingers.Stop()
+		if config.FingerSweep {
+			fixFingers.Stop()
+			if err := n.FixAllFingers(ctx); err != nil {
+				n.logger.Warn("fixing fingers failed", "err", err)
+			}
+		}
+		next := 0
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case <-stabilize.C:
-				if err := n.Stabilize(); err != nil {
-					for i := 0; i < R-1; i++ {
-						n.successors[i] = n.successors[i+1]
+				if err := n.Stabilize(ctx); err != nil {
+					n.logger.Warn("stabilization failed", "err", err)
+				}
+				if config.FingerSweep {
+					if err := n.FixAllFingers(ctx); err != nil {
+						n.logger.Warn("fixing fingers failed", "err", err)
 					}
 				}
-			case t := <-fixFingers.C:
-				if err := n.FixFingers(t.Nanosecond()); err != nil {
-					// TODO: this error is likely transient, can we remove it?
-					log.Printf("got error %v", err)
+				stabilize.Reset(jitter(config.StabilizeInterval, config.Jitter))
+			case <-fixFingers.C:
+				if err := n.FixFingers(ctx, next); err != nil {
+					// usually transient, so only logged at debug. the last one is kept for Info.
+					n.logger.Debug("fixing finger failed", "finger", next, "err", err)
 				}
+				next = (next + 1) % M
+				fixFingers.Reset(jitter(config.FixFingersInterval, config.Jitter))
 			}
 		}
 	}()
 	return n, nil
 }
 
+// Join points this node's successor list into the ring known to the first of seeds that
+// responds, trying each address in order. It fails only if every seed does, reporting
+// each error.
+func (n *LocalNode) Join(ctx context.Context, seeds []string) error {
+	var errs []string
+	for _, addr := range seeds {
+		m, err := resolveRemoteNode(ctx, addr, n.client)
+		if err == nil {
+			err = n.join(ctx, m)
+		}
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || errors.Is(err, ErrDuplicateID) {
+			// every seed leads to the same ring, so another would only say the same.
+			return err
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+	}
+	return fmt.Errorf("unable to join via any of %d nodes: %s", len(seeds), strings.Join(errs, "; "))
+}
+
+// maxJoinBackoff caps the delay between attempts in JoinWithRetry.
+const maxJoinBackoff = 30 * time.Second
+
+// JoinWithRetry calls Join until it succeeds or ctx is done, waiting backoff after the
+// first failed attempt and doubling the wait after each subsequent one up to maxJoinBackoff.
+// This lets nodes started in any order wait for the ring to come up.
+func (n *LocalNode) JoinWithRetry(ctx context.Context, seeds []string, backoff time.Duration) error {
+	for attempts := 1; ; attempts++ {
+		err := n.Join(ctx, seeds)
+		if err == nil || errors.Is(err, ErrDuplicateID) {
+			return err
+		}
+		n.logger.Warn("join failed, retrying", "attempt", attempts, "backoff", backoff, "err", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up joining after %d attempts: %w", attempts, err)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxJoinBackoff {
+			backoff = maxJoinBackoff
+		}
+	}
+}
+
+func (n *LocalNode) join(ctx context.Context, m Node) error {
+	s, err := m.FindSuccessor(ctx, n.id)
+	if err != nil {
+		return err
+	}
+	if s.ID() == n.id && s.Host() != n.host {
+		// the same id on the same host is this node restarting, which takes its place back.
+		return fmt.Errorf("%w: %x is taken by %s", ErrDuplicateID, n.id, s.Host())
+	}
+	var t []Node
+	if n.joinStrategy == JoinLookup {
+		t, err = n.lookupSuccessors(ctx, m, s)
+	} else {
+		t, err = s.Successors(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	successors := n.fillSuccessors(n.sibling(s), n.siblingList(t))
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	copy(n.successors, successors)
+	n.predecessor = nil
+	return nil
+}
+
+// lookupSuccessors finds the nodes following s by asking m for the successor of each in
+// turn, for JoinLookup. The walk stops once the list is full or it reaches this node or a
+// node already listed, having gone all the way around.
+func (n *LocalNode) lookupSuccessors(ctx context.Context, m, s Node) ([]Node, error) {
+	seen := map[uint64]bool{s.ID(): true}
+	var successors []Node
+	for prev := s; len(successors) < len(n.successors)-1; {
+		next, err := m.FindSuccessor(ctx, prev.ID()+1)
+		if err != nil {
+			return nil, err
+		}
+		if next.ID() == n.id || seen[next.ID()] {
+			break
+		}
+		seen[next.ID()] = true
+		successors = append(successors, next)
+		prev = next
+	}
+	return successors, nil
+}
+
 func (n *LocalNode) ID() uint64 {
 	return n.id
 }
@@ -103,100 +590,785 @@ func (n *LocalNode) Host() string {
 	return n.host
 }
 
-func (n *LocalNode) Successors() ([R]Node, error) {
-	return n.successors, nil
+func (n *LocalNode) Successors(ctx context.Context) ([]Node, error) {
+	return n.successorList(), nil
+}
+
+func (n *LocalNode) Predecessor(ctx context.Context) (Node, error) {
+	return n.currentPredecessor(), nil
+}
+
+func (n *LocalNode) Predecessors(ctx context.Context) ([]Node, error) {
+	return n.predecessorList(), nil
+}
+
+// Ready reports whether the node has taken its place in the ring: it has a predecessor
+// and, unless it started the ring itself, has stabilized onto a successor other than itself.
+func (n *LocalNode) Ready() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.predecessor == nil {
+		return false
+	}
+	return n.founder || (n.successors[0].ID() != n.id && atomic.LoadInt64(&n.lastStabilized) != 0)
+}
+
+// stable reports whether the node has settled into the ring: either it is alone, with
+// itself as successor and predecessor, or it has a predecessor other than itself and has
+// refilled its successor list from its successor at least once.
+func (n *LocalNode) stable() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.successors[0].ID() == n.id {
+		return n.predecessor != nil && n.predecessor.ID() == n.id
+	}
+	return n.predecessor != nil && n.predecessor.ID() != n.id && atomic.LoadInt64(&n.lastStabilized) != 0
+}
+
+// successorList returns a copy of the successor list.
+func (n *LocalNode) successorList() []Node {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return append([]Node(nil), n.successors...)
 }
 
-func (n *LocalNode) Predecessor() (Node, error) {
-	return n.predecessor, nil
+// successor returns the first entry of the successor list.
+func (n *LocalNode) successor() Node {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.successors[0]
 }
 
-func (n *LocalNode) FindSuccessor(id uint64) (Node, error) {
-	successors, err := n.Successors()
+func (n *LocalNode) currentPredecessor() Node {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.predecessor
+}
+
+// predecessorList returns the predecessor followed by a copy of the predecessor list.
+func (n *LocalNode) predecessorList() []Node {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.predecessor == nil {
+		return nil
+	}
+	return append([]Node{n.predecessor}, n.predecessors...)
+}
+
+// fingerTable returns a copy of the finger table.
+func (n *LocalNode) fingerTable() [M]Node {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.finger
+}
+
+func (n *LocalNode) FindSuccessor(ctx context.Context, id uint64) (Node, error) {
+	s, _, err := n.FindSuccessorRoute(ctx, id)
+	return s, err
+}
+
+// FindSuccessorRoute is FindSuccessor that also reports the route the lookup took.
+func (n *LocalNode) FindSuccessorRoute(ctx context.Context, id uint64) (Node, Route, error) {
+	var route Route
+	s, err := n.findSuccessor(ctx, id, &route)
+	n.metrics.observeLookup(route.Hops)
+	if err == nil {
+		n.routes.add(id, s, route)
+	}
+	return s, route, err
+}
+
+// findFinger is FindSuccessor for finger repair, which is left out of the recent lookups
+// so that they sample the lookups made for callers.
+func (n *LocalNode) findFinger(ctx context.Context, id uint64) (Node, error) {
+	var route Route
+	s, err := n.findSuccessor(ctx, id, &route)
+	n.metrics.observeLookup(route.Hops)
+	return s, err
+}
+
+func (n *LocalNode) findSuccessor(ctx context.Context, id uint64, route *Route) (Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if id == n.ID() && atomic.LoadInt32(&n.drain) != drained {
+		return n, nil
+	}
+	successors, err := n.Successors(ctx)
 	if err != nil {
 		return nil, err
 	}
 	if between(n.ID(), id, successors[0].ID()) {
 		return successors[0], nil
 	} else {
+		if s := n.cache.get(id); s != nil {
+			n.metrics.observeCache(true)
+			route.Cached = true
+			return s, nil
+		}
+		if n.cache != nil {
+			n.metrics.observeCache(false)
+		}
 		// forward the query around the circle.
-		return n.ClosestPrecedingNode(id).FindSuccessor(id)
+		m, err := n.ClosestPrecedingNode(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if m.ID() == n.ID() {
+			// the finger table has nothing closer, so walk the successor list instead.
+			m = successors[0]
+		}
+		route.hop(m)
+		s, err := n.walk(ctx, m, id, route)
+		if err != nil {
+			return nil, err
+		}
+		n.cache.put(id, s)
+		return s, nil
 	}
 }
 
-func (n *LocalNode) ClosestPrecedingNode(id uint64) Node {
+// FindSuccessorIterative resolves the successor of id starting from this node, as
+// FindSuccessor does once a lookup leaves it.
+func (n *LocalNode) FindSuccessorIterative(ctx context.Context, id uint64) (Node, error) {
+	var route Route
+	defer func() { n.metrics.observeLookup(route.Hops) }()
+	return n.walk(ctx, n, id, &route)
+}
+
+// walk drives a lookup for id from m by asking each hop for the next one and contacting
+// it directly, so that no hop holds a request open while the rest of the lookup runs.
+// Peers that cannot answer NextHop are left to resolve the rest recursively. A hop that
+// cannot be reached is routed around from the last hop that answered, as Stabilize does
+// for a dead successor.
+func (n *LocalNode) walk(ctx context.Context, m Node, id uint64, route *Route) (Node, error) {
+	visited := map[uint64]bool{}
+	dead := map[uint64]bool{}
+	var prev Node = n
+	for i := 0; i < 2*M; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		next, done, err := m.NextHop(ctx, id)
+		if errors.Is(err, errNoNextHop) {
+			return m.FindSuccessor(ctx, id)
+		} else if errors.Is(err, ErrNodeUnreachable) {
+			dead[m.ID()] = true
+			next, done, err = n.detour(ctx, prev, id, dead)
+			if err != nil {
+				return nil, err
+			}
+			if done {
+				return next, nil
+			}
+			m = next
+			route.hop(m)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if done {
+			return next, nil
+		}
+		visited[m.ID()] = true
+		if visited[next.ID()] {
+			return nil, fmt.Errorf("%w: revisited %s", ErrRoutingLoop, next.Serialize())
+		}
+		prev, m = m, next
+		route.hop(m)
+	}
+	return nil, fmt.Errorf("%w: exceeded %d hops", ErrRoutingLoop, 2*M)
+}
+
+// detour picks the next hop for id from prev, the last hop that answered, avoiding the
+// dead nodes. This node can use its fingers, but a remote hop is only asked for its
+// successor list, which is walked instead.
+func (n *LocalNode) detour(ctx context.Context, prev Node, id uint64, dead map[uint64]bool) (Node, bool, error) {
+	var candidates []Node
+	if prev.ID() == n.ID() {
+		if m := n.closestPrecedingNode(id, dead); m.ID() != n.ID() {
+			return m, false, nil
+		}
+		candidates = n.successorList()
+	} else {
+		var err error
+		if candidates, err = prev.Successors(ctx); err != nil {
+			return nil, false, err
+		}
+	}
+	// the list runs clockwise from prev, so the first live successor past id has taken
+	// over its keys from any dead ones before it. failing that, route via the furthest.
+	var next Node
+	for _, s := range candidates {
+		if dead[s.ID()] || s.ID() == prev.ID() {
+			continue
+		}
+		if between(prev.ID(), id, s.ID()) {
+			return s, true, nil
+		}
+		next = s
+	}
+	if next == nil {
+		return nil, false, fmt.Errorf("%w: no live successor of %s", ErrNodeUnreachable, prev.Serialize())
+	}
+	return next, false, nil
+}
+
+func (n *LocalNode) NextHop(ctx context.Context, id uint64) (Node, bool, error) {
+	if id == n.ID() && atomic.LoadInt32(&n.drain) != drained {
+		return n, true, nil
+	}
+	successors, err := n.Successors(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if between(n.ID(), id, successors[0].ID()) {
+		return successors[0], true, nil
+	}
+	m, err := n.ClosestPrecedingNode(ctx, id)
+	if err != nil {
+		return nil, false, err
+	}
+	if m.ID() == n.ID() {
+		// the finger table has nothing closer, so walk the successor list instead.
+		m = successors[0]
+	}
+	return m, false, nil
+}
+
+func (n *LocalNode) ClosestPrecedingNode(ctx context.Context, id uint64) (Node, error) {
+	return n.closestPrecedingNode(id, nil), nil
+}
+
+// closestPrecedingNode is ClosestPrecedingNode skipping the nodes in exclude.
+func (n *LocalNode) closestPrecedingNode(id uint64, exclude map[uint64]bool) Node {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
 	for i := M - 1; i >= 0; i-- {
-		if between(n.ID(), n.finger[i].ID(), id) {
-			return n.finger[i]
+		if f := n.finger[i]; f != nil && !exclude[f.ID()] && strictlyBetween(n.ID(), f.ID(), id) {
+			return f
+		}
+	}
+	// no usable finger, so route via the successor list instead.
+	for i := len(n.successors) - 1; i >= 0; i-- {
+		if s := n.successors[i]; s != nil && !exclude[s.ID()] && strictlyBetween(n.ID(), s.ID(), id) {
+			return s
 		}
 	}
 	return n
 }
 
-func (n *LocalNode) Stabilize() error {
-	x, err := n.successors[0].Predecessor()
+// Stabilize refreshes the successor list from the successor and notifies it of this node.
+// It commits optimistically so that mu is never held across an RPC, which would stall
+// every lookup behind a slow peer: the successor is read under the lock, the remote calls
+// are made without it, and the result is only written back if the successor is unchanged.
+// If something else, such as NotifyLeave, replaced it meanwhile, the round is abandoned and
+// the next one starts from the new successor. Changes here must keep RPCs outside mu.
+func (n *LocalNode) Stabilize(ctx context.Context) (err error) {
+	defer func() { n.health.record(&n.health.stabilizeErr, err) }()
+	before := n.successorIDs()
+	defer func() {
+		if after := n.successorIDs(); after != before {
+			n.cache.clear()
+		}
+	}()
+	successor := n.successor()
+	if err := successor.Ping(ctx); err != nil {
+		// the successor is dead, skip over it.
+		n.replaceSuccessor(ctx, successor)
+		return err
+	}
+	x, err := successor.Predecessor(ctx)
 	if err != nil {
 		return err
 	}
-	if between(n.ID(), x.ID(), n.successors[0].ID()) {
+	next := successor
+	if x != nil && between(n.ID(), x.ID(), successor.ID()) {
 		// discovered a new successor.
-		n.successors[0] = x
+		next = n.sibling(x)
+	} else if x != nil && x.ID() != n.ID() && atomic.LoadInt32(&n.drain) != drained {
+		next = n.reconcile(ctx, successor, x)
+	}
+	if (x == nil || x.ID() == n.ID()) && n.health.reconciled() {
+		n.logger.Info("successor's predecessor points back again", "successor", successor.Host())
 	}
-	y, err := n.successors[0].Successors()
+	y, err := next.Successors(ctx)
 	if err != nil {
 		return err
 	}
-	if copy(n.successors[1:], y[:(R-1)]) != R-1 {
-		return io.ErrShortWrite
+	successors := n.fillSuccessors(next, n.siblingList(y))
+	n.mu.Lock()
+	current := n.successors[0] == successor
+	if current {
+		copy(n.successors, successors)
+	}
+	n.mu.Unlock()
+	if !current {
+		return nil
+	}
+	if next != successor {
+		n.emit(Event{Type: SuccessorChanged, Node: next})
+	}
+	if atomic.LoadInt32(&n.drain) != drained {
+		// a drained node stays out of the ring, or the successor would take it back.
+		if err := next.Notify(ctx, n); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&n.lastStabilized, time.Now().UnixNano())
+	return n.stabilizePredecessors(ctx)
+}
+
+// inconsistentRounds is how many rounds of stabilization in a row the successor's
+// predecessor may fail to point back before the node is flagged inconsistent.
+const inconsistentRounds = 3
+
+// reconcile handles a successor whose predecessor x lies behind this node rather than
+// pointing back at it. That is expected for a round, until this node's Notify reaches the
+// successor, but if it persists the successor is following another predecessor, as when a
+// partition heals after two rings formed. Each such round asks x for this node's
+// successor, adopting any closer one it knows of, and after inconsistentRounds the node is
+// flagged inconsistent. It returns the successor to continue the round with.
+func (n *LocalNode) reconcile(ctx context.Context, successor, x Node) Node {
+	if rounds := n.health.mismatched(); rounds == inconsistentRounds {
+		n.logger.Warn("successor's predecessor does not point back", "successor", successor.Host(), "predecessor", x.Host(), "rounds", rounds)
+		n.emit(Event{Type: RingInconsistent, Node: x})
+	}
+	// x may know of nodes this node does not, such as those of another ring.
+	m, err := n.sibling(x).FindSuccessor(ctx, n.ID()+1)
+	if err != nil || !strictlyBetween(n.ID(), m.ID(), successor.ID()) {
+		return successor
+	}
+	if m = n.sibling(m); m.Ping(ctx) != nil {
+		return successor
+	}
+	n.logger.Info("found a closer successor through the successor's predecessor", "successor", m.Host(), "via", x.Host())
+	return m
+}
+
+// Inconsistent reports whether the successor's predecessor has not pointed back at this
+// node for inconsistentRounds rounds of stabilization, which is also shown by Info and
+// the RingInconsistent event. Stabilization keeps trying to reconcile the ring, but keys
+// written while it was split may need DHTServer.RebalanceAll to reach their owners.
+func (n *LocalNode) Inconsistent() bool {
+	n.health.Lock()
+	defer n.health.Unlock()
+	return !n.health.inconsistentSince.IsZero()
+}
+
+// stabilizePredecessors refreshes the predecessor list from the predecessor, committing
+// optimistically as Stabilize does. If the predecessor cannot be reached, the nearest live
+// node in the list takes its place until a closer one notifies this node, so that the ring
+// heals backwards without waiting on the successor direction.
+func (n *LocalNode) stabilizePredecessors(ctx context.Context) error {
+	n.mu.RLock()
+	p, before := n.predecessor, append([]Node(nil), n.predecessors...)
+	n.mu.RUnlock()
+	if p == nil || p.ID() == n.ID() {
+		return nil
+	}
+	ps, err := p.Predecessors(ctx)
+	if errors.Is(err, ErrNodeUnreachable) {
+		for i, m := range before {
+			if m.ID() != n.ID() && m.Ping(ctx) != nil {
+				continue
+			}
+			if m.ID() == n.ID() {
+				m = n
+			}
+			n.mu.Lock()
+			changed := n.predecessor == p
+			if changed {
+				n.predecessor, n.predecessors = m, before[i+1:]
+			}
+			onPredecessor := n.onPredecessor
+			n.mu.Unlock()
+			if changed {
+				n.emit(Event{Type: PredecessorChanged, Node: m})
+				if onPredecessor != nil {
+					go onPredecessor(m)
+				}
+			}
+			break
+		}
+		return err
+	} else if err != nil {
+		return err
+	}
+	ps = n.siblingList(ps)
+	n.mu.Lock()
+	if n.predecessor == p {
+		n.predecessors = ps[:min(len(ps), len(n.successors)-1)]
 	}
-	return n.successors[0].Notify(n)
+	n.mu.Unlock()
+	return nil
 }
 
-func (n *LocalNode) Notify(m Node) error {
-	switch p := n.predecessor.(type) {
-	case nil, *LocalNode:
-		if n.predecessor == nil || between(n.predecessor.ID(), m.ID(), n.ID()) {
-			n.predecessor = m
+// replaceSuccessor replaces dead, the first successor, with the next live node in the
+// successor list and refills the list from it, so that the list stays full rather than
+// shrinking with every failure. If no successor is left alive, this node closes the ring
+// on itself until another notifies it.
+func (n *LocalNode) replaceSuccessor(ctx context.Context, dead Node) {
+	skipped := map[uint64]bool{dead.ID(): true}
+	failed := []Node{dead}
+	var next Node = n
+	var y []Node
+	for _, m := range n.successorList() {
+		if skipped[m.ID()] {
+			continue
 		}
-	case *RemoteNode:
-		if _, err := p.op("", ""); err == nil && between(n.predecessor.ID(), m.ID(), n.ID()) {
-			n.predecessor = m
+		if m.ID() == n.ID() {
+			break
 		}
+		var err error
+		if y, err = m.Successors(ctx); err == nil {
+			next, y = m, n.siblingList(y)
+			break
+		}
+		skipped[m.ID()] = true
+		failed = append(failed, m)
+	}
+	successors := n.fillSuccessors(next, y)
+	n.mu.Lock()
+	if n.successors[0] != dead {
+		n.mu.Unlock()
+		return
+	}
+	copy(n.successors, successors)
+	n.mu.Unlock()
+	var events []Event
+	for _, m := range failed {
+		n.health.successorDropped()
+		events = append(events, Event{Type: SuccessorFailed, Node: m})
+	}
+	n.emit(append(events, Event{Type: SuccessorChanged, Node: next})...)
+}
+
+// fillSuccessors returns a successor list as long as this node's, made of first followed
+// by rest, the list first returned. A peer may return fewer than are needed, such as while
+// it is starting up or if it keeps a shorter list, so the rest is padded with first until
+// stabilization finds more, as a node alone in its ring fills its list with itself.
+func (n *LocalNode) fillSuccessors(first Node, rest []Node) []Node {
+	successors := make([]Node, len(n.successors))
+	successors[0] = first
+	for i := 1; i < len(successors); i++ {
+		if i-1 < len(rest) {
+			successors[i] = rest[i-1]
+		} else {
+			successors[i] = first
+		}
+	}
+	return successors
+}
+
+// successorIDs summarizes the successor list so that changes to it can be detected.
+func (n *LocalNode) successorIDs() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	ids := make([]byte, 0, 17*len(n.successors))
+	for _, s := range n.successors {
+		ids = strconv.AppendUint(append(ids, ' '), s.ID(), 16)
+	}
+	return string(ids)
+}
+
+// Notify is called by m when it believes it is this node's predecessor. m is accepted if
+// there is no predecessor yet, if it lies strictly between the current one and this node,
+// or if the current one has stopped responding.
+func (n *LocalNode) Notify(ctx context.Context, m Node) error {
+	if m.ID() == n.ID() && m.Host() != n.host {
+		// two nodes raced to join with the same id, which only one of them can hold.
+		n.logger.Error("peer has this node's id", "peer", m.Host())
+		return fmt.Errorf("%w: %x is held by %s", ErrDuplicateID, n.id, n.host)
+	}
+	p := n.currentPredecessor()
+	if p != nil && p.ID() == m.ID() && p.Host() != m.Host() && p.Ping(ctx) == nil {
+		// the predecessor is alive, so m is a second node with its id rather than its replacement.
+		n.logger.Error("peer has the predecessor's id", "peer", m.Host(), "predecessor", p.Host())
+		return fmt.Errorf("%w: %x is held by %s", ErrDuplicateID, m.ID(), p.Host())
 	}
-	// discard data up to n.predecessor.ID() asynchronously
-	go n.onPredecessor(n.predecessor)
+	var accept bool
+	switch {
+	case p == nil, strictlyBetween(p.ID(), m.ID(), n.ID()):
+		accept = true
+	case p.Ping(ctx) != nil && ctx.Err() == nil:
+		// the predecessor is dead, so m is the closest live one known. a draining node
+		// leaves its keys to be taken over by the node after it instead.
+		accept = atomic.LoadInt32(&n.drain) == notDraining
+	}
+	n.mu.Lock()
+	changed := accept && n.predecessor == p && (p == nil || p.ID() != m.ID())
+	if accept && n.predecessor == p {
+		if p != nil && strictlyBetween(p.ID(), m.ID(), n.ID()) {
+			// m joined in front of p, which now precedes it.
+			ps := append([]Node{p}, n.predecessors...)
+			n.predecessors = ps[:min(len(ps), len(n.successors)-1)]
+		}
+		n.predecessor = m
+	}
+	p, onPredecessor := n.predecessor, n.onPredecessor
+	n.mu.Unlock()
+	if p.ID() == m.ID() {
+		n.health.notified()
+	}
+	if changed {
+		n.emit(Event{Type: PredecessorChanged, Node: m})
+		if onPredecessor != nil {
+			// discard data up to m.ID() asynchronously
+			go onPredecessor(m)
+		}
+	}
+	return nil
+}
+
+func (n *LocalNode) Ping(ctx context.Context) error {
 	return nil
 }
 
+// NotifyLeave informs this node that m is leaving the ring, replacing any pointer to m
+// with replacement, which is m's successor or predecessor depending on the side.
+func (n *LocalNode) NotifyLeave(ctx context.Context, m Node, replacement Node) error {
+	if replacement.ID() == n.ID() {
+		replacement = n
+	}
+	defer n.cache.clear()
+	var events []Event
+	n.mu.Lock()
+	onPredecessor := n.onPredecessor
+	if n.predecessor != nil && n.predecessor.ID() == m.ID() {
+		n.predecessor = replacement
+		events = append(events, Event{Type: PredecessorChanged, Node: replacement})
+		if onPredecessor != nil {
+			go onPredecessor(replacement)
+		}
+	}
+	if n.successors[0].ID() == m.ID() {
+		n.successors[0] = replacement
+		events = append(events, Event{Type: SuccessorChanged, Node: replacement})
+	}
+	for i := range n.finger {
+		if n.finger[i] != nil && n.finger[i].ID() == m.ID() {
+			// fall back to the successor list until the finger is repaired.
+			n.finger[i] = n
+		}
+	}
+	n.mu.Unlock()
+	n.emit(events...)
+	return nil
+}
+
+// Leave stops the stabilization loops and repoints both neighbours at each other.
+// It is safe to call more than once.
+func (n *LocalNode) Leave(ctx context.Context) error {
+	var err error
+	n.leave.Do(func() {
+		n.cancel()
+		successor, predecessor := n.successor(), n.currentPredecessor()
+		if successor.ID() == n.ID() {
+			return
+		}
+		if predecessor != nil && predecessor.ID() != n.ID() {
+			err = n.splice(ctx, predecessor, successor)
+		}
+	})
+	return err
+}
+
+// splice repoints predecessor and successor at each other, removing this node from
+// between them.
+func (n *LocalNode) splice(ctx context.Context, predecessor, successor Node) error {
+	err := n.sibling(predecessor).NotifyLeave(ctx, n, successor)
+	if serr := n.sibling(successor).NotifyLeave(ctx, n, predecessor); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// spliceOut marks the node drained and splices it out of the ring, leaving it running so
+// that it still answers the RPCs of nodes that have yet to route around it.
+func (n *LocalNode) spliceOut(ctx context.Context) error {
+	atomic.StoreInt32(&n.drain, drained)
+	defer n.cache.clear()
+	successor, predecessor := n.successor(), n.currentPredecessor()
+	if successor.ID() == n.ID() || predecessor == nil || predecessor.ID() == n.ID() {
+		return nil
+	}
+	if err := n.splice(ctx, predecessor, successor); err != nil {
+		atomic.StoreInt32(&n.drain, draining)
+		return err
+	}
+	return nil
+}
+
+// sibling returns the node on this host that m refers to, whether this node or another
+// vnode, so that calls to it skip HTTP, or m if it is elsewhere.
+func (n *LocalNode) sibling(m Node) Node {
+	if m == nil || m.Host() != n.host {
+		return m
+	}
+	if m.ID() == n.id {
+		return n
+	}
+	n.mu.RLock()
+	s, ok := n.siblings[m.ID()]
+	n.mu.RUnlock()
+	if ok {
+		return s
+	}
+	return m
+}
+
+// siblingList replaces the entries of nodes that refer to nodes on this host with them, as
+// sibling does. Peers list this node in the successor lists they return, in small rings
+// repeatedly, and each copy would otherwise be called over HTTP.
+func (n *LocalNode) siblingList(nodes []Node) []Node {
+	for i, m := range nodes {
+		nodes[i] = n.sibling(m)
+	}
+	return nodes
+}
+
+// OnPredecessor registers fn to be called on its own goroutine with the new predecessor
+// each time the node's predecessor changes.
 func (n *LocalNode) OnPredecessor(fn func(Node)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	n.onPredecessor = fn
 }
 
-func (n *LocalNode) FixFingers(i int) error {
-	s, err := n.FindSuccessor(n.ID() + (1 << (i % M)))
+// fingerStart returns the start of finger i, id + 2^i around the identifier circle. The
+// sum wraps modulo 2^M because M is the width of uint64, so the high fingers of a node
+// near the top of the keyspace land just past zero rather than saturating.
+func fingerStart(id uint64, i int) uint64 {
+	return id + uint64(1)<<uint(i)
+}
+
+// FixFingers repairs finger i, taken modulo M.
+func (n *LocalNode) FixFingers(ctx context.Context, i int) (err error) {
+	defer func() { n.health.record(&n.health.fixFingersErr, err) }()
+	i = (i%M + M) % M
+	s, err := n.findFinger(ctx, fingerStart(n.ID(), i))
 	if err != nil { // try an earlier finger.
-		n.finger[(i % M)] = n.finger[(i+M-1)%M]
+		n.setFinger(i, n.fingerTable()[(i+M-1)%M])
 		return err
 	}
-	n.finger[(i % M)] = s
+	n.setFinger(i, s)
 	return nil
 }
 
+// setFinger updates finger i, invalidating cached lookups if it now points elsewhere.
+func (n *LocalNode) setFinger(i int, f Node) {
+	f = n.sibling(f)
+	n.mu.Lock()
+	old := n.finger[i]
+	n.finger[i] = f
+	n.mu.Unlock()
+	if old == nil || f == nil || old.ID() != f.ID() {
+		n.cache.clear()
+		if f != nil {
+			n.emit(Event{Type: FingerRepaired, Node: f, Finger: i})
+		}
+	}
+}
+
+// fingerConcurrency bounds the lookups in flight during a FixAllFingers sweep.
+const fingerConcurrency = 8
+
+// minForcedStabilize is the least time between rounds forced through op=Stabilize, so
+// that the RPC cannot be used to flood the ring with stabilization traffic.
+const minForcedStabilize = time.Second
+
+// stabilizeNow runs Stabilize and then FixAllFingers, as the loop started with the node
+// would eventually. It reports false without doing either if a forced round is running or
+// started less than minForcedStabilize ago.
+func (n *LocalNode) stabilizeNow(ctx context.Context) (bool, error) {
+	if !n.forceMu.TryLock() {
+		return false, nil
+	}
+	defer n.forceMu.Unlock()
+	if time.Since(n.lastForced) < minForcedStabilize {
+		return false, nil
+	}
+	n.lastForced = time.Now()
+	if err := n.Stabilize(ctx); err != nil {
+		return true, err
+	}
+	return true, n.FixAllFingers(ctx)
+}
+
+// FixAllFingers repairs every finger, fingerConcurrency at a time. Finger starts increase
+// with the index, so a finger whose start precedes the last successor found reuses it
+// rather than repeating the lookup. As with FixFingers, a finger whose lookup fails
+// falls back to the previous one. The first error is returned after the sweep completes.
+func (n *LocalNode) FixAllFingers(ctx context.Context) (first error) {
+	defer func() { n.health.record(&n.health.fixFingersErr, first) }()
+	known := n.successor()
+	for base := 0; base < M; base += fingerConcurrency {
+		var results [fingerConcurrency]Node
+		var errs [fingerConcurrency]error
+		var wg sync.WaitGroup
+		for j := 0; j < fingerConcurrency && base+j < M; j++ {
+			start := fingerStart(n.ID(), base+j)
+			if between(n.ID(), start, known.ID()) {
+				results[j] = known
+				continue
+			}
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				results[j], errs[j] = n.findFinger(ctx, start)
+			}(j)
+		}
+		wg.Wait()
+		for j := 0; j < fingerConcurrency && base+j < M; j++ {
+			i := base + j
+			if errs[j] != nil {
+				n.setFinger(i, n.fingerTable()[(i+M-1)%M])
+				if first == nil {
+					first = errs[j]
+				}
+				continue
+			}
+			n.setFinger(i, results[j])
+			known = results[j]
+		}
+	}
+	return first
+}
+
 func (n *LocalNode) HTTPHandlerFunc() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.URL.Query().Get("op") {
+		op := r.URL.Query().Get("op")
+		if !n.authorized(r, op == "Notify" || op == "NotifyLeave" || op == "Stabilize") {
+			w.WriteHeader(401)
+			return
+		}
+		switch op {
 		case "Successors":
-			for i := 0; i < len(n.successors); i++ {
-				w.Write([]byte(n.successors[i].Serialize()))
-				if i != len(n.successors)-1 {
+			successors := n.successorList()
+			for i := 0; i < len(successors); i++ {
+				w.Write([]byte(n.serialize(successors[i])))
+				if i != len(successors)-1 {
+					w.Write([]byte("\n"))
+				}
+			}
+		case "Predecessors":
+			predecessors := n.predecessorList()
+			if len(predecessors) == 0 {
+				w.WriteHeader(204)
+				return
+			}
+			for i := 0; i < len(predecessors); i++ {
+				w.Write([]byte(n.serialize(predecessors[i])))
+				if i != len(predecessors)-1 {
 					w.Write([]byte("\n"))
 				}
 			}
 		case "Predecessor":
-			if n.predecessor == nil {
-				w.WriteHeader(200)
+			if p := n.currentPredecessor(); p == nil {
+				w.WriteHeader(204)
 			} else {
-				w.Write([]byte(n.predecessor.Serialize()))
+				w.Write([]byte(n.serialize(p)))
 			}
 		case "FindSuccessor":
 			id, err := strconv.ParseUint(r.URL.Query().Get("id"), 16, 64)
@@ -204,63 +1376,195 @@ func (n *LocalNode) HTTPHandlerFunc() http.HandlerFunc {
 				w.WriteHeader(400)
 				return
 			}
-			m, err := n.FindSuccessor(id)
+			m, err := n.FindSuccessor(r.Context(), id)
 			if err != nil {
 				w.WriteHeader(400)
 				return
 			}
-			w.Write([]byte(m.Serialize()))
-		case "Notify":
+			w.Write([]byte(n.serialize(m)))
+		case "Route":
+			// a FindSuccessor that answers with the route taken, for debugging.
+			id, err := strconv.ParseUint(r.URL.Query().Get("id"), 16, 64)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			m, route, err := n.FindSuccessorRoute(r.Context(), id)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(lookupInfo(id, m, route))
+		case "ClosestPrecedingNode":
+			id, err := strconv.ParseUint(r.URL.Query().Get("id"), 16, 64)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			m, err := n.ClosestPrecedingNode(r.Context(), id)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			w.Write([]byte(n.serialize(m)))
+		case "Info":
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(n.Info()); err != nil {
+				n.logger.Warn("writing info failed", "err", err)
+			}
+		case "Stabilize":
+			// an admin RPC that runs a round now and answers with the resulting Info.
+			ran, err := n.stabilizeNow(r.Context())
+			if !ran {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err != nil {
+				n.logger.Warn("forced stabilization failed", "err", err)
+				w.WriteHeader(http.StatusBadGateway)
+			}
+			if err := json.NewEncoder(w).Encode(n.Info()); err != nil {
+				n.logger.Warn("writing info failed", "err", err)
+			}
+		case "NextHop":
 			id, err := strconv.ParseUint(r.URL.Query().Get("id"), 16, 64)
 			if err != nil {
 				w.WriteHeader(400)
 				return
 			}
-			if err := n.Notify(&RemoteNode{id: id, host: r.URL.Query().Get("host")}); err != nil {
+			m, done, err := n.NextHop(r.Context(), id)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			if done {
+				w.Write([]byte("done\n" + n.serialize(m)))
+			} else {
+				w.Write([]byte("next\n" + n.serialize(m)))
+			}
+		case "Ping":
+			w.WriteHeader(200)
+		case "NotifyLeave":
+			m, err := n.remoteFromQuery(r.URL.Query())
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			replacement := &RemoteNode{client: n.client}
+			if err := replacement.Deserialize(r.URL.Query().Get("replacement")); err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			if err := n.NotifyLeave(r.Context(), m, replacement); err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			w.WriteHeader(200)
+		case "Notify":
+			m, err := n.remoteFromQuery(r.URL.Query())
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			if err := n.Notify(r.Context(), m); errors.Is(err, ErrDuplicateID) {
+				w.WriteHeader(http.StatusConflict)
+				return
+			} else if err != nil {
 				w.WriteHeader(400)
 				return
 			}
 			w.WriteHeader(200)
 		default:
-			w.Write([]byte(n.Serialize()))
+			w.Write([]byte(n.serialize(n)))
 		}
 	})
 }
 
+// remoteFromQuery builds the node identified by the id and host parameters of an RPC.
+func (n *LocalNode) remoteFromQuery(q url.Values) (*RemoteNode, error) {
+	id, err := strconv.ParseUint(q.Get("id"), 16, 64)
+	if err != nil {
+		return nil, err
+	}
+	host, err := canonicalHost(q.Get("host"))
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteNode{id: id, host: host, client: n.client}, nil
+}
+
+// serialize encodes m in the wire format this node serves.
+func (n *LocalNode) serialize(m Node) string {
+	if n.wireFormat == WireJSON {
+		b, err := json.Marshal(nodeJSON{ID: fmt.Sprintf("%x", m.ID()), Host: m.Host()})
+		if err == nil {
+			return string(b)
+		}
+	}
+	return m.Serialize()
+}
+
 func (n *LocalNode) Serialize() string {
 	return fmt.Sprintf("%x:%s", n.id, n.host)
 }
 
 func (n *LocalNode) String() string {
 	ps := "nil"
-	if n.predecessor != nil {
-		ps = n.predecessor.Serialize()
+	if p := n.currentPredecessor(); p != nil {
+		ps = p.Serialize()
 	}
-	ss := [R]string{}
-	for i := 0; i < R; i++ {
-		ss[i] = n.successors[i].Serialize()
+	successors := n.successorList()
+	ss := make([]string, len(successors))
+	for i := range successors {
+		ss[i] = successors[i].Serialize()
 	}
 	return fmt.Sprintf("local[%s]\npredecessor: %s\nsuccessors: %s", n.Serialize(), ps, ss)
 }
 
 type RemoteNode struct {
-	id   uint64
-	host string
+	id     uint64
+	host   string
+	client *http.Client
 }
 
 var _ Node = (*RemoteNode)(nil)
 
 func NewRemoteNode(addr string) (*RemoteNode, error) {
+	return NewRemoteNodeWithClient(addr, defaultClient())
+}
+
+// NewRemoteNodeWithClient resolves the node at addr, issuing this and all subsequent RPCs with client.
+func NewRemoteNodeWithClient(addr string, client *http.Client) (*RemoteNode, error) {
+	return resolveRemoteNode(context.Background(), addr, client)
+}
+
+// resolveRemoteNode is NewRemoteNodeWithClient giving up when ctx is done.
+func resolveRemoteNode(ctx context.Context, addr string, client *http.Client) (*RemoteNode, error) {
+	addr, err := canonicalHost(addr)
+	if err != nil {
+		return nil, err
+	}
 	// resolve the id automatically.
-	resp, err := http.Get(fmt.Sprintf("http://%s/node", addr))
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+addr+"/node", nil)
 	if err != nil {
 		return nil, err
 	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNodeUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedStatus, resp.Status)
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	n := &RemoteNode{}
+	n := &RemoteNode{client: client}
 	return n, n.Deserialize(string(body))
 }
 
@@ -272,17 +1576,33 @@ func (n *RemoteNode) Host() string {
 	return n.host
 }
 
-func (n *RemoteNode) op(name string, arg string) ([]string, error) {
-	url := fmt.Sprintf("http://%s/node?op=%s", n.host, name)
-	if arg != "" {
-		url += fmt.Sprintf("&%s", arg)
+func (n *RemoteNode) op(ctx context.Context, name string, args url.Values) ([]string, error) {
+	if args == nil {
+		args = url.Values{}
 	}
-	resp, err := http.Get(url)
+	args.Set("op", name)
+	// address the vnode this node is when its host runs several.
+	args.Set("vnode", fmt.Sprintf("%x", n.id))
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+n.host+"/node?"+args.Encode(), nil)
 	if err != nil {
 		return nil, err
 	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %v", ErrNodeUnreachable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 204 {
+		return nil, nil
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return nil, fmt.Errorf("%w: %s", ErrDuplicateID, resp.Status)
+	}
 	if resp.StatusCode != 200 {
-		return nil, errors.New(resp.Status)
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedStatus, resp.Status)
 	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -292,42 +1612,103 @@ func (n *RemoteNode) op(name string, arg string) ([]string, error) {
 	return tokens, nil
 }
 
-func (n *RemoteNode) Successors() ([R]Node, error) {
-	res := [R]Node{}
-	tokens, err := n.op("Successors", "")
+func (n *RemoteNode) Successors(ctx context.Context) ([]Node, error) {
+	tokens, err := n.op(ctx, "Successors", nil)
 	if err != nil {
-		return res, err
+		return nil, err
 	}
-	for i := 0; i < R; i++ {
-		m := &RemoteNode{}
-		if err := m.Deserialize(tokens[i]); err != nil {
-			return res, err
+	return n.nodeList(tokens)
+}
+
+func (n *RemoteNode) Predecessor(ctx context.Context) (Node, error) {
+	tokens, err := n.op(ctx, "Predecessor", nil)
+	if err != nil {
+		return nil, err
+	}
+	if tokens == nil {
+		// the node has no predecessor yet.
+		return nil, nil
+	}
+	m := &RemoteNode{client: n.client}
+	return m, m.Deserialize(tokens[0])
+}
+
+func (n *RemoteNode) Predecessors(ctx context.Context) ([]Node, error) {
+	tokens, err := n.op(ctx, "Predecessors", nil)
+	if err != nil {
+		return nil, err
+	}
+	return n.nodeList(tokens)
+}
+
+// nodeList deserializes a list of nodes, one per token. Blank tokens are skipped, so that
+// a peer with nothing to list, such as one still starting up, returns an empty list.
+func (n *RemoteNode) nodeList(tokens []string) ([]Node, error) {
+	res := make([]Node, 0, len(tokens))
+	for _, token := range tokens {
+		if token == "" {
+			continue
+		}
+		m := &RemoteNode{client: n.client}
+		if err := m.Deserialize(token); err != nil {
+			return nil, err
 		}
-		res[i] = m
+		res = append(res, m)
 	}
 	return res, nil
 }
 
-func (n *RemoteNode) Predecessor() (Node, error) {
-	tokens, err := n.op("Predecessor", "")
+func (n *RemoteNode) FindSuccessor(ctx context.Context, id uint64) (Node, error) {
+	tokens, err := n.op(ctx, "FindSuccessor", url.Values{"id": {fmt.Sprintf("%x", id)}})
 	if err != nil {
 		return nil, err
 	}
-	m := &RemoteNode{}
-	return m, m.Deserialize(tokens[0])
+	return n.node(tokens)
 }
 
-func (n *RemoteNode) FindSuccessor(id uint64) (Node, error) {
-	tokens, err := n.op("FindSuccessor", fmt.Sprintf("id=%x", id))
+func (n *RemoteNode) ClosestPrecedingNode(ctx context.Context, id uint64) (Node, error) {
+	tokens, err := n.op(ctx, "ClosestPrecedingNode", url.Values{"id": {fmt.Sprintf("%x", id)}})
 	if err != nil {
 		return nil, err
 	}
-	m := &RemoteNode{}
+	return n.node(tokens)
+}
+
+// node deserializes the node a lookup answers with. Lookups always name one, so a peer
+// answering with none, such as with a 204, is misbehaving.
+func (n *RemoteNode) node(tokens []string) (Node, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: no node in answer", ErrUnexpectedStatus)
+	}
+	m := &RemoteNode{client: n.client}
 	return m, m.Deserialize(tokens[0])
 }
 
-func (n *RemoteNode) Notify(m Node) error {
-	_, err := n.op("Notify", fmt.Sprintf("id=%x&host=%s", m.ID(), m.Host()))
+func (n *RemoteNode) NextHop(ctx context.Context, id uint64) (Node, bool, error) {
+	tokens, err := n.op(ctx, "NextHop", url.Values{"id": {fmt.Sprintf("%x", id)}})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(tokens) != 2 || (tokens[0] != "done" && tokens[0] != "next") {
+		// older peers answer unknown ops by serializing themselves.
+		return nil, false, errNoNextHop
+	}
+	m := &RemoteNode{client: n.client}
+	return m, tokens[0] == "done", m.Deserialize(tokens[1])
+}
+
+func (n *RemoteNode) Notify(ctx context.Context, m Node) error {
+	_, err := n.op(ctx, "Notify", url.Values{"id": {fmt.Sprintf("%x", m.ID())}, "host": {m.Host()}})
+	return err
+}
+
+func (n *RemoteNode) Ping(ctx context.Context) error {
+	_, err := n.op(ctx, "Ping", nil)
+	return err
+}
+
+func (n *RemoteNode) NotifyLeave(ctx context.Context, m Node, replacement Node) error {
+	_, err := n.op(ctx, "NotifyLeave", url.Values{"id": {fmt.Sprintf("%x", m.ID())}, "host": {m.Host()}, "replacement": {replacement.Serialize()}})
 	return err
 }
 
@@ -336,16 +1717,38 @@ func (n *RemoteNode) Serialize() string {
 }
 
 func (n *RemoteNode) Deserialize(s string) error {
-	if len(s) < 16 {
+	if strings.HasPrefix(s, "{") {
+		var v nodeJSON
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return err
+		}
+		id, err := strconv.ParseUint(v.ID, 16, 64)
+		if err != nil {
+			return err
+		}
+		host, err := canonicalHost(v.Host)
+		if err != nil {
+			return err
+		}
+		n.id = id
+		n.host = host
 		return nil
 	}
+	// the id never contains a colon, so only split on the first one to keep IPv6 hosts intact.
 	tokens := strings.SplitN(s, ":", 2)
+	if len(tokens) != 2 {
+		return fmt.Errorf("invalid node %q", s)
+	}
 	id, err := strconv.ParseUint(tokens[0], 16, 64)
 	if err != nil {
 		return err
 	}
+	host, err := canonicalHost(tokens[1])
+	if err != nil {
+		return err
+	}
 	n.id = id
-	n.host = tokens[1]
+	n.host = host
 	return nil
 }
 
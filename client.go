@@ -0,0 +1,160 @@
+package chord
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Client reads and writes the DHT through its members without joining the ring or holding
+// any keys. Each request is sent to one member, which routes it to the key's owner, and is
+// retried against the next member if that one cannot be reached.
+type Client struct {
+	// HTTPClient issues the requests, defaulting to a client with DefaultTimeout.
+	HTTPClient *http.Client
+	// TLS, when set, makes requests over https with this configuration, as Config.TLS does.
+	TLS *tls.Config
+	// Secret, when set, signs requests for members configured with the same Config.Secret.
+	Secret []byte
+	// KeyHash maps the string keys of GetString and SetString, as DHTServer.KeyHash does.
+	KeyHash func(key string) uint64
+
+	addrs []string
+	once  sync.Once
+	http  *http.Client
+	mu    sync.Mutex
+	// current is the index of the member requests are sent to first.
+	current int
+}
+
+// NewClient creates a client that routes requests through the members at addrs.
+func NewClient(addrs []string) (*Client, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no member addresses")
+	}
+	canonical := make([]string, len(addrs))
+	for i, addr := range addrs {
+		host, err := canonicalHost(addr)
+		if err != nil {
+			return nil, err
+		}
+		canonical[i] = host
+	}
+	return &Client{addrs: canonical}, nil
+}
+
+func (c *Client) Get(key uint64) (io.Reader, error) {
+	resp, err := c.do("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// buffer the value so that a member dying mid-response, or a damaged value, surfaces here.
+	b, err := io.ReadAll(verifyResponse(resp))
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+func (c *Client) Set(key uint64, value io.Reader) error {
+	// buffer the value so that it can be resent to another member.
+	b, err := io.ReadAll(value)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do("POST", key, b)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) Delete(key uint64) error {
+	resp, err := c.do("DELETE", key, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) GetString(key string) (io.Reader, error) {
+	return c.Get(hashWith(c.KeyHash, key))
+}
+
+func (c *Client) SetString(key string, value io.Reader) error {
+	return c.Set(hashWith(c.KeyHash, key), value)
+}
+
+// do sends the request to each member in turn, starting from the last one that answered,
+// until one responds with a status other than a server error. Missing keys are reported
+// as ErrKeyNotFound.
+func (c *Client) do(method string, key uint64, body []byte) (*http.Response, error) {
+	c.once.Do(c.init)
+	c.mu.Lock()
+	start := c.current
+	c.mu.Unlock()
+	var err error
+	for i := 0; i < len(c.addrs); i++ {
+		j := (start + i) % len(c.addrs)
+		var req *http.Request
+		req, err = http.NewRequest(method, fmt.Sprintf("http://%s/store?key=%x", c.addrs[j], key), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set(ChecksumHeader, checksum(body))
+		}
+		var resp *http.Response
+		resp, err = c.http.Do(req)
+		if err != nil {
+			err = fmt.Errorf("%w: %v", ErrNodeUnreachable, err)
+			continue
+		}
+		if resp.StatusCode >= 500 {
+			err = statusError(resp)
+			resp.Body.Close()
+			continue
+		}
+		c.mu.Lock()
+		c.current = j
+		c.mu.Unlock()
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			return nil, statusError(resp)
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no member could serve the request: %w", err)
+}
+
+func (c *Client) init() {
+	client := c.HTTPClient
+	if client == nil {
+		client = defaultClient()
+	}
+	c.http = securedClient(client, c.TLS, c.Secret)
+}
+
+// securedClient returns a copy of client that upgrades requests to TLS and signs them
+// with secret, as configured.
+func securedClient(client *http.Client, tlsConfig *tls.Config, secret []byte) *http.Client {
+	secured := *client
+	if tlsConfig != nil {
+		secured.Transport = secureTransport(secured.Transport, tlsConfig)
+	}
+	if secret != nil {
+		next := secured.Transport
+		if next == nil {
+			next = sharedTransport
+		}
+		secured.Transport = &signingTransport{next: next, secret: secret}
+	}
+	return &secured
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/muxable/chord"
@@ -15,35 +20,239 @@ import (
 
 func main() {
 	addr := flag.String("addr", "127.0.0.1:5001", "the address to listen on")
-	join := flag.String("join", "", "the address to join")
+	adminAddr := flag.String("admin-addr", "", "the address to serve admin RPCs such as Drain on, or empty to not serve them")
+	advertise := flag.String("advertise", "", "the address peers should dial to reach this node, defaulting to -addr")
+	path := flag.String("path", "", "the base path to serve the node under, such as /chord")
+	join := flag.String("join", "", "a comma-separated list of addresses to try joining through, in order")
+	replicas := flag.Int("replicas", chord.R, "the length of the successor list")
+	jsonWire := flag.Bool("json", false, "serve nodes in the JSON wire format")
+	data := flag.String("data", "", "the directory to persist data to, or empty to keep it in memory")
+	fingerSweep := flag.Bool("finger-sweep", false, "repair the whole finger table each stabilization instead of one finger per tick")
+	lookupCache := flag.Int("lookup-cache", 0, "the number of key-range buckets to cache lookups for, or zero to disable")
+	lookupCacheTTL := flag.Duration("lookup-cache-ttl", chord.DefaultLookupCacheTTL, "how long a cached lookup is used")
+	joinBackoff := flag.Duration("join-backoff", 0, "retry joining with exponential backoff starting from this delay, or zero to fail immediately")
+	checksums := flag.Bool("checksums", false, "keep a checksum with each value and refuse to serve values that fail it; existing data must be rewritten")
+	readOnlyAfter := flag.Int("read-only-after", 0, "turn the store read-only after this many consecutive failed writes, or zero to never")
+	joinTimeout := flag.Duration("join-timeout", 2*time.Minute, "give up joining, retries included, after this long, or zero to wait forever")
+	vnodes := flag.Int("vnodes", 1, "the number of virtual nodes to run on this host per unit of -weight")
+	weight := flag.Float64("weight", 1, "the capacity of this host relative to others, scaling the number of virtual nodes it runs")
+	antiEntropy := flag.Duration("anti-entropy", 0, "how often to reconcile keys with replicas, or zero to disable")
+	tlsCert := flag.String("tls-cert", "", "the certificate to present to peers, enabling mutual TLS")
+	tlsKey := flag.String("tls-key", "", "the private key for -tls-cert")
+	tlsCA := flag.String("tls-ca", "", "the CA bundle that peer certificates must chain to")
+	stabilizeInterval := flag.Duration("stabilize-interval", chord.DefaultStabilizeInterval, "how often to stabilize the successor list")
+	fixFingersInterval := flag.Duration("fix-fingers-interval", chord.DefaultFixFingersInterval, "how often to repair a finger")
+	jitter := flag.Float64("jitter", chord.DefaultJitter, "the fraction to randomly vary stabilization intervals by, or negative to disable")
+	secret := flag.String("secret", os.Getenv("CHORD_SECRET"), "the shared cluster secret to sign requests with, defaulting to $CHORD_SECRET")
+	encryptionKey := flag.String("encryption-key", os.Getenv("CHORD_ENCRYPTION_KEY"), "a hex-encoded AES key to encrypt stored values with, defaulting to $CHORD_ENCRYPTION_KEY")
+	maxKeys := flag.Int("max-keys", 0, "the number of keys to hold before evicting, or zero for no limit")
+	maxBytes := flag.Int64("max-bytes", 0, "the total size of values to hold before evicting, or zero for no limit")
+	eviction := flag.String("eviction", "lru", "the eviction policy when -max-keys or -max-bytes is reached, lru or lfu, or reject to refuse writes instead")
+	indexNames := flag.Bool("index-names", false, "index the names keys are written under so they can be listed by prefix")
+	idSource := flag.String("id", "random", "how to choose node ids, random or host to derive them from the advertised address so restarts keep their place")
+	peerRate := flag.Float64("peer-rate", 0, "the requests per second to serve each non-member address, or zero for no limit")
+	globalRate := flag.Float64("global-rate", 0, "the requests per second to serve from non-members in total, or zero for no limit")
+	authReads := flag.Bool("auth-reads", false, "require signed requests for reads as well as writes")
+	maxValueSize := flag.Int64("max-value-size", 0, "the largest value a write may carry in bytes, or zero for no limit")
+	maxTransferSize := flag.Int64("max-transfer-size", 0, "the largest batch or migration body in bytes, or zero for no limit")
+	joinStrategy := flag.String("join-strategy", "copy", "how to fill the successor list on join, copy to take the successor's or lookup to look up each entry")
+	readCache := flag.Int("read-cache", 0, "the number of values read from other nodes to cache, or zero to disable")
+	readCacheTTL := flag.Duration("read-cache-ttl", chord.DefaultReadCacheTTL, "how long a cached value is served, which bounds how stale it can be")
+	readCacheBytes := flag.Int64("read-cache-bytes", 0, "the total size of cached values in bytes, or zero for no limit beyond -read-cache")
+	transferCodec := flag.String("transfer-codec", "json", "the codec to send migrations in, json or gob; gob is smaller for binary values but needs every node to support it")
+	readNearest := flag.Bool("read-nearest", false, "serve reads from whichever replica responds fastest rather than the owner, which may briefly return stale values")
+	statePath := flag.String("state", "", "a file to checkpoint the node's routing state to, restoring it and the node's id on restart")
 	flag.Parse()
 
+	if *idSource != "random" && *idSource != "host" {
+		log.Fatalf("unknown id source %q", *idSource)
+	}
+	if *joinStrategy != "copy" && *joinStrategy != "lookup" {
+		log.Fatalf("unknown join strategy %q", *joinStrategy)
+	}
+	if *transferCodec != "json" && *transferCodec != "gob" {
+		log.Fatalf("unknown transfer codec %q", *transferCodec)
+	}
+	if *statePath != "" && (*vnodes > 1 || *weight != 1) {
+		log.Fatal("-state is not supported with virtual nodes")
+	}
+
 	rand.Seed(time.Now().UnixNano())
 
 	ctx, cancel := context.WithCancel(context.Background())
 
-	var remote chord.Node
+	host := *advertise
+	if host == "" {
+		host = *addr
+	}
+	host += *path
+
+	var seeds []string
 	if *join != "" {
-		node, err := chord.NewRemoteNode(*join)
+		for _, addr := range strings.Split(*join, ",") {
+			seeds = append(seeds, strings.TrimSpace(addr))
+		}
+	}
+
+	wireFormat := chord.WireLegacy
+	if *jsonWire {
+		wireFormat = chord.WireJSON
+	}
+
+	var store chord.Store
+	if *data != "" {
+		disk, err := chord.NewDiskStore(*data)
+		if err != nil {
+			panic(err)
+		}
+		go disk.Sweep(ctx, time.Second)
+		store = disk
+	} else {
+		memory := &chord.MemoryStore{Logger: slog.Default()}
+		go memory.Sweep(ctx, time.Second)
+		store = memory
+	}
+	if *readOnlyAfter > 0 {
+		guard := chord.NewWriteGuard(store, *readOnlyAfter)
+		guard.Logger = slog.Default()
+		go guard.Recover(ctx, 10*time.Second)
+		store = guard
+	}
+	if *checksums {
+		store = chord.NewChecksumStore(store)
+	}
+	if *encryptionKey != "" {
+		key, err := hex.DecodeString(*encryptionKey)
 		if err != nil {
 			panic(err)
 		}
-		remote = node
+		encrypted, err := chord.NewEncryptedStore(store, key)
+		if err != nil {
+			panic(err)
+		}
+		store = encrypted
+	}
+	if *maxKeys > 0 || *maxBytes > 0 {
+		var policy chord.EvictionPolicy
+		switch *eviction {
+		case "lru":
+			policy = chord.NewLRU()
+		case "lfu":
+			policy = chord.NewLFU()
+		case "reject":
+			policy = chord.NewRejectPolicy()
+		default:
+			log.Fatalf("unknown eviction policy %q", *eviction)
+		}
+		store = chord.NewBoundedStore(store, *maxKeys, *maxBytes, policy)
+	}
+	if *indexNames {
+		store = chord.NewIndexedStore(store)
 	}
 
-	local, err := chord.NewLocalNode(ctx, rand.Uint64(), *addr, remote)
-	if err != nil {
-		panic(err)
+	config := chord.Config{Replicas: *replicas, WireFormat: wireFormat, FingerSweep: *fingerSweep, LookupCacheSize: *lookupCache, LookupCacheTTL: *lookupCacheTTL, JoinBackoff: *joinBackoff, JoinTimeout: *joinTimeout, StabilizeInterval: *stabilizeInterval, FixFingersInterval: *fixFingersInterval, Jitter: *jitter, Logger: slog.Default(), Weight: *weight, HostIDs: *idSource == "host"}
+	if *joinStrategy == "lookup" {
+		config.JoinStrategy = chord.JoinLookup
+	}
+	if *secret != "" {
+		config.Secret, config.AuthenticateReads = []byte(*secret), *authReads
+	}
+	if *statePath != "" {
+		snap, err := loadSnapshot(*statePath)
+		if err != nil {
+			panic(err)
+		}
+		config.Snapshot = snap
+	}
+	if *tlsCert != "" {
+		tlsConfig, err := chord.MutualTLSConfig(*tlsCert, *tlsKey, *tlsCA)
+		if err != nil {
+			panic(err)
+		}
+		config.TLS = tlsConfig
 	}
 
-	dht, err := chord.NewDHTServer(local, &chord.MemoryStore{})
-	if err != nil {
-		panic(err)
+	var dht interface {
+		HTTPServeMux() *http.ServeMux
+		AdminServeMux() *http.ServeMux
+		Leave(context.Context) error
+	}
+	var servers []*chord.DHTServer
+	checkpoint := func() {}
+	if *vnodes > 1 || *weight != 1 {
+		host, err := chord.NewWeightedVirtualHost(ctx, host, *vnodes, seeds, store, config)
+		if err != nil {
+			panic(err)
+		}
+		dht, servers = host, host.Servers()
+	} else {
+		var local *chord.LocalNode
+		id, err := chord.HostID(host)
+		if err == nil && config.Snapshot != nil {
+			// the snapshot is only of use to the node it was taken of.
+			if id, err = config.Snapshot.NodeID(); err == nil {
+				local, err = chord.NewLocalNodeWithSeeds(ctx, id, host, seeds, config)
+			}
+		} else if err == nil && config.HostIDs {
+			local, err = chord.NewLocalNodeWithSeeds(ctx, id, host, seeds, config)
+		} else if err == nil {
+			local, err = chord.NewLocalNodeWithRandomID(ctx, host, seeds, config)
+		}
+		if err != nil {
+			panic(err)
+		}
+		server, err := chord.NewDHTServer(local, store)
+		if err != nil {
+			panic(err)
+		}
+		dht, servers = server, []*chord.DHTServer{server}
+		if *statePath != "" {
+			checkpoint = func() {
+				if err := saveSnapshot(*statePath, local.Snapshot()); err != nil {
+					log.Printf("checkpointing routing state failed: %v", err)
+				}
+			}
+			go func() {
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(30 * time.Second):
+						checkpoint()
+					}
+				}
+			}()
+		}
 	}
 
-	server := &http.Server{Addr: *addr, Handler: dht.HTTPServeMux()}
+	for _, s := range servers {
+		s.PeerRateLimit, s.GlobalRateLimit = chord.RateLimit{Rate: *peerRate}, chord.RateLimit{Rate: *globalRate}
+		s.MaxValueSize, s.MaxTransferSize = *maxValueSize, *maxTransferSize
+		s.ReadNearest = *readNearest
+		s.ReadCacheSize, s.ReadCacheTTL, s.ReadCacheBytes = *readCache, *readCacheTTL, *readCacheBytes
+		if *transferCodec == "gob" {
+			s.TransferCodec = chord.TransferGob
+		}
+		if *antiEntropy > 0 {
+			s.StartAntiEntropy(*antiEntropy)
+		}
+	}
 
-	go server.ListenAndServe()
+	server := &http.Server{Addr: *addr, Handler: dht.HTTPServeMux(), TLSConfig: config.TLS}
+	admin := &http.Server{Addr: *adminAddr, Handler: dht.AdminServeMux(), TLSConfig: config.TLS}
+
+	if config.TLS != nil {
+		go server.ListenAndServeTLS("", "")
+	} else {
+		go server.ListenAndServe()
+	}
+	if *adminAddr != "" {
+		if config.TLS != nil {
+			go admin.ListenAndServeTLS("", "")
+		} else {
+			go admin.ListenAndServe()
+		}
+	}
 
 	go func() {
 		for {
@@ -60,14 +269,45 @@ func main() {
 	signal.Notify(c, os.Interrupt)
 	<-c
 
-	// stop accepting incoming requests
+	// stop accepting incoming requests and drain in-flight ones
 	server.Shutdown(context.Background())
+	admin.Shutdown(context.Background())
 
-	// close and forward data
-	if err := server.Close(); err != nil {
+	checkpoint()
+
+	// forward data and leave the ring
+	if err := dht.Leave(context.Background()); err != nil {
 		panic(err)
 	}
 
-	// leave the ring
 	cancel()
 }
+
+// loadSnapshot reads the routing state saved at path, or returns nil if there is none.
+func loadSnapshot(path string) (*chord.Snapshot, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var snap chord.Snapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &snap, nil
+}
+
+// saveSnapshot writes snap to path, replacing it whole so that a crash midway leaves the
+// previous checkpoint.
+func saveSnapshot(path string, snap chord.Snapshot) error {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
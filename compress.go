@@ -0,0 +1,117 @@
+package chord
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// gzipHandler decodes gzipped request bodies and, if the server compresses, gzips responses
+// for clients that accept it. Compressing servers advertise that they accept gzipped bodies
+// with an Accept-Encoding response header, which gzipTransport looks for before
+// compressing anything it sends them.
+func (s *DHTServer) gzipHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") == "gzip" {
+			body, err := gzip.NewReader(req.Body)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			defer body.Close()
+			req.Body = body
+			req.Header.Del("Content-Encoding")
+			req.ContentLength = -1
+		}
+		if !s.Compress {
+			next.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Accept-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, req)
+	})
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code != http.StatusNoContent && code != http.StatusNotModified {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.gz == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.gz.Write(p)
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// gzipTransport gzips the bodies of requests to peers that have advertised accepting them,
+// while the server compresses. Responses need no help: the standard transport asks for
+// gzip and decodes it transparently.
+type gzipTransport struct {
+	next   http.RoundTripper
+	server *DHTServer
+	// peers holds the hosts known to accept gzipped bodies.
+	peers sync.Map
+}
+
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := t.peers.Load(req.URL.Host); ok && t.server.Compress && req.Body != nil && req.Body != http.NoBody && req.Header.Get("Content-Encoding") == "" {
+		body, w := io.Pipe()
+		go func(r io.ReadCloser) {
+			defer r.Close()
+			gz := gzip.NewWriter(w)
+			_, err := io.Copy(gz, r)
+			if err == nil {
+				err = gz.Close()
+			}
+			w.CloseWithError(err)
+		}(req.Body)
+		req = cloneRequest(req)
+		req.Body, req.GetBody, req.ContentLength = body, nil, -1
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.Header.Get("Accept-Encoding") == "gzip" {
+		t.peers.Store(req.URL.Host, true)
+	}
+	return resp, err
+}
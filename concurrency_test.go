@@ -0,0 +1,85 @@
+package chord
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentStabilizeAndLookup runs stabilization, finger repair and notifications on
+// every node while lookups, reads and writes go through them, for go test -race to check
+// that the routing state is only touched under mu.
+func TestConcurrentStabilizeAndLookup(t *testing.T) {
+	r := newTestRing(t, 8, quietConfig)
+	ctx := context.Background()
+	const rounds = 20
+	var wg sync.WaitGroup
+	for _, i := range r.Live() {
+		n := r.Nodes[i]
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				n.Stabilize(ctx)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				n.FixFingers(ctx, j)
+				if j%5 == 0 {
+					n.FixAllFingers(ctx)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				n.Info()
+				n.Snapshot()
+				n.successorList()
+				n.predecessorList()
+			}
+		}()
+	}
+	keys := spread(32)
+	errs := make(chan error, len(r.Nodes)*len(keys))
+	for _, i := range r.Live() {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, key := range keys {
+				s, err := r.Nodes[i].FindSuccessor(ctx, key)
+				if err != nil {
+					errs <- fmt.Errorf("FindSuccessor(%x) from node %d: %v", key, i, err)
+					continue
+				}
+				// the ring is stable, so stabilizing it must not change any answer.
+				if want := r.Nodes[r.owner(key)]; s.ID() != want.ID() {
+					errs <- fmt.Errorf("FindSuccessor(%x) from node %d = %x, want %x", key, i, s.ID(), want.ID())
+				}
+			}
+		}(i)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j, key := range keys[:8] {
+				key += uint64(i)
+				if err := r.Servers[i].Set(key, strings.NewReader(fmt.Sprint(j))); err != nil {
+					errs <- fmt.Errorf("Set(%x) on node %d: %v", key, i, err)
+					continue
+				}
+				if _, err := r.Servers[(i+1)%len(r.Servers)].Get(key); err != nil {
+					errs <- fmt.Errorf("Get(%x) on node %d: %v", key, i+1, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
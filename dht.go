@@ -2,181 +2,1074 @@ package chord
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type DHTServer struct {
 	node  *LocalNode
 	store Store
+	// leaveMu guards left and resume, which record how far a departure has progressed.
+	leaveMu sync.Mutex
+	left    bool
+	resume  *uint64
+
+	// Quorum is the number of nodes, including the owner, that must acknowledge a write.
+	Quorum int
+	// ReadQuorum is the number of nodes, including the owner, GetQuorum must hear from,
+	// defaulting to a majority of the owner and its replicas.
+	ReadQuorum int
+	// ReadRepair, when set, writes a value read from a replica back to any replica,
+	// including the owner, whose copy differs.
+	ReadRepair bool
+	// ReadNearest makes Get, and reads proxied through this node, read from whichever of
+	// the owner and its replicas responds fastest, as GetNearest does.
+	ReadNearest bool
+	// ReadCacheSize, when positive, caches up to that many values that Get read from other
+	// nodes, serving them again for ReadCacheTTL, defaulting to DefaultReadCacheTTL, without
+	// asking the owner. ReadCacheBytes, when positive, also bounds their total size. Keys
+	// this node owns are always read from its store. A cached value can be stale by up to
+	// ReadCacheTTL unless the write was made through this server or passed to
+	// InvalidateCached.
+	ReadCacheSize  int
+	ReadCacheTTL   time.Duration
+	ReadCacheBytes int64
+	// BatchSize is the number of keys sent per request when leaving, defaulting to DefaultBatchSize.
+	BatchSize int
+	// ContentHash creates the hash Put derives keys from, defaulting to SHA-256. The key is
+	// the first eight bytes of the sum, big-endian.
+	ContentHash func() hash.Hash
+	// KeyHash maps the string keys of GetString and SetString into the identifier space,
+	// defaulting to HashKey. Setting it to the hash of another consistent-hashing scheme
+	// gives every key the same id in both, for migrating from one to the other.
+	KeyHash func(key string) uint64
+	// PeerRateLimit and GlobalRateLimit cap the /node and /store requests served per second
+	// from each remote address and in total, answering 429 beyond them. Requests from ring
+	// members, and signed ones when the ring has a secret, are exempt. Both are unlimited
+	// by default.
+	PeerRateLimit   RateLimit
+	GlobalRateLimit RateLimit
+	// Compress gzips store values, migrations and RPC responses sent to peers that also
+	// compress. It is off by default for peers that predate it.
+	Compress bool
+	// MaxValueSize caps the body of a write to a single key, including replica writes, and
+	// the values of a compare-and-swap. MaxTransferSize caps every other /store body, such
+	// as batches and the migrations sent when nodes join and leave, so it must fit
+	// BatchSize values. Larger bodies are refused with 413 and ErrTooLarge, measured after
+	// decompression. Both are unlimited by default, and should match across the ring.
+	MaxValueSize    int64
+	MaxTransferSize int64
+	// TransferCodec is the codec migrations are sent in and listings are served in to
+	// peers that ask for it, defaulting to TransferJSON. TransferGob avoids inflating
+	// binary values by a third, but needs every node in the ring to understand it.
+	TransferCodec TransferCodec
+
+	// client is the node's client with bodies gzipped as Compress allows.
+	client *http.Client
+	// lookups coalesces concurrent lookups for the same key.
+	lookups flightGroup
+	limiter rateLimiter
+	// releaseMu guards onRelease.
+	releaseMu sync.Mutex
+	onRelease func(owner Node, keys []uint64) error
+	// constrainMu serializes constrain, so that keys are released once even when
+	// notifications arrive faster than the OnRelease handler returns.
+	constrainMu sync.Mutex
+	// watchMu guards watchers, the subscriptions made with Subscribe.
+	watchMu  sync.Mutex
+	watchers map[*watcher]bool
+	// nearest ranks replicas for GetNearest.
+	nearest nearestCache
+	// reads caches values read from other nodes.
+	reads readCache
 }
 
 // NewDHTServer binds a node to a given store.
 func NewDHTServer(node *LocalNode, store Store) (*DHTServer, error) {
-	node.OnPredecessor(func(predecessor Node) {
-		// delete all the keys up to the predecessor's id because they now own it.
-		if err := store.Constrain(predecessor.ID(), node.ID()); err != nil {
-			// TODO: error handling
-			log.Printf("error when constraining %v", err)
+	s := &DHTServer{node: node, store: store}
+	client := *node.client
+	next := client.Transport
+	if next == nil {
+		next = sharedTransport
+	}
+	client.Transport = &unreachableTransport{next: &gzipTransport{next: next, server: s}}
+	s.client = &client
+	node.OnPredecessor(s.constrain)
+	if successor := node.successor(); successor != node && successor.Host() != node.Host() {
+		// make this node a replicant of the successor, unless it is a vnode sharing this store.
+		if err := pullRecords(context.Background(), node.logger, node.client, successor.Host(), store, DefaultBatchSize); err != nil {
+			return nil, err
+		}
+		// the successor's records include keys this node does not hold, which only a change
+		// of predecessor would otherwise drop.
+		if p := node.currentPredecessor(); p != nil {
+			go s.constrain(p)
+		}
+	}
+	return s, nil
+}
+
+// constrainRetry is how long constrain waits before trying again when the ring could not
+// be walked or the keys could not be released.
+const constrainRetry = 5 * time.Second
+
+// retryConstrain runs constrain again after constrainRetry, unless the predecessor has
+// changed since, in which case the change has already run it.
+func (s *DHTServer) retryConstrain(predecessor Node) {
+	time.AfterFunc(constrainRetry, func() {
+		if s.node.ctx.Err() != nil {
+			return
+		}
+		if p := s.node.currentPredecessor(); p != nil && p.ID() == predecessor.ID() {
+			s.constrain(p)
 		}
 	})
-	if node.successors[0] != node {
-		// make this node a replicant of the successor.
-		resp, err := http.Get(fmt.Sprintf("http://%s/store", node.successors[0].Host()))
+}
+
+// constrain drops the keys this node neither owns nor replicates now that predecessor
+// precedes it, first handing them to the OnRelease handler, if any.
+func (s *DHTServer) constrain(predecessor Node) {
+	s.constrainMu.Lock()
+	defer s.constrainMu.Unlock()
+	node := s.node
+	// keys owned by the nodes preceding this one are replicated here, so walk back
+	// past every node that has this one in its successor list.
+	lower := predecessor
+	for i := 0; i < len(node.successorList()); i++ {
+		p, err := lower.Predecessor(context.Background())
+		if err != nil || p == nil {
+			// the ring is in flux, keep everything until it can be walked.
+			node.logger.Debug("walking predecessors failed", "from", lower.Host(), "err", err)
+			s.retryConstrain(predecessor)
+			return
+		}
+		if p.ID() == node.ID() {
+			lower = node
+			break
+		}
+		lower = p
+	}
+	if err := s.release(lower.ID(), node.ID()); err != nil {
+		// keep the keys so the release is retried.
+		node.logger.Warn("releasing keys failed", "start", lower.ID(), "end", node.ID(), "err", err)
+		s.retryConstrain(predecessor)
+		return
+	}
+	// delete all the keys up to that id because they now own it.
+	if err := s.store.Constrain(lower.ID(), node.ID()); err != nil {
+		node.logger.Error("constraining store failed", "start", lower.ID(), "end", node.ID(), "err", err)
+		s.retryConstrain(predecessor)
+	}
+}
+
+func (s *DHTServer) Get(key uint64) (io.Reader, error) {
+	value, _, err := s.GetVersioned(key)
+	return value, err
+}
+
+// GetVersioned returns the value of key along with the version it was written at.
+func (s *DHTServer) GetVersioned(key uint64) (io.Reader, Version, error) {
+	return s.getVersioned(context.Background(), key)
+}
+
+// getVersioned is GetVersioned recorded as a span, a child of any span in ctx.
+func (s *DHTServer) getVersioned(ctx context.Context, key uint64) (value io.Reader, version Version, err error) {
+	ctx, span := s.node.tracer.Start(ctx, "chord.Get")
+	span.SetAttribute("key", fmt.Sprintf("%x", key))
+	defer func() { span.End(err) }()
+	if s.ReadNearest {
+		return s.getNearest(ctx, key)
+	}
+	node, err := s.lookupContext(ctx, key)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	if node.ID() == s.node.ID() {
+		value, version, err := s.store.GetVersioned(key)
+		if !errors.Is(err, ErrCorrupt) {
+			return value, version, err
+		}
+		s.node.logger.Error("owned value corrupt, reading from replicas", "key", fmt.Sprintf("%x", key), "err", err)
+		return s.getFromReplicas(ctx, node, key, err)
+	}
+	if s.ReadCacheSize > 0 {
+		if value, version, ok := s.cachedRead(key); ok {
+			s.node.metrics.observeReadCache(true)
+			return bytes.NewReader(value), version, nil
+		}
+		s.node.metrics.observeReadCache(false)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/store?key=%x&vnode=%x", node.Host(), key, node.ID()), nil)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	resp, err := s.client.Do(req)
+	if err == nil && resp.StatusCode == 200 {
+		if s.ReadCacheSize <= 0 {
+			return verifyResponse(resp), headerVersion(resp.Header), nil
+		}
+		b, err := io.ReadAll(verifyResponse(resp))
+		resp.Body.Close()
 		if err != nil {
-			return nil, err
+			return nil, Version{}, err
+		}
+		s.cacheRead(key, b, headerVersion(resp.Header))
+		return bytes.NewReader(b), headerVersion(resp.Header), nil
+	}
+	if err == nil {
+		resp.Body.Close()
+		err = statusError(resp)
+		if errors.Is(err, ErrKeyNotFound) {
+			// the owner is up, so its answer is authoritative.
+			return nil, Version{}, err
 		}
-		body, err := ioutil.ReadAll(resp.Body)
+	}
+	return s.getFromReplicas(ctx, node, key, err)
+}
+
+// getFromReplicas reads key from the replicas held by the successors of node, its owner,
+// which failed with err, repairing the owner and the other replicas if ReadRepair is set.
+func (s *DHTServer) getFromReplicas(ctx context.Context, node Node, key uint64, err error) (io.Reader, Version, error) {
+	// fall back to the replicas held by the owner's successors.
+	successors, serr := node.Successors(ctx)
+	if serr != nil {
+		return nil, Version{}, err
+	}
+	for _, m := range successors {
+		if m.ID() == node.ID() {
+			continue
+		}
+		value, version, ttl, rerr := s.getReplica(ctx, m, key)
+		if rerr != nil {
+			continue
+		}
+		if !s.ReadRepair {
+			return value, version, nil
+		}
+		b, rerr := io.ReadAll(value)
+		closeReader(value)
+		if rerr != nil {
+			continue
+		}
+		// the repair outlives the read, so it must not be cancelled with it.
+		go s.repair(context.WithoutCancel(ctx), key, b, version, ttl, append([]Node{node}, successors...), m)
+		return bytes.NewReader(b), version, nil
+	}
+	return nil, Version{}, err
+}
+
+// lookup finds the owner of key, sharing the walk with any identical lookup in flight.
+func (s *DHTServer) lookup(key uint64) (Node, error) {
+	return s.lookupContext(context.Background(), key)
+}
+
+// lookupContext is lookup made with ctx. A shared walk carries the values of the ctx of
+// the caller that started it, so only that caller's trace records it, but not its
+// cancellation, which would otherwise fail the walk for every caller sharing it.
+func (s *DHTServer) lookupContext(ctx context.Context, key uint64) (Node, error) {
+	ctx = context.WithoutCancel(ctx)
+	return s.lookups.do(key, func() (Node, error) {
+		return s.node.FindSuccessor(ctx, key)
+	})
+}
+
+// getReplica returns node's copy of key along with its version and remaining lifetime.
+func (s *DHTServer) getReplica(ctx context.Context, node Node, key uint64) (io.Reader, Version, time.Duration, error) {
+	if node.ID() == s.node.ID() {
+		ttl, err := s.store.TTL(key)
+		if err != nil {
+			return nil, Version{}, 0, err
+		}
+		value, version, err := s.store.GetVersioned(key)
+		return value, version, ttl, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/store?key=%x&replica=true", node.Host(), key), nil)
+	if err != nil {
+		return nil, Version{}, 0, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, Version{}, 0, err
+	} else if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, Version{}, 0, statusError(resp)
+	}
+	return verifyResponse(resp), headerVersion(resp.Header), headerTTL(resp.Header), nil
+}
+
+// headerVersion returns the version carried by h, treating a missing one as the zero version.
+func headerVersion(h http.Header) Version {
+	version, err := ParseVersion(h.Get(VersionHeader))
+	if err != nil {
+		return Version{}
+	}
+	return version
+}
+
+// headerTTL returns the lifetime carried by h, treating a missing one as never expiring.
+func headerTTL(h http.Header) time.Duration {
+	ttl, err := time.ParseDuration(h.Get(TTLHeader))
+	if err != nil {
+		return 0
+	}
+	return ttl
+}
+
+func (s *DHTServer) Set(key uint64, value io.Reader) error {
+	return s.set(context.Background(), key, value, Version{}, 0)
+}
+
+// SetVersioned writes value at version unless a newer write to key has already been made.
+// A zero version is replaced by a fresh one assigned by the key's owner.
+func (s *DHTServer) SetVersioned(key uint64, value io.Reader, version Version) error {
+	return s.set(context.Background(), key, value, version, 0)
+}
+
+// SetWithTTL writes value such that it expires from the owner and every replica after ttl.
+func (s *DHTServer) SetWithTTL(key uint64, value io.Reader, ttl time.Duration) error {
+	return s.set(context.Background(), key, value, Version{}, ttl)
+}
+
+// set writes key through its owner, recorded as a span that is a child of any span in ctx.
+func (s *DHTServer) set(ctx context.Context, key uint64, value io.Reader, version Version, ttl time.Duration) (err error) {
+	ctx, span := s.node.tracer.Start(ctx, "chord.Set")
+	span.SetAttribute("key", fmt.Sprintf("%x", key))
+	defer func() { span.End(err) }()
+	s.InvalidateCached(key)
+	node, err := s.lookupContext(ctx, key)
+	if err != nil {
+		return err
+	}
+	if node.ID() == s.node.ID() {
+		return s.setLocal(ctx, key, value, version, ttl)
+	}
+	return s.post(ctx, fmt.Sprintf("http://%s/store?key=%x&vnode=%x", node.Host(), key, node.ID()), value, version, ttl)
+}
+
+func (s *DHTServer) post(ctx context.Context, url string, value io.Reader, version Version, ttl time.Duration) error {
+	req, err := newChecksumRequest("POST", url, value)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if !version.IsZero() {
+		req.Header.Set(VersionHeader, version.String())
+	}
+	if ttl > 0 {
+		req.Header.Set(TTLHeader, ttl.String())
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// setLocal streams value into the store and to every replica at once rather than buffering it.
+func (s *DHTServer) setLocal(ctx context.Context, key uint64, value io.Reader, version Version, ttl time.Duration) error {
+	if version.IsZero() {
+		current, prev, err := s.store.GetVersioned(key)
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		closeReader(current)
+		version = nextVersion(s.node.ID(), prev)
+	}
+	replicas := s.replicas()
+	readers := make([]*io.PipeReader, len(replicas))
+	writers := make(fanout, len(replicas))
+	for i := range replicas {
+		readers[i], writers[i] = io.Pipe()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.replicate(replicas, func(i int, m Node) error {
+			err := s.setReplica(ctx, m, key, readers[i], version, ttl)
+			// unblock the writer if the replica stopped reading early.
+			readers[i].CloseWithError(err)
+			return err
+		})
+	}()
+	err := s.store.SetVersionedWithTTL(key, io.TeeReader(value, writers), version, ttl)
+	writers.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+	s.publish(Change{Type: KeySet, Key: key, Version: version})
+	return <-done
+}
+
+func (s *DHTServer) setReplica(ctx context.Context, node Node, key uint64, value io.Reader, version Version, ttl time.Duration) error {
+	if node.ID() == s.node.ID() {
+		return s.store.SetVersionedWithTTL(key, value, version, ttl)
+	}
+	return s.post(ctx, fmt.Sprintf("http://%s/store?key=%x&replica=true", node.Host(), key), value, version, ttl)
+}
+
+// replicas returns this node's distinct successors, which hold copies of the keys it owns.
+// Vnodes on this node's own host are skipped since they share its store.
+func (s *DHTServer) replicas() []Node {
+	seen := map[uint64]bool{s.node.ID(): true}
+	var replicas []Node
+	for _, m := range s.node.successorList() {
+		if !seen[m.ID()] && m.Host() != s.node.Host() {
+			seen[m.ID()] = true
+			replicas = append(replicas, m)
+		}
+	}
+	return replicas
+}
+
+// replicate applies fn to each replica concurrently, returning an error if fewer than
+// Quorum nodes (counting this one) acknowledged.
+func (s *DHTServer) replicate(replicas []Node, fn func(int, Node) error) error {
+	errs := make(chan error)
+	for i, m := range replicas {
+		go func(i int, m Node) { errs <- fn(i, m) }(i, m)
+	}
+	acks := 1
+	for range replicas {
+		if err := <-errs; err != nil {
+			s.node.logger.Warn("replication failed", "err", err)
+		} else {
+			acks++
+		}
+	}
+	if acks < s.Quorum {
+		return fmt.Errorf("%w: replicated to %d of %d required nodes", ErrReplicationFailed, acks, s.Quorum)
+	}
+	return nil
+}
+
+// Range returns every key in the inclusive interval [start, end], walking clockwise from
+// start so that start > end wraps around zero.
+func (s *DHTServer) Range(start, end uint64) (map[uint64]io.Reader, error) {
+	ctx := context.Background()
+	out := map[uint64]io.Reader{}
+	visited := map[uint64]bool{}
+	id := start
+	for {
+		node, err := s.node.FindSuccessor(ctx, id)
 		if err != nil {
 			return nil, err
 		}
-		var data map[uint64][]byte
-		if err := json.Unmarshal(body, &data); err != nil {
+		if visited[node.ID()] {
+			return out, nil
+		}
+		visited[node.ID()] = true
+		if err := s.gather(node, start, end, out); err != nil {
 			return nil, err
 		}
-		for key, value := range data {
-			if err := store.Set(key, bytes.NewReader(value)); err != nil {
-				return nil, err
+		if between(start-1, end, node.ID()) {
+			// this node owns the end of the interval.
+			return out, nil
+		}
+		id = node.ID() + 1
+	}
+}
+
+// gather adds the keys node holds in [start, end] to out, skipping any already present.
+func (s *DHTServer) gather(node Node, start, end uint64, out map[uint64]io.Reader) error {
+	if node.ID() == s.node.ID() {
+		keys, err := s.store.Keys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if _, ok := out[key]; ok || !between(start-1, key, end) {
+				continue
 			}
+			value, err := s.store.Get(key)
+			if errors.Is(err, ErrKeyNotFound) {
+				// expired since it was listed.
+				continue
+			} else if err != nil {
+				return err
+			}
+			out[key] = value
+		}
+		return nil
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/store?start=%x&end=%x", node.Host(), start, end), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", acceptTransfers)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return statusError(resp)
+	}
+	values := &MemoryStore{}
+	if _, _, err := readRecords(resp.Body, resp.Header.Get("Content-Type"), values); err != nil {
+		return err
+	}
+	for key, value := range values.All() {
+		if _, ok := out[key]; !ok {
+			out[key] = bytes.NewReader(value)
 		}
 	}
-	return &DHTServer{node: node, store: store}, nil
+	return nil
 }
 
-func (s *DHTServer) Get(key uint64) (io.Reader, error) {
-	node, err := s.node.FindSuccessor(key)
+// Members walks the ring clockwise from this node and returns every live node in order.
+// A node that does not respond is stepped over using the successor list of the node before
+// it. If the walk revisits a node or passes this one without landing on it, the nodes
+// found so far are returned along with an error.
+func (s *DHTServer) Members(ctx context.Context) ([]Node, error) {
+	var last Node = s.node
+	members := []Node{last}
+	seen := map[uint64]bool{last.ID(): true}
+	successors, err := s.node.Successors(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if node.ID() == s.node.ID() {
-		return s.store.Get(key)
+	for {
+		var next Node
+		var nextSuccessors []Node
+		for _, m := range successors {
+			if m.ID() == s.node.ID() {
+				// back at the start.
+				return members, nil
+			}
+			if t, err := m.Successors(ctx); err == nil {
+				next, nextSuccessors = m, t
+				break
+			} else if ctx.Err() != nil {
+				return members, err
+			}
+		}
+		if next == nil {
+			return members, fmt.Errorf("no live successor after %s", last.Serialize())
+		}
+		if seen[next.ID()] || !between(last.ID(), next.ID(), s.node.ID()) {
+			return members, fmt.Errorf("inconsistent ring: %s follows %s", next.Serialize(), last.Serialize())
+		}
+		seen[next.ID()] = true
+		members = append(members, next)
+		last, successors = next, nextSuccessors
 	}
-	resp, err := http.Get(fmt.Sprintf("http://%s/store?key=%x", node.Host(), key))
+}
+
+func (s *DHTServer) GetString(key string) (io.Reader, error) {
+	return s.Get(hashWith(s.KeyHash, key))
+}
+
+func (s *DHTServer) SetString(key string, value io.Reader) error {
+	return s.Set(hashWith(s.KeyHash, key), value)
+}
+
+// Put stores value under a key derived from its content and returns the key. Identical
+// content always maps to the same key, so storing it again never clobbers other data.
+func (s *DHTServer) Put(value io.Reader) (uint64, error) {
+	newHash := s.ContentHash
+	if newHash == nil {
+		newHash = sha256.New
+	}
+	h := newHash()
+	b, err := io.ReadAll(io.TeeReader(value, h))
 	if err != nil {
-		return nil, err
-	} else if resp.StatusCode != 200 {
-		return nil, io.ErrUnexpectedEOF
+		return 0, err
 	}
-	return resp.Body, nil
+	var sum [8]byte
+	copy(sum[:], h.Sum(nil))
+	key := binary.BigEndian.Uint64(sum[:])
+	return key, s.Set(key, bytes.NewReader(b))
 }
 
-func (s *DHTServer) Set(key uint64, value io.Reader) error {
-	node, err := s.node.FindSuccessor(key)
+func (s *DHTServer) Delete(key uint64) error {
+	s.InvalidateCached(key)
+	node, err := s.lookup(key)
 	if err != nil {
 		return err
 	}
 	if node.ID() == s.node.ID() {
-		return s.store.Set(key, value)
+		if err := s.store.Delete(key); err != nil {
+			return err
+		}
+		s.publish(Change{Type: KeyDeleted, Key: key})
+		return s.replicate(s.replicas(), func(i int, m Node) error {
+			return s.deleteReplica(m, key)
+		})
+	}
+	return s.delete(fmt.Sprintf("http://%s/store?key=%x&vnode=%x", node.Host(), key, node.ID()))
+}
+
+func (s *DHTServer) deleteReplica(node Node, key uint64) error {
+	return s.delete(fmt.Sprintf("http://%s/store?key=%x&replica=true", node.Host(), key))
+}
+
+func (s *DHTServer) delete(url string) error {
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
 	}
-	resp, err := http.Post(fmt.Sprintf("http://%s/store?key=%x", node.Host(), key), "application/octet-stream", value)
+	resp, err := s.client.Do(req)
 	if err != nil {
 		return err
-	} else if resp.StatusCode != 200 {
-		return io.ErrShortWrite
 	}
-	return err
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return statusError(resp)
+	}
+	return nil
 }
 
+// HTTPServeMux serves the node and its store under the base path of the node's host, so
+// that a node advertised as host:port/chord answers /chord/node and /chord/store and can
+// be mounted alongside other routes.
 func (s *DHTServer) HTTPServeMux() *http.ServeMux {
+	base := basePath(s.node.host)
 	mux := http.NewServeMux()
-	mux.Handle("/node", s.node.HTTPHandlerFunc())
-	mux.Handle("/store", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		switch req.Method {
-		case "GET":
-			key := req.URL.Query().Get("key")
-			if key == "" {
-				body, err := json.Marshal(s.store.All())
-				if err != nil {
-					w.WriteHeader(500)
-					return
-				}
-				if _, err := w.Write(body); err != nil {
-					w.WriteHeader(500)
-					return
-				}
-			} else {
-				intkey, err := strconv.ParseUint(key, 16, 64)
-				if err != nil {
-					log.Printf("error %v", err)
-					w.WriteHeader(500)
-					return
-				}
-				value, err := s.Get(intkey)
-				if err != nil {
-					log.Printf("error %v", err)
-					w.WriteHeader(500)
-					return
-				}
-				if _, err := io.Copy(w, value); err != nil {
-					log.Printf("error %v", err)
-					w.WriteHeader(500)
-					return
-				}
-			}
-
-		case "POST":
-			key := req.URL.Query().Get("key")
-			if key == "" {
-				body, err := io.ReadAll(req.Body)
-				if err != nil {
-					w.WriteHeader(400)
-					return
-				}
-				var data map[uint64][]byte
-				if err := json.Unmarshal(body, &data); err != nil {
-					w.WriteHeader(400)
-					return
-				}
-				for key, value := range data {
-					if err := s.store.Set(key, bytes.NewReader(value)); err != nil {
-						w.WriteHeader(500)
-						return
-					}
-				}
-				w.WriteHeader(200)
-			} else {
-				intkey, err := strconv.ParseUint(key, 16, 64)
-				if err != nil {
-					log.Printf("error %v", err)
-					w.WriteHeader(500)
-					return
-				}
-				if err := s.Set(intkey, req.Body); err != nil {
-					log.Printf("error %v", err)
-					w.WriteHeader(500)
-					return
-				}
-				w.WriteHeader(200)
-			}
-		default:
-			w.WriteHeader(400)
+	mux.Handle(base+"/node", s.rpcHandler(s.node.HTTPHandlerFunc()))
+	mux.Handle(base+"/healthz", http.HandlerFunc(s.serveHealthz))
+	mux.Handle(base+"/readyz", readyzHandler(s.node))
+	mux.Handle(base+"/metrics", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !s.node.authorized(req, false) {
+			w.WriteHeader(401)
+			return
 		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.node.metrics.Export(w, s.node, s.store)
 	}))
+	mux.Handle(base+"/store", s.rpcHandler(http.HandlerFunc(s.serveStore)))
 	return mux
 }
 
-func (s *DHTServer) String() string {
-	return fmt.Sprintf("--- dht ---\n%v\n--- store ---\n%v", s.node, s.store)
+// AdminServeMux serves the admin RPCs, POST /admin?op=Drain and op=Rebalance, under the
+// base path of the node's host. They are kept off HTTPServeMux so that they can be served
+// only where operators can reach them, such as on a loopback address, and when the ring
+// has a secret they must be signed like any write.
+func (s *DHTServer) AdminServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(basePath(s.node.host)+"/admin", s.node.wrap(s.node.traceHandler(http.HandlerFunc(s.serveAdmin))))
+	return mux
 }
 
-func (s *DHTServer) Close() error {
-	// send the data to the predecessor.
-	body, err := json.Marshal(s.store.All())
+// rpcHandler wraps h in what every RPC passes through, outermost first: the node's
+// Middleware, tracing, rate limiting and compression.
+func (s *DHTServer) rpcHandler(h http.Handler) http.Handler {
+	return s.node.wrap(s.node.traceHandler(s.rateLimitHandler(s.gzipHandler(h))))
+}
+
+// storeOps are the /store ops by method and name. Requests without an op, or with one not
+// listed, are reads, writes and deletes of a key or of the records the node holds.
+var storeOps = map[string]map[string]func(*DHTServer, http.ResponseWriter, *http.Request){
+	"GET": {
+		"Locate":   (*DHTServer).serveLocate,
+		"Watch":    (*DHTServer).serveWatch,
+		"Replicas": (*DHTServer).serveReplicas,
+		"Inspect":  (*DHTServer).serveInspect,
+		"Names":    (*DHTServer).serveNames,
+	},
+	"POST": {
+		"CompareAndSwap": (*DHTServer).serveCompareAndSwap,
+		"SetBatch":       (*DHTServer).serveBatch,
+		"GetBatch":       (*DHTServer).serveBatch,
+		"Name":           (*DHTServer).serveName,
+	},
+}
+
+// adminOps are the /admin ops, all of which are POSTs.
+var adminOps = map[string]func(*DHTServer, http.ResponseWriter, *http.Request){
+	"Drain":     (*DHTServer).serveDrain,
+	"Rebalance": (*DHTServer).serveRebalance,
+}
+
+func (s *DHTServer) serveStore(w http.ResponseWriter, req *http.Request) {
+	if !s.node.authorized(req, req.Method != "GET") {
+		w.WriteHeader(401)
+		return
+	}
+	if req.Method == "POST" && !s.limitBody(w, req) {
+		return
+	}
+	if op, ok := storeOps[req.Method][req.URL.Query().Get("op")]; ok {
+		op(s, w, req)
+		return
+	}
+	key := req.URL.Query().Get("key")
+	switch {
+	case req.Method == "GET" && key == "":
+		s.serveList(w, req)
+	case req.Method == "GET":
+		s.serveGet(w, req)
+	case req.Method == "POST" && key == "":
+		s.serveLoad(w, req)
+	case req.Method == "POST":
+		s.serveSet(w, req)
+	case req.Method == "DELETE":
+		s.serveDelete(w, req)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *DHTServer) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	if !s.node.authorized(req, true) {
+		w.WriteHeader(401)
+		return
+	}
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	op, ok := adminOps[req.URL.Query().Get("op")]
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+	op(s, w, req)
+}
+
+// requestLogger is the node's logger annotated with req.
+func (s *DHTServer) requestLogger(req *http.Request) *slog.Logger {
+	return s.node.logger.With("method", req.Method, "query", req.URL.RawQuery)
+}
+
+// serveList answers the records the node holds after the key in after and in the range
+// from start to end, up to limit of them, or with op=Tree or op=Digests a summary of them.
+func (s *DHTServer) serveList(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if op := query.Get("op"); op == "Tree" || op == "Digests" {
+		s.serveTree(w, req)
+		return
+	}
+	var after *uint64
+	if query.Get("after") != "" {
+		key, err := strconv.ParseUint(query.Get("after"), 16, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		after = &key
+	}
+	limit := -1
+	if query.Get("limit") != "" {
+		n, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || n < 0 {
+			w.WriteHeader(400)
+			return
+		}
+		limit = n
+	}
+	var filter func(uint64) bool
+	if query.Get("start") != "" {
+		start, err := strconv.ParseUint(query.Get("start"), 16, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		end, err := strconv.ParseUint(query.Get("end"), 16, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		filter = func(key uint64) bool {
+			return between(start-1, key, end)
+		}
+	}
+	keys, err := sortedKeys(s.store, func(key uint64) bool {
+		return (after == nil || key > *after) && (filter == nil || filter(key))
+	})
 	if err != nil {
-		return err
+		w.WriteHeader(500)
+		return
+	}
+	codec := acceptCodec(req, s.TransferCodec)
+	w.Header().Set("Content-Type", codec.contentType())
+	if err := writeRecords(w, codec, s.store, keys, limit); err != nil {
+		s.requestLogger(req).Error("store request failed", "err", err)
+	}
+}
+
+// serveGet answers the value of key, from this node's store alone for a replica read or
+// with op=Digest its digest.
+func (s *DHTServer) serveGet(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	key, err := strconv.ParseUint(query.Get("key"), 16, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	if offset, length, ok := parseRange(req.Header.Get("Range")); ok && query.Get("op") != "Digest" {
+		s.serveRange(w, req, key, offset, length)
+		return
+	}
+	get := func(key uint64) (io.Reader, Version, error) {
+		return s.getVersioned(req.Context(), key)
+	}
+	if query.Get("replica") != "" || query.Get("op") == "Digest" {
+		get = s.store.GetVersioned
+	}
+	value, version, err := get(key)
+	if err != nil {
+		writeStoreError(w, s.requestLogger(req), err)
+		return
+	}
+	defer closeReader(value)
+	w.Header().Set(VersionHeader, version.String())
+	if ttl, err := s.store.TTL(key); err == nil && ttl > 0 {
+		w.Header().Set(TTLHeader, ttl.String())
 	}
-	resp, err := http.Post(fmt.Sprintf("http://%s/store", s.node.predecessor.Host()), "application/json", bytes.NewReader(body))
+	if query.Get("op") == "Digest" {
+		sum, err := digest(value)
+		if err != nil {
+			s.requestLogger(req).Error("store request failed", "err", err)
+			w.WriteHeader(500)
+			return
+		}
+		w.Write([]byte(sum))
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Trailer", ChecksumHeader)
+	value = &checksumReader{Reader: value, done: func(sum string) error {
+		w.Header().Set(ChecksumHeader, sum)
+		return nil
+	}}
+	if _, err := io.Copy(w, value); err != nil {
+		// the status has been sent, so the client sees a short body without a checksum.
+		s.requestLogger(req).Error("store request failed", "err", err)
+	}
+}
+
+// serveLoad stores the records in the body, as sent when keys migrate between nodes.
+func (s *DHTServer) serveLoad(w http.ResponseWriter, req *http.Request) {
+	if _, _, err := readRecords(req.Body, req.Header.Get("Content-Type"), s.store); err != nil {
+		s.requestLogger(req).Error("store request failed", "err", err)
+		w.WriteHeader(bodyStatus(err))
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// serveSet writes the body to key, to this node's store alone for a replica write.
+func (s *DHTServer) serveSet(w http.ResponseWriter, req *http.Request) {
+	key, err := strconv.ParseUint(req.URL.Query().Get("key"), 16, 64)
 	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	var version Version
+	if h := req.Header.Get(VersionHeader); h != "" {
+		if version, err = ParseVersion(h); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	var ttl time.Duration
+	if h := req.Header.Get(TTLHeader); h != "" {
+		if ttl, err = time.ParseDuration(h); err != nil || ttl < 0 {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	set := func(key uint64, value io.Reader, version Version, ttl time.Duration) error {
+		return s.set(req.Context(), key, value, version, ttl)
+	}
+	if req.URL.Query().Get("replica") != "" {
+		set = s.store.SetVersionedWithTTL
+	}
+	if err := set(key, verifyChecksum(req.Body, &req.Header, &req.Trailer), version, ttl); err != nil {
+		writeStoreError(w, s.requestLogger(req), err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// serveDelete deletes key, from this node's store alone for a replica delete.
+func (s *DHTServer) serveDelete(w http.ResponseWriter, req *http.Request) {
+	key, err := strconv.ParseUint(req.URL.Query().Get("key"), 16, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	del := s.Delete
+	if req.URL.Query().Get("replica") != "" {
+		del = s.store.Delete
+	}
+	if err := del(key); err != nil {
+		writeStoreError(w, s.requestLogger(req), err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// serveDrain answers once the node is drained.
+func (s *DHTServer) serveDrain(w http.ResponseWriter, req *http.Request) {
+	if err := s.Drain(req.Context()); err != nil {
+		writeStoreError(w, s.requestLogger(req), err)
+		return
+	}
+	w.Write([]byte("drained"))
+}
+
+// serveRebalance moves every key this node holds to its owners, such as after a split
+// ring has been reconciled.
+func (s *DHTServer) serveRebalance(w http.ResponseWriter, req *http.Request) {
+	if err := s.rebalanceAll(req.Context()); err != nil {
+		writeStoreError(w, s.requestLogger(req), err)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// wrap applies the node's Middleware to h, the first outermost.
+func (n *LocalNode) wrap(h http.Handler) http.Handler {
+	for i := len(n.middleware) - 1; i >= 0; i-- {
+		h = n.middleware[i](h)
+	}
+	return h
+}
+
+// serveHealthz answers liveness probes, which pass as long as the process is serving. A
+// store refusing writes is reported as read-only without failing the probe, since the node
+// still serves reads and restarting it would not fix the store. A node being drained is
+// reported as draining, and then as drained once it is ready to be taken down.
+func (s *DHTServer) serveHealthz(w http.ResponseWriter, req *http.Request) {
+	if guard := writeGuard(s.store); guard != nil && guard.ReadOnly() {
+		w.Write([]byte("read-only"))
+		return
+	}
+	switch atomic.LoadInt32(&s.node.drain) {
+	case draining:
+		w.Write([]byte("draining"))
+	case drained:
+		w.Write([]byte("drained"))
+	default:
+		w.Write([]byte("ok"))
+	}
+}
+
+// stablePollInterval is how often WaitStable checks the node's routing state.
+const stablePollInterval = 20 * time.Millisecond
+
+// WaitStable blocks until the node has settled into the ring or ctx is done, for callers
+// that start nodes and then need routing to have converged before making requests. In a
+// ring of several nodes it waits for a predecessor other than this node and a successor
+// list refilled by stabilization; a node alone in its ring is stable as soon as it starts.
+func (s *DHTServer) WaitStable(ctx context.Context) error {
+	ticker := time.NewTicker(stablePollInterval)
+	defer ticker.Stop()
+	for !s.node.stable() {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("ring not stable: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// readyzHandler answers readiness probes, which pass once every one of nodes is Ready.
+func readyzHandler(nodes ...*LocalNode) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, n := range nodes {
+			if !n.Ready() {
+				w.WriteHeader(503)
+				w.Write([]byte("not ready"))
+				return
+			}
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+func (s *DHTServer) String() string {
+	return fmt.Sprintf("--- dht ---\n%v\n--- store (%d keys, %d bytes) ---\n%v", s.node, s.store.Len(), s.store.Size(), s.store)
+}
+
+// Leave hands the keys this node owns to its successor, which owns them once this node
+// is gone, and then removes the node from the ring. It is safe to call more than once,
+// and calling it again after a failed transfer resumes from the last delivered batch.
+func (s *DHTServer) Leave(ctx context.Context) error {
+	s.leaveMu.Lock()
+	defer s.leaveMu.Unlock()
+	if s.left {
+		return nil
+	}
+	if atomic.LoadInt32(&s.node.drain) != drained {
+		if err := s.transfer(ctx); err != nil {
+			return err
+		}
+	}
+	s.left = true
+	return s.node.Leave(ctx)
+}
+
+// Drain prepares the node to be taken down for maintenance without interrupting service.
+// It stops the node taking over keys from a failed predecessor, hands the keys it owns to
+// its successor in batches while still serving them, and then splices the node out of
+// the ring so that the successor owns them. Writes made meanwhile reach the successor as
+// their replica. The node keeps running and answering RPCs for nodes that have yet to
+// route around it, and a later Leave has nothing left to transfer. Like Leave, calling it
+// again after a failure resumes from the last delivered batch.
+func (s *DHTServer) Drain(ctx context.Context) error {
+	s.leaveMu.Lock()
+	defer s.leaveMu.Unlock()
+	if s.left || atomic.LoadInt32(&s.node.drain) == drained {
+		return nil
+	}
+	atomic.StoreInt32(&s.node.drain, draining)
+	s.node.logger.Info("draining")
+	if err := s.transfer(ctx); err != nil {
 		return err
 	}
-	if resp.StatusCode != 200 {
-		return errors.New(resp.Status)
+	if err := s.node.spliceOut(ctx); err != nil {
+		return err
 	}
+	s.node.logger.Info("drained")
 	return nil
-}
\ No newline at end of file
+}
+
+func (s *DHTServer) transfer(ctx context.Context) error {
+	successor := s.node.successor()
+	if successor.ID() == s.node.ID() || successor.Host() == s.node.Host() {
+		// a vnode on this host already shares the store.
+		return nil
+	}
+	predecessor := s.node.currentPredecessor()
+	keys, err := sortedKeys(s.store, func(key uint64) bool {
+		if s.resume != nil && key <= *s.resume {
+			// delivered by an earlier attempt.
+			return false
+		}
+		return predecessor == nil || between(predecessor.ID(), key, s.node.ID())
+	})
+	if err != nil {
+		return err
+	}
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	sent, err := pushRecords(ctx, s.node.logger, s.client, successor.Host(), s.store, keys, batchSize, s.TransferCodec)
+	if sent > 0 {
+		s.resume = &keys[sent-1]
+	}
+	return err
+}
+
+func (s *DHTServer) Close() error {
+	return s.Leave(context.Background())
+}
@@ -0,0 +1,227 @@
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// request makes a request to node i of r over the ring's network.
+func request(t *testing.T, r *TestRing, i int, method, path string, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://"+r.Nodes[i].Host()+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := r.Network.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestGetMissingKey(t *testing.T) {
+	r := newTestRing(t, 4, quietConfig)
+	key := r.Nodes[2].ID() - 1
+	if owner := r.owner(key); owner != 2 {
+		t.Fatalf("key %x is owned by node %d", key, owner)
+	}
+	if _, err := r.Servers[2].Get(key); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("local Get = %v, want ErrKeyNotFound", err)
+	}
+	if _, err := r.Servers[0].Get(key); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("remote Get = %v, want ErrKeyNotFound", err)
+	}
+	if _, err := r.Stores[2].Get(key); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("store Get = %v, want ErrKeyNotFound", err)
+	}
+	for _, i := range []int{0, 2} {
+		if resp := request(t, r, i, "GET", fmt.Sprintf("/store?key=%x", key), ""); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("GET from node %d = %d, want 404", i, resp.StatusCode)
+		}
+	}
+	c, err := NewClient([]string{r.Nodes[0].Host()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.HTTPClient = r.Network.Client()
+	if _, err := c.Get(key); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Client.Get = %v, want ErrKeyNotFound", err)
+	}
+}
+
+func TestGetDeletedKey(t *testing.T) {
+	r := newTestRing(t, 4, quietConfig)
+	key := r.Nodes[2].ID() - 1
+	if err := r.Servers[0].Set(key, strings.NewReader("value")); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 2} {
+		value, err := r.Servers[i].Get(key)
+		if err != nil {
+			t.Fatalf("Get from node %d: %v", i, err)
+		}
+		if b, _ := io.ReadAll(value); string(b) != "value" {
+			t.Errorf("Get from node %d = %q", i, b)
+		}
+	}
+	if err := r.Servers[0].Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 2} {
+		if _, err := r.Servers[i].Get(key); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get from node %d after Delete = %v, want ErrKeyNotFound", i, err)
+		}
+	}
+}
+
+func TestStoreStatus(t *testing.T) {
+	r := newTestRing(t, 4, quietConfig)
+	key := r.Nodes[2].ID() - 1
+	for _, s := range r.Servers {
+		s.MaxValueSize = 4
+	}
+	tests := []struct {
+		name, method, path, body string
+		want                     int
+	}{
+		{"malformed key", "GET", "/store?key=xyz", "", http.StatusBadRequest},
+		{"malformed write key", "POST", "/store?key=xyz", "v", http.StatusBadRequest},
+		{"malformed delete key", "DELETE", "/store?key=", "", http.StatusBadRequest},
+		{"malformed limit", "GET", "/store?limit=-1", "", http.StatusBadRequest},
+		{"missing key", "GET", fmt.Sprintf("/store?key=%x", key), "", http.StatusNotFound},
+		{"value too large", "POST", fmt.Sprintf("/store?key=%x", key), "too large", http.StatusRequestEntityTooLarge},
+		{"unsupported method", "PUT", fmt.Sprintf("/store?key=%x", key), "v", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		for _, i := range []int{0, 2} {
+			if resp := request(t, r, i, tt.method, tt.path, tt.body); resp.StatusCode != tt.want {
+				t.Errorf("%s: %s %s to node %d = %d, want %d", tt.name, tt.method, tt.path, i, resp.StatusCode, tt.want)
+			}
+		}
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/store?key=%x", r.Nodes[2].Host(), key), strings.NewReader("v"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(ChecksumHeader, checksum([]byte("w")))
+	resp, err := r.Network.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("bad checksum: POST = %d, want 422", resp.StatusCode)
+	}
+
+	// the owner is gone before its predecessor notices, so the write cannot be forwarded.
+	r.Crash(2)
+	if resp := request(t, r, 1, "POST", fmt.Sprintf("/store?key=%x", key), "v"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("crashed owner: POST = %d, want 502", resp.StatusCode)
+	}
+	if err := r.Servers[1].Set(key, strings.NewReader("v")); !errors.Is(err, ErrNodeUnreachable) {
+		t.Errorf("crashed owner: Set = %v, want ErrNodeUnreachable", err)
+	}
+}
+
+func TestStatusErrors(t *testing.T) {
+	for _, err := range []error{
+		ErrKeyNotFound,
+		ErrBadRequest,
+		ErrTooLarge,
+		ErrInvalidRange,
+		ErrCorrupt,
+		ErrStoreFull,
+		ErrReplicationFailed,
+		ErrNodeUnreachable,
+	} {
+		status := storeStatus(fmt.Errorf("wrapped: %w", err))
+		if got := statusError(&http.Response{StatusCode: status, Status: http.StatusText(status)}); !errors.Is(got, err) {
+			t.Errorf("statusError(%d) = %v, want %v", status, got, err)
+		}
+	}
+	for err, want := range map[error]int{
+		ErrQuorumNotReached:        http.StatusServiceUnavailable,
+		ErrReadOnly:                http.StatusServiceUnavailable,
+		ErrUnexpectedStatus:        http.StatusBadGateway,
+		ErrRoutingLoop:             http.StatusBadGateway,
+		errors.New("disk on fire"): http.StatusInternalServerError,
+	} {
+		if got := storeStatus(err); got != want {
+			t.Errorf("storeStatus(%v) = %d, want %d", err, got, want)
+		}
+	}
+	if got := statusError(&http.Response{StatusCode: 418}); !errors.Is(got, ErrUnexpectedStatus) {
+		t.Errorf("statusError(418) = %v, want ErrUnexpectedStatus", got)
+	}
+}
+
+func TestAdminServeMux(t *testing.T) {
+	config := quietConfig
+	config.Secret = []byte("secret")
+	r := newTestRing(t, 4, config)
+	admin := r.Servers[1].AdminServeMux()
+	serve := func(method, query string, sign bool) int {
+		req := httptest.NewRequest(method, "http://"+r.Nodes[1].Host()+"/admin?"+query, nil)
+		if sign {
+			SignRequest(req, config.Secret)
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := serve("POST", "op=Drain", false); code != http.StatusUnauthorized {
+		t.Errorf("unsigned Drain = %d, want 401", code)
+	}
+	if code := serve("GET", "op=Drain", true); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET Drain = %d, want 405", code)
+	}
+	if code := serve("POST", "op=Unknown", true); code != http.StatusBadRequest {
+		t.Errorf("unknown op = %d, want 400", code)
+	}
+	// the ring's routes no longer serve admin ops.
+	req, err := http.NewRequest("POST", "http://"+r.Nodes[0].Host()+"/store?op=Drain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SignRequest(req, config.Secret)
+	resp, err := r.Network.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if atomic.LoadInt32(&r.Nodes[0].drain) != 0 {
+		t.Error("POST /store?op=Drain drained the node")
+	}
+	if code := serve("POST", "op=Drain", true); code != http.StatusOK {
+		t.Errorf("Drain = %d, want 200", code)
+	}
+	if atomic.LoadInt32(&r.Nodes[1].drain) != drained {
+		t.Error("Drain did not drain the node")
+	}
+}
+
+func TestGetQuorumWithoutOwner(t *testing.T) {
+	r := newTestRing(t, 8, quietConfig)
+	settle(t, r)
+	key := r.Nodes[5].ID() - 1
+	if err := r.Servers[0].Set(key, strings.NewReader("v")); err != nil {
+		t.Fatal(err)
+	}
+	// the owner is gone but nobody has noticed, so it cannot list its successors.
+	r.Crash(5)
+	value, err := r.Servers[1].GetQuorum(key)
+	if err != nil {
+		t.Fatalf("GetQuorum: %v", err)
+	}
+	if b, _ := io.ReadAll(value); string(b) != "v" {
+		t.Errorf("GetQuorum = %q, want %q", b, "v")
+	}
+}
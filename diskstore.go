@@ -0,0 +1,391 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DiskStore persists each value in its own file under a directory, named by the key's
+// big-endian hex encoding so that a directory listing is in key order. Each file starts
+// with the value's version and expiry so that they are always replaced together.
+type DiskStore struct {
+	path string
+	// mu serializes the version check against the rename in SetVersioned and CompareAndSwap,
+	// and the expiry check against the removal of an expired file.
+	mu sync.Mutex
+}
+
+var (
+	_ Store      = (*DiskStore)(nil)
+	_ RangeStore = (*DiskStore)(nil)
+)
+
+// headerSize is the length of the version and expiry header at the start of each file.
+const headerSize = 24
+
+type diskHeader struct {
+	version Version
+	expires time.Time
+}
+
+func (h diskHeader) expired(now time.Time) bool {
+	return !h.expires.IsZero() && !now.Before(h.expires)
+}
+
+// NewDiskStore opens the store rooted at path, creating the directory if necessary.
+func NewDiskStore(path string) (*DiskStore, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskStore{path: path}, nil
+}
+
+func (s *DiskStore) filename(key uint64) string {
+	return filepath.Join(s.path, fmt.Sprintf("%016x", key))
+}
+
+func (s *DiskStore) Set(key uint64, value io.Reader) error {
+	return s.set(key, value, Version{}, 0, true)
+}
+
+func (s *DiskStore) Get(key uint64) (io.Reader, error) {
+	value, _, err := s.GetVersioned(key)
+	return value, err
+}
+
+func (s *DiskStore) SetVersioned(key uint64, value io.Reader, version Version) error {
+	return s.set(key, value, version, 0, false)
+}
+
+func (s *DiskStore) SetWithTTL(key uint64, value io.Reader, ttl time.Duration) error {
+	return s.set(key, value, Version{}, ttl, true)
+}
+
+func (s *DiskStore) SetVersionedWithTTL(key uint64, value io.Reader, version Version, ttl time.Duration) error {
+	return s.set(key, value, version, ttl, false)
+}
+
+func (s *DiskStore) set(key uint64, value io.Reader, version Version, ttl time.Duration, force bool) error {
+	name, err := s.writeTemp(value, version, ttl)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !force {
+		current, err := s.header(key)
+		if err != nil || (!current.expired(time.Now()) && version.Less(current.version)) {
+			os.Remove(name)
+			return err
+		}
+	}
+	return os.Rename(name, s.filename(key))
+}
+
+// CompareAndSwap replaces the value of key with new if it currently holds old, or is absent
+// if old is nil, and no newer version has been written.
+func (s *DiskStore) CompareAndSwap(key uint64, old, new []byte, version Version) (bool, error) {
+	name, err := s.writeTemp(bytes.NewReader(new), version, 0)
+	if err != nil {
+		return false, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ok, err := s.matches(key, old, version)
+	if err != nil || !ok {
+		os.Remove(name)
+		return false, err
+	}
+	return true, os.Rename(name, s.filename(key))
+}
+
+// matches reports whether key holds old and nothing newer than version, counting an
+// expired value as absent. The caller holds mu.
+func (s *DiskStore) matches(key uint64, old []byte, version Version) (bool, error) {
+	f, h, err := s.open(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return old == nil, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if h.expired(time.Now()) {
+		return old == nil, nil
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return false, err
+	}
+	return old != nil && bytes.Equal(b, old) && !version.Less(h.version), nil
+}
+
+// writeTemp writes a complete file to a temporary name so that a crash never leaves a
+// partial value behind, returning the name to rename into place.
+func (s *DiskStore) writeTemp(value io.Reader, version Version, ttl time.Duration) (string, error) {
+	f, err := os.CreateTemp(s.path, ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	var header [headerSize]byte
+	binary.BigEndian.PutUint64(header[:8], uint64(version.Timestamp))
+	binary.BigEndian.PutUint64(header[8:16], version.Node)
+	if deadline := expiry(ttl); !deadline.IsZero() {
+		binary.BigEndian.PutUint64(header[16:], uint64(deadline.UnixNano()))
+	}
+	if _, err := f.Write(header[:]); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if _, err := io.Copy(f, value); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Probe reports whether the store can be written, by writing and removing an empty file.
+func (s *DiskStore) Probe() error {
+	name, err := s.writeTemp(bytes.NewReader(nil), Version{}, 0)
+	if err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+func (s *DiskStore) GetVersioned(key uint64) (io.Reader, Version, error) {
+	f, h, err := s.open(key)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	if h.expired(time.Now()) {
+		f.Close()
+		if err := s.expire(key); err != nil {
+			return nil, Version{}, err
+		}
+		return nil, Version{}, ErrKeyNotFound
+	}
+	return f, h.version, nil
+}
+
+// open opens the file of key positioned after its header, expired or not.
+func (s *DiskStore) open(key uint64) (*os.File, diskHeader, error) {
+	f, err := os.Open(s.filename(key))
+	if os.IsNotExist(err) {
+		return nil, diskHeader{}, ErrKeyNotFound
+	} else if err != nil {
+		return nil, diskHeader{}, err
+	}
+	h, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, diskHeader{}, err
+	}
+	return f, h, nil
+}
+
+// expire deletes key if it is still expired, checking again under mu so that a value
+// renamed into place since it was found expired is kept.
+func (s *DiskStore) expire(key uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.header(key)
+	if err != nil || !h.expired(time.Now()) {
+		return err
+	}
+	return s.Delete(key)
+}
+
+// GetRange seeks to offset rather than reading the value up to it.
+func (s *DiskStore) GetRange(key uint64, offset, length int64) (io.Reader, int64, error) {
+	value, _, err := s.GetVersioned(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	f := value.(*os.File)
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	size := info.Size() - headerSize
+	start, n, err := span(offset, length, size)
+	if err == nil {
+		_, err = f.Seek(headerSize+start, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, n), f}, size, nil
+}
+
+func (s *DiskStore) TTL(key uint64) (time.Duration, error) {
+	h, err := s.header(key)
+	if err != nil || h.expired(time.Now()) {
+		return 0, err
+	}
+	return remaining(h.expires), nil
+}
+
+// header returns the header of key on disk, or the zero header if it is absent.
+func (s *DiskStore) header(key uint64) (diskHeader, error) {
+	f, err := os.Open(s.filename(key))
+	if os.IsNotExist(err) {
+		return diskHeader{}, nil
+	} else if err != nil {
+		return diskHeader{}, err
+	}
+	defer f.Close()
+	return readHeader(f)
+}
+
+func readHeader(r io.Reader) (diskHeader, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return diskHeader{}, err
+	}
+	h := diskHeader{version: Version{Timestamp: int64(binary.BigEndian.Uint64(header[:8])), Node: binary.BigEndian.Uint64(header[8:16])}}
+	if deadline := binary.BigEndian.Uint64(header[16:]); deadline != 0 {
+		h.expires = time.Unix(0, int64(deadline))
+	}
+	return h, nil
+}
+
+func (s *DiskStore) Delete(key uint64) error {
+	if err := os.Remove(s.filename(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Keys lists the keys present on disk, skipping any stray files and deleting any that
+// have expired.
+func (s *DiskStore) Keys() ([]uint64, error) {
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	keys := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		key, err := strconv.ParseUint(entry.Name(), 16, 64)
+		if err != nil || len(entry.Name()) != 16 {
+			continue
+		}
+		if h, err := s.header(key); err == nil && h.expired(now) {
+			s.expire(key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Sweep deletes expired keys every interval until ctx is cancelled.
+func (s *DiskStore) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Keys()
+		}
+	}
+}
+
+func (s *DiskStore) All() map[uint64][]byte {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil
+	}
+	out := make(map[uint64][]byte, len(keys))
+	for _, key := range keys {
+		b, err := os.ReadFile(s.filename(key))
+		if err != nil || len(b) < headerSize {
+			continue
+		}
+		out[key] = b[headerSize:]
+	}
+	return out
+}
+
+// Len counts the files of unexpired keys, reading only their headers.
+func (s *DiskStore) Len() int {
+	n, _ := s.stat()
+	return n
+}
+
+// Size sums the lengths of the files of unexpired keys, less their headers.
+func (s *DiskStore) Size() int64 {
+	_, size := s.stat()
+	return size
+}
+
+func (s *DiskStore) stat() (int, int64) {
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return 0, 0
+	}
+	now := time.Now()
+	n, size := 0, int64(0)
+	for _, entry := range entries {
+		key, err := strconv.ParseUint(entry.Name(), 16, 64)
+		if err != nil || len(entry.Name()) != 16 {
+			continue
+		}
+		if h, err := s.header(key); err != nil || h.expired(now) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		n, size = n+1, size+info.Size()-headerSize
+	}
+	return n, size
+}
+
+// Constrain holds mu while it deletes, so that writes wait for it rather than landing
+// partway through. Files are still removed one at a time, so a crash may leave some behind.
+func (s *DiskStore) Constrain(a, b uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		key, err := strconv.ParseUint(entry.Name(), 16, 64)
+		if err != nil || len(entry.Name()) != 16 || between(a, key, b) {
+			continue
+		}
+		if err := s.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DiskStore) String() string {
+	return fmt.Sprintf("disk[%s]", s.path)
+}
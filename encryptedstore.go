@@ -0,0 +1,178 @@
+package chord
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// EncryptedStore wraps a Store so that values are held as AES-GCM ciphertext, leaving keys,
+// versions and lifetimes in the clear. Each value is sealed with a random nonce and bound
+// to its key, so a ciphertext copied to another key fails to open. Constrain, Delete, Keys
+// and TTL pass straight through without decrypting anything.
+type EncryptedStore struct {
+	Store
+	aead cipher.AEAD
+}
+
+var _ Store = (*EncryptedStore)(nil)
+
+// ErrDecryptionFailed is returned when a stored value cannot be opened, such as when the
+// store was written with a different key.
+var ErrDecryptionFailed = errors.New("decryption failed")
+
+// NewEncryptedStore wraps store, encrypting with key, which must be 16, 24 or 32 bytes to
+// select AES-128, AES-192 or AES-256.
+func NewEncryptedStore(store Store, key []byte) (*EncryptedStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedStore{Store: store, aead: aead}, nil
+}
+
+func (s *EncryptedStore) seal(key uint64, value []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(value)+s.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, value, binary.BigEndian.AppendUint64(nil, key)), nil
+}
+
+func (s *EncryptedStore) open(key uint64, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < s.aead.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	nonce, sealed := ciphertext[:s.aead.NonceSize()], ciphertext[s.aead.NonceSize():]
+	value, err := s.aead.Open(nil, nonce, sealed, binary.BigEndian.AppendUint64(nil, key))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return value, nil
+}
+
+// sealReader reads value and seals it for key.
+func (s *EncryptedStore) sealReader(key uint64, value io.Reader) (io.Reader, error) {
+	b, err := io.ReadAll(value)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.seal(key, b)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(sealed), nil
+}
+
+func (s *EncryptedStore) Set(key uint64, value io.Reader) error {
+	sealed, err := s.sealReader(key, value)
+	if err != nil {
+		return err
+	}
+	return s.Store.Set(key, sealed)
+}
+
+func (s *EncryptedStore) Get(key uint64) (io.Reader, error) {
+	value, _, err := s.GetVersioned(key)
+	return value, err
+}
+
+func (s *EncryptedStore) SetVersioned(key uint64, value io.Reader, version Version) error {
+	sealed, err := s.sealReader(key, value)
+	if err != nil {
+		return err
+	}
+	return s.Store.SetVersioned(key, sealed, version)
+}
+
+func (s *EncryptedStore) SetWithTTL(key uint64, value io.Reader, ttl time.Duration) error {
+	sealed, err := s.sealReader(key, value)
+	if err != nil {
+		return err
+	}
+	return s.Store.SetWithTTL(key, sealed, ttl)
+}
+
+func (s *EncryptedStore) SetVersionedWithTTL(key uint64, value io.Reader, version Version, ttl time.Duration) error {
+	sealed, err := s.sealReader(key, value)
+	if err != nil {
+		return err
+	}
+	return s.Store.SetVersionedWithTTL(key, sealed, version, ttl)
+}
+
+func (s *EncryptedStore) GetVersioned(key uint64) (io.Reader, Version, error) {
+	value, version, err := s.getSealed(key)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	b, err := s.open(key, value)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	return bytes.NewReader(b), version, nil
+}
+
+// getSealed returns the ciphertext held for key.
+func (s *EncryptedStore) getSealed(key uint64) ([]byte, Version, error) {
+	value, version, err := s.Store.GetVersioned(key)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	defer closeReader(value)
+	b, err := io.ReadAll(value)
+	return b, version, err
+}
+
+// CompareAndSwap opens the current value to compare it with old, then swaps on the
+// ciphertext it read, so that a write landing in between makes the swap fail.
+func (s *EncryptedStore) CompareAndSwap(key uint64, old, new []byte, version Version) (bool, error) {
+	current, _, err := s.getSealed(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		current = nil
+	} else if err != nil {
+		return false, err
+	}
+	if (current != nil) != (old != nil) {
+		return false, nil
+	}
+	if current != nil {
+		value, err := s.open(key, current)
+		if err != nil {
+			return false, err
+		}
+		if !bytes.Equal(value, old) {
+			return false, nil
+		}
+	}
+	sealed, err := s.seal(key, new)
+	if err != nil {
+		return false, err
+	}
+	return s.Store.CompareAndSwap(key, current, sealed, version)
+}
+
+// All returns every value that can be decrypted.
+func (s *EncryptedStore) All() map[uint64][]byte {
+	out := map[uint64][]byte{}
+	for key, sealed := range s.Store.All() {
+		if value, err := s.open(key, sealed); err == nil {
+			out[key] = value
+		}
+	}
+	return out
+}
+
+func (s *EncryptedStore) String() string {
+	return fmt.Sprintf("encrypted[%d keys]", s.Store.Len())
+}
@@ -0,0 +1,144 @@
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// ErrNodeUnreachable is returned when a remote node could not be contacted in time.
+var ErrNodeUnreachable = errors.New("node unreachable")
+
+// ErrRoutingLoop is returned when an iterative lookup revisits a node or exceeds its hop budget.
+var ErrRoutingLoop = errors.New("routing loop")
+
+// ErrKeyNotFound is returned when a key has no value.
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrReplicationFailed is returned when a write was not acknowledged by enough replicas.
+var ErrReplicationFailed = errors.New("replication failed")
+
+// ErrQuorumNotReached is returned when a read was not answered by enough replicas.
+var ErrQuorumNotReached = errors.New("quorum not reached")
+
+// ErrStoreFull is returned when a write would take a store that rejects writes when full
+// over its limits.
+var ErrStoreFull = errors.New("store full")
+
+// ErrReadOnly is returned for writes to a WriteGuard that has turned read-only.
+var ErrReadOnly = errors.New("store is read-only")
+
+// ErrCorrupt is returned when a value does not match its checksum, having been damaged at
+// rest or in transit.
+var ErrCorrupt = errors.New("value corrupt")
+
+// ErrInvalidRange is returned when a ranged read starts past the end of the value.
+var ErrInvalidRange = errors.New("range not satisfiable")
+
+// ErrTooLarge is returned when a write's body exceeds DHTServer.MaxValueSize or
+// MaxTransferSize on the node serving it.
+var ErrTooLarge = errors.New("request body too large")
+
+// ErrUnexpectedStatus is returned when a peer answers a request with a failure status.
+var ErrUnexpectedStatus = errors.New("unexpected status")
+
+// ErrDuplicateID is returned when a node joins a ring that already has a member with its
+// id on another host. Routing assumes ids are unique, so the join is refused rather than
+// letting the two nodes split ownership of the id unpredictably.
+var ErrDuplicateID = errors.New("duplicate node id")
+
+// ErrJoinTimeout is returned when a node could not join the ring within Config.JoinTimeout.
+var ErrJoinTimeout = errors.New("join timed out")
+
+// ErrStaleSnapshot is returned when routing state cannot be restored from a snapshot,
+// because it was taken of another node or none of the nodes in it still respond.
+var ErrStaleSnapshot = errors.New("stale snapshot")
+
+// ErrBadRequest is returned when a peer rejects a request as malformed.
+var ErrBadRequest = errors.New("bad request")
+
+// ErrInvalidConfig is returned when a node is created with an unusable Config.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// errNoNextHop is returned by peers that predate the NextHop RPC.
+var errNoNextHop = errors.New("NextHop not supported")
+
+// statusError describes a failed /store response from a peer, mapping the statuses
+// storeStatus answers with back to the errors they stand for.
+func statusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		return fmt.Errorf("%w: %s", ErrBadRequest, resp.Status)
+	case http.StatusNotFound:
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, resp.Status)
+	case http.StatusBadGateway:
+		return fmt.Errorf("%w: %s", ErrNodeUnreachable, resp.Status)
+	case http.StatusServiceUnavailable:
+		return fmt.Errorf("%w: %s", ErrReplicationFailed, resp.Status)
+	case http.StatusInsufficientStorage:
+		return fmt.Errorf("%w: %s", ErrStoreFull, resp.Status)
+	case http.StatusUnprocessableEntity:
+		return fmt.Errorf("%w: %s", ErrCorrupt, resp.Status)
+	case http.StatusRequestedRangeNotSatisfiable:
+		return fmt.Errorf("%w: %s", ErrInvalidRange, resp.Status)
+	case http.StatusRequestEntityTooLarge:
+		return fmt.Errorf("%w: %s", ErrTooLarge, resp.Status)
+	}
+	return fmt.Errorf("%w: %s", ErrUnexpectedStatus, resp.Status)
+}
+
+// storeStatus is the status a /store request failing with err answers with: 404 for a
+// missing key, 400 for a malformed request, 413 for a body over the server's limits, 416
+// for a range past the end of the value, 422 for a value failing its checksum, 507 if the
+// owner's store is full, 502 if the owner could not be reached or failed, 503 if too few
+// replicas could be or the store is read-only, and 500 for anything gone wrong on this node.
+func storeStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrInvalidRange):
+		return http.StatusRequestedRangeNotSatisfiable
+	case errors.Is(err, ErrCorrupt):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrStoreFull):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrReplicationFailed), errors.Is(err, ErrQuorumNotReached), errors.Is(err, ErrReadOnly):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrNodeUnreachable), errors.Is(err, ErrUnexpectedStatus), errors.Is(err, ErrRoutingLoop):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// writeStoreError answers a failed /store request with the status of err, logging it
+// unless it is the caller's fault or only a missing key. Corrupt values are always logged,
+// since they may mean a failing disk.
+func writeStoreError(w http.ResponseWriter, logger *slog.Logger, err error) {
+	status := storeStatus(err)
+	if status >= 500 || errors.Is(err, ErrCorrupt) {
+		logger.Error("store request failed", "status", status, "err", err)
+	}
+	w.WriteHeader(status)
+}
+
+// unreachableTransport marks failures to get any response from a peer with
+// ErrNodeUnreachable, so that they can be told apart from peers that answered with one.
+type unreachableTransport struct {
+	next http.RoundTripper
+}
+
+func (t *unreachableTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if errors.Is(err, ErrTooLarge) {
+		// the body being forwarded ran over this node's limit, which is no fault of the peer.
+		return nil, err
+	} else if err != nil && req.Context().Err() == nil {
+		return nil, fmt.Errorf("%w: %v", ErrNodeUnreachable, err)
+	}
+	return resp, err
+}
@@ -0,0 +1,67 @@
+package chord
+
+import "strconv"
+
+// EventType identifies the change to a node's routing state that an Event reports.
+type EventType int
+
+const (
+	// PredecessorChanged is emitted when the node accepts a new predecessor.
+	PredecessorChanged EventType = iota
+	// SuccessorChanged is emitted when the node's first successor changes.
+	SuccessorChanged
+	// SuccessorFailed is emitted for each successor dropped for not responding.
+	SuccessorFailed
+	// FingerRepaired is emitted when a finger is pointed at a different node.
+	FingerRepaired
+	// RingInconsistent is emitted when the successor's predecessor has not pointed back at
+	// the node for several rounds of stabilization, which can mean that two rings formed
+	// during a partition. Node is the predecessor the successor has instead.
+	RingInconsistent
+)
+
+func (t EventType) String() string {
+	switch t {
+	case PredecessorChanged:
+		return "PredecessorChanged"
+	case SuccessorChanged:
+		return "SuccessorChanged"
+	case SuccessorFailed:
+		return "SuccessorFailed"
+	case FingerRepaired:
+		return "FingerRepaired"
+	case RingInconsistent:
+		return "RingInconsistent"
+	}
+	return "EventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// Event reports a change to a node's view of the ring. Node is the node now in the
+// affected position, or the one that failed for SuccessorFailed.
+type Event struct {
+	Type EventType
+	Node Node
+	// Finger is the index of the finger for FingerRepaired.
+	Finger int
+}
+
+// OnEvent registers fn to be called with every subsequent Event. Handlers run on the
+// goroutine that made the change, such as the stabilization loop or an RPC handler, so
+// they should return quickly and must not block on the node.
+func (n *LocalNode) OnEvent(fn func(Event)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.onEvent = append(n.onEvent, fn)
+}
+
+// emit calls the registered handlers with each of events. The caller does not hold mu.
+func (n *LocalNode) emit(events ...Event) {
+	n.mu.RLock()
+	handlers := n.onEvent
+	n.mu.RUnlock()
+	for _, e := range events {
+		for _, fn := range handlers {
+			fn(e)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package chord
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNilFingersRouteViaSuccessors(t *testing.T) {
+	r := newTestRing(t, 8, quietConfig)
+	n := r.Nodes[0]
+	n.mu.Lock()
+	for i := range n.finger {
+		n.finger[i] = nil
+	}
+	n.mu.Unlock()
+	n.cache.clear()
+	checkLookups(t, r, 0, spread(64))
+}
+
+func TestNilFingerAmongLive(t *testing.T) {
+	r := newTestRing(t, 8, quietConfig)
+	n := r.Nodes[0]
+	n.mu.Lock()
+	n.finger[M-1], n.finger[M-2] = nil, nil
+	n.mu.Unlock()
+	n.cache.clear()
+	checkLookups(t, r, 0, spread(64))
+}
+
+func TestFingerStart(t *testing.T) {
+	tests := []struct {
+		id   uint64
+		i    int
+		want uint64
+	}{
+		{0, 0, 1},
+		{0, 10, 1 << 10},
+		{0, M - 1, 1 << 63},
+		{1 << 62, 62, 1 << 63},
+		{1 << 63, M - 1, 0},
+		{math.MaxUint64, 0, 0},
+		{math.MaxUint64, 1, 1},
+		{math.MaxUint64 - 5, M - 1, 1<<63 - 6},
+	}
+	for _, tt := range tests {
+		if got := fingerStart(tt.id, tt.i); got != tt.want {
+			t.Errorf("fingerStart(%x, %d) = %x, want %x", tt.id, tt.i, got, tt.want)
+		}
+	}
+}
+
+func TestFingerStartsAreDistinct(t *testing.T) {
+	// near the top of the keyspace, the high fingers must wrap past zero rather than
+	// collapse onto the same start.
+	id := uint64(math.MaxUint64 - 1000)
+	seen := map[uint64]int{}
+	for i := 0; i < M; i++ {
+		start := fingerStart(id, i)
+		if j, ok := seen[start]; ok {
+			t.Fatalf("fingers %d and %d both start at %x", j, i, start)
+		}
+		seen[start] = i
+		if start-id != uint64(1)<<uint(i) {
+			t.Errorf("finger %d starts %x past the node, want %x", i, start-id, uint64(1)<<uint(i))
+		}
+	}
+}
+
+func TestFixAllFingers(t *testing.T) {
+	r := newTestRing(t, 8, quietConfig)
+	for _, i := range r.Live() {
+		fingers := r.Nodes[i].fingerTable()
+		for j, f := range fingers {
+			if want := r.Nodes[r.owner(fingerStart(r.Nodes[i].ID(), j))]; f.ID() != want.ID() {
+				t.Errorf("node %d finger %d = %x, want %x", i, j, f.ID(), want.ID())
+			}
+		}
+	}
+}
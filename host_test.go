@@ -0,0 +1,86 @@
+package chord
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalHost(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"127.0.0.1:5001", "127.0.0.1:5001"},
+		{"[::1]:5001", "[::1]:5001"},
+		{"[fe80::1]:80/chord/", "[fe80::1]:80/chord"},
+		{"node0:5000", "node0:5000"},
+	}
+	for _, tt := range tests {
+		got, err := canonicalHost(tt.host)
+		if err != nil || got != tt.want {
+			t.Errorf("canonicalHost(%q) = %q, %v, want %q", tt.host, got, err, tt.want)
+		}
+	}
+	for _, host := range []string{"::1:5001", "127.0.0.1", ""} {
+		if got, err := canonicalHost(host); err == nil {
+			t.Errorf("canonicalHost(%q) = %q, want an error", host, got)
+		}
+	}
+}
+
+func TestSerializeIPv6(t *testing.T) {
+	for _, s := range []string{"2a:[::1]:5001", `{"id":"2a","host":"[::1]:5001"}`} {
+		var n RemoteNode
+		if err := n.Deserialize(s); err != nil {
+			t.Fatalf("Deserialize(%q): %v", s, err)
+		}
+		if n.ID() != 0x2a || n.Host() != "[::1]:5001" {
+			t.Errorf("Deserialize(%q) = %x %s", s, n.ID(), n.Host())
+		}
+		if got := n.Serialize(); got != "2a:[::1]:5001" {
+			t.Errorf("Serialize() = %q", got)
+		}
+	}
+}
+
+// listenIPv6 starts a node with a DHTServer on an IPv6 loopback port, skipping the test if
+// the host has no IPv6 loopback.
+func listenIPv6(t *testing.T, id uint64, seeds []string) *LocalNode {
+	t.Helper()
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	return serveNode(t, l, id, seeds, quietConfig)
+}
+
+func TestIPv6JoinAndLookup(t *testing.T) {
+	ctx := context.Background()
+	a := listenIPv6(t, 1<<62, nil)
+	b := listenIPv6(t, 3<<62, []string{a.Host()})
+	if !strings.HasPrefix(a.Host(), "[::1]:") {
+		t.Fatalf("host %q is not a bracketed IPv6 loopback", a.Host())
+	}
+	for i := 0; i < 3; i++ {
+		a.Stabilize(ctx)
+		b.Stabilize(ctx)
+	}
+	if a.successor().ID() != b.ID() || b.successor().ID() != a.ID() {
+		t.Fatalf("successors %x and %x, want each other", a.successor().ID(), b.successor().ID())
+	}
+	if p := a.currentPredecessor(); p == nil || p.Host() != b.Host() {
+		t.Fatalf("predecessor of a is %v, want %s", p, b.Host())
+	}
+	for _, n := range []*LocalNode{a, b} {
+		for key, want := range map[uint64]*LocalNode{1: a, 1 << 62: a, 1<<62 + 1: b, 3 << 62: b, 3<<62 + 1: a} {
+			s, err := n.FindSuccessor(ctx, key)
+			if err != nil {
+				t.Fatalf("FindSuccessor(%x) from %s: %v", key, n.Host(), err)
+			}
+			if s.ID() != want.ID() || s.Host() != want.Host() {
+				t.Errorf("FindSuccessor(%x) from %s = %x at %s, want %x at %s", key, n.Host(), s.ID(), s.Host(), want.ID(), want.Host())
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package chord
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Info is a snapshot of a node's routing state, served as JSON by op=Info. Fingers are
+// listed by index, with null for any that are unset.
+type Info struct {
+	ID          string    `json:"id"`
+	Host        string    `json:"host"`
+	Predecessor *nodeJSON `json:"predecessor"`
+	// Predecessors lists the nodes preceding the predecessor, nearest first.
+	Predecessors   []nodeJSON  `json:"predecessors"`
+	Successors     []nodeJSON  `json:"successors"`
+	Fingers        []*nodeJSON `json:"fingers"`
+	LastStabilized *time.Time  `json:"lastStabilized,omitempty"`
+	// LastNotified is when the predecessor last notified this node.
+	LastNotified        *time.Time `json:"lastNotified,omitempty"`
+	LastStabilizeError  *ErrorInfo `json:"lastStabilizeError,omitempty"`
+	LastFixFingersError *ErrorInfo `json:"lastFixFingersError,omitempty"`
+	// SuccessorDrops counts the successors skipped over for failing to respond.
+	SuccessorDrops uint64 `json:"successorDrops"`
+	// InconsistentSince is set while the successor's predecessor does not point back at
+	// this node, from when it was first flagged. See LocalNode.Inconsistent.
+	InconsistentSince *time.Time `json:"inconsistentSince,omitempty"`
+	// RecentLookups samples the lookups made from this node, most recent first.
+	RecentLookups []LookupInfo `json:"recentLookups,omitempty"`
+}
+
+// ErrorInfo is an error a node ran into and when.
+type ErrorInfo struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+// health records how well a node is keeping its place in the ring, so that Info can show
+// why a node is struggling rather than only that it is.
+type health struct {
+	sync.Mutex
+	stabilizeErr   *ErrorInfo
+	fixFingersErr  *ErrorInfo
+	successorDrops uint64
+	lastNotified   time.Time
+	// mismatches counts the consecutive rounds of stabilization in which the successor's
+	// predecessor did not point back, and inconsistentSince is set once there have been
+	// inconsistentRounds of them.
+	mismatches        int
+	inconsistentSince time.Time
+}
+
+// record stores err, if any, in field.
+func (h *health) record(field **ErrorInfo, err error) {
+	if err == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	*field = &ErrorInfo{Error: err.Error(), Time: time.Now().UTC()}
+}
+
+func (h *health) successorDropped() {
+	h.Lock()
+	defer h.Unlock()
+	h.successorDrops++
+}
+
+// mismatched records a round in which the successor's predecessor did not point back,
+// returning how many there have been in a row.
+func (h *health) mismatched() int {
+	h.Lock()
+	defer h.Unlock()
+	h.mismatches++
+	if h.mismatches == inconsistentRounds {
+		h.inconsistentSince = time.Now().UTC()
+	}
+	return h.mismatches
+}
+
+// reconciled records a round in which the successor's predecessor pointed back, reporting
+// whether the node had been flagged inconsistent.
+func (h *health) reconciled() bool {
+	h.Lock()
+	defer h.Unlock()
+	flagged := !h.inconsistentSince.IsZero()
+	h.mismatches, h.inconsistentSince = 0, time.Time{}
+	return flagged
+}
+
+func (h *health) notified() {
+	h.Lock()
+	defer h.Unlock()
+	h.lastNotified = time.Now().UTC()
+}
+
+func toJSON(m Node) *nodeJSON {
+	if m == nil {
+		return nil
+	}
+	return &nodeJSON{ID: fmt.Sprintf("%x", m.ID()), Host: m.Host()}
+}
+
+func (n *LocalNode) Info() Info {
+	info := Info{
+		ID:          fmt.Sprintf("%x", n.id),
+		Host:        n.host,
+		Predecessor: toJSON(n.currentPredecessor()),
+		Fingers:     make([]*nodeJSON, M),
+	}
+	if ps := n.predecessorList(); len(ps) > 0 {
+		for _, p := range ps[1:] {
+			info.Predecessors = append(info.Predecessors, *toJSON(p))
+		}
+	}
+	for _, s := range n.successorList() {
+		info.Successors = append(info.Successors, *toJSON(s))
+	}
+	for i, f := range n.fingerTable() {
+		info.Fingers[i] = toJSON(f)
+	}
+	if t := atomic.LoadInt64(&n.lastStabilized); t != 0 {
+		stabilized := time.Unix(0, t).UTC()
+		info.LastStabilized = &stabilized
+	}
+	info.RecentLookups = n.routes.list()
+	n.health.Lock()
+	defer n.health.Unlock()
+	if !n.health.lastNotified.IsZero() {
+		notified := n.health.lastNotified
+		info.LastNotified = &notified
+	}
+	info.LastStabilizeError, info.LastFixFingersError = n.health.stabilizeErr, n.health.fixFingersErr
+	info.SuccessorDrops = n.health.successorDrops
+	if !n.health.inconsistentSince.IsZero() {
+		since := n.health.inconsistentSince
+		info.InconsistentSince = &since
+	}
+	return info
+}
@@ -0,0 +1,104 @@
+package chord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// ReplicaStatus is one holder's copy of a key, as reported by Inspect.
+type ReplicaStatus struct {
+	Node Node
+	// Present is false if the node holds no copy of the key.
+	Present bool
+	Version Version
+	// Checksum is the hex SHA-256 of the node's copy, as op=Digest reports it.
+	Checksum string
+	// Err is set if the node could not be asked or could not read its copy, such as with
+	// ErrCorrupt. Present, Version and Checksum are then unknown.
+	Err error
+}
+
+// Inspect asks the owner of key and every replica for their copy's version and checksum,
+// without transferring the values, so that divergent replicas can be found without
+// querying each node by hand. Statuses are in the order Replicas returns the nodes. It
+// only fails if the holders cannot be determined; a holder that cannot be asked is
+// reported with its Err set.
+func (s *DHTServer) Inspect(key uint64) ([]ReplicaStatus, error) {
+	nodes, err := s.Replicas(key)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]ReplicaStatus, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node Node) {
+			defer wg.Done()
+			status := ReplicaStatus{Node: node}
+			status.Checksum, status.Version, status.Err = s.getVersionedDigest(context.Background(), node, key)
+			if status.Present = status.Err == nil; errors.Is(status.Err, ErrKeyNotFound) {
+				status.Err = nil
+			}
+			statuses[i] = status
+		}(i, node)
+	}
+	wg.Wait()
+	return statuses, nil
+}
+
+// ReplicasAgree reports whether every status from Inspect was read and they all hold the
+// same version of the same value, or all lack the key.
+func ReplicasAgree(statuses []ReplicaStatus) bool {
+	for _, status := range statuses {
+		if first := statuses[0]; status.Err != nil || status.Present != first.Present || status.Version != first.Version || status.Checksum != first.Checksum {
+			return false
+		}
+	}
+	return true
+}
+
+// replicaStatusJSON is the JSON representation of a ReplicaStatus.
+type replicaStatusJSON struct {
+	Node     *nodeJSON `json:"node"`
+	Present  bool      `json:"present"`
+	Version  string    `json:"version,omitempty"`
+	Checksum string    `json:"checksum,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// serveInspect answers GET /store?op=Inspect&key=... with a JSON object reporting each
+// holder's copy of key, owner first, and whether they all agree.
+func (s *DHTServer) serveInspect(w http.ResponseWriter, req *http.Request) {
+	key, err := strconv.ParseUint(req.URL.Query().Get("key"), 16, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	statuses, err := s.Inspect(key)
+	if err != nil {
+		writeStoreError(w, s.node.logger, err)
+		return
+	}
+	out := struct {
+		Agree    bool                `json:"agree"`
+		Replicas []replicaStatusJSON `json:"replicas"`
+	}{Agree: ReplicasAgree(statuses), Replicas: make([]replicaStatusJSON, len(statuses))}
+	for i, status := range statuses {
+		r := replicaStatusJSON{Node: toJSON(status.Node), Present: status.Present, Checksum: status.Checksum}
+		if status.Present {
+			r.Version = status.Version.String()
+		}
+		if status.Err != nil {
+			r.Error = status.Err.Error()
+		}
+		out.Replicas[i] = r
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		s.node.logger.Warn("writing replica statuses failed", "err", err)
+	}
+}
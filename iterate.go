@@ -0,0 +1,163 @@
+package chord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// KeyValue is a single entry yielded by Iterate.
+type KeyValue struct {
+	Key     uint64
+	Value   []byte
+	Version Version
+}
+
+// cursor tracks how far through a range Iterate has got, so that a replica can pick up
+// where a failed node left off without yielding keys twice.
+type cursor struct {
+	start, end uint64
+	last       uint64
+	started    bool
+}
+
+func (c *cursor) includes(key uint64) bool {
+	return between(c.start-1, key, c.end) && (!c.started || key > c.last)
+}
+
+// Iterate streams every key/value pair stored in the ring. Each member's range is read
+// from that member, falling back to the replicas after it if it fails, so every key is
+// yielded once even though several nodes hold it. Ranges that no node could serve, for
+// instance because of churn during the walk, are logged and skipped. The channel is
+// closed once the walk completes or ctx is done.
+func (s *DHTServer) Iterate(ctx context.Context) (<-chan KeyValue, error) {
+	members, err := s.Members(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan KeyValue)
+	go func() {
+		defer close(out)
+		for i, m := range members {
+			c := &cursor{start: members[(i+len(members)-1)%len(members)].ID() + 1, end: m.ID()}
+			var candidates []Node
+			for j := 0; j < len(members) && j <= len(s.node.successors); j++ {
+				candidates = append(candidates, members[(i+j)%len(members)])
+			}
+			if err := s.iterateRange(ctx, candidates, c, out); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				s.node.logger.Warn("skipping range", "start", fmt.Sprintf("%x", c.start), "end", fmt.Sprintf("%x", c.end), "err", err)
+			}
+		}
+	}()
+	return out, nil
+}
+
+// iterateRange yields the keys in c from the first of candidates able to serve them.
+func (s *DHTServer) iterateRange(ctx context.Context, candidates []Node, c *cursor, out chan<- KeyValue) error {
+	var err error
+	for _, m := range candidates {
+		if m.ID() == s.node.ID() {
+			err = s.iterateLocal(ctx, c, out)
+		} else {
+			err = s.iterateRemote(ctx, m, c, out)
+		}
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *DHTServer) iterateLocal(ctx context.Context, c *cursor, out chan<- KeyValue) error {
+	keys, err := sortedKeys(s.store, c.includes)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		value, version, err := s.store.GetVersioned(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(value)
+		closeReader(value)
+		if err != nil {
+			return err
+		}
+		if err := yield(ctx, c, out, KeyValue{Key: key, Value: b, Version: version}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iterateRemote pages through node's records in c, DefaultBatchSize at a time.
+func (s *DHTServer) iterateRemote(ctx context.Context, node Node, c *cursor, out chan<- KeyValue) error {
+	for {
+		query := url.Values{
+			"start": {fmt.Sprintf("%x", c.start)},
+			"end":   {fmt.Sprintf("%x", c.end)},
+			"limit": {strconv.Itoa(DefaultBatchSize)},
+		}
+		if c.started {
+			query.Set("after", fmt.Sprintf("%x", c.last))
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/store?%s", node.Host(), query.Encode()), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Accept", acceptTransfers)
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		n, err := s.yieldRecords(ctx, resp, c, out)
+		if err != nil {
+			return err
+		}
+		if n < DefaultBatchSize {
+			return nil
+		}
+	}
+}
+
+func (s *DHTServer) yieldRecords(ctx context.Context, resp *http.Response, c *cursor, out chan<- KeyValue) (int, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, statusError(resp)
+	}
+	dec := newRecordDecoder(resp.Body, resp.Header.Get("Content-Type"))
+	for n := 0; ; n++ {
+		var rec record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if err := rec.verify(); err != nil {
+			return n, err
+		}
+		if err := yield(ctx, c, out, KeyValue{Key: rec.Key, Value: rec.Value, Version: rec.Version}); err != nil {
+			return n, err
+		}
+	}
+}
+
+// yield sends kv and advances c past it.
+func yield(ctx context.Context, c *cursor, out chan<- KeyValue, kv KeyValue) error {
+	select {
+	case out <- kv:
+		c.last, c.started = kv.Key, true
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
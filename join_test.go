@@ -0,0 +1,143 @@
+package chord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestJoinDuplicateID(t *testing.T) {
+	r := newTestRing(t, 4, quietConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := quietConfig
+	config.Client = r.Network.Client()
+	for _, seed := range []int{0, 2, 3} {
+		_, err := NewLocalNodeWithSeeds(ctx, r.Nodes[2].ID(), "dup:5000", []string{r.Nodes[seed].Host()}, config)
+		if !errors.Is(err, ErrDuplicateID) {
+			t.Errorf("joining through node %d with node 2's id = %v, want ErrDuplicateID", seed, err)
+		}
+	}
+	// the same id on the same host is the node restarting, not a duplicate.
+	n, err := NewLocalNodeWithSeeds(ctx, r.Nodes[2].ID(), r.Nodes[2].Host(), []string{r.Nodes[0].Host()}, config)
+	if err != nil {
+		t.Fatalf("rejoining with node 2's id and host: %v", err)
+	}
+	n.cancel()
+	// the ring is untouched.
+	if err := r.Stabilize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkLookups(t, r, 0, spread(32))
+}
+
+// TestNotifyDuplicateID has nodes that raced to join with an id already in the ring notify
+// its holder and the holder's successor, both of which must refuse them.
+func TestNotifyDuplicateID(t *testing.T) {
+	r := newTestRing(t, 4, quietConfig)
+	ctx := context.Background()
+	dup := candidate(r, r.Nodes[1].ID(), "dup:5000")
+	for _, i := range []int{1, 2} {
+		if err := r.Nodes[i].Notify(ctx, dup); !errors.Is(err, ErrDuplicateID) {
+			t.Errorf("node %d Notify = %v, want ErrDuplicateID", i, err)
+		}
+		// over RPC, the refusal maps back to the same error.
+		m := candidate(r, r.Nodes[i].ID(), r.Nodes[i].Host())
+		if err := m.Notify(ctx, dup); !errors.Is(err, ErrDuplicateID) {
+			t.Errorf("node %d Notify over RPC = %v, want ErrDuplicateID", i, err)
+		}
+	}
+	if p := r.Nodes[2].currentPredecessor(); p.Host() != r.Nodes[1].Host() {
+		t.Errorf("node 2 predecessor = %s, want node 1", p.Host())
+	}
+}
+
+// growRing joins nodes with ids one at a time through the first, stabilizing every node
+// once between joins, and returns how many of the joiners' successor list entries were
+// right just after they joined and how many rounds the whole ring then took to converge.
+func growRing(t *testing.T, strategy JoinStrategy, ids []uint64) (correct, rounds int) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	network := NewMemoryNetwork()
+	config := quietConfig
+	config.Client = network.Client()
+	config.JoinStrategy = strategy
+	var nodes []*LocalNode
+	// want checks n's successor list against the nodes joined so far, in ring order.
+	want := func(n *LocalNode) int {
+		sorted := append([]uint64(nil), ids[:len(nodes)]...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		at := sort.Search(len(sorted), func(i int) bool { return sorted[i] >= n.ID() })
+		right := 0
+		for j, s := range n.successorList() {
+			if s.ID() == sorted[(at+1+j)%len(sorted)] {
+				right++
+			}
+		}
+		return right
+	}
+	for i, id := range ids {
+		host := fmt.Sprintf("node%d:5000", i)
+		var seeds []string
+		if i > 0 {
+			seeds = []string{nodes[0].Host()}
+		}
+		n, err := NewLocalNodeWithSeeds(ctx, id, host, seeds, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewDHTServer(n, &MemoryStore{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		network.Handle(host, s.HTTPServeMux())
+		nodes = append(nodes, n)
+		correct += want(n)
+		for _, n := range nodes {
+			n.Stabilize(ctx)
+		}
+	}
+	for rounds = 0; rounds < 4*len(ids); rounds++ {
+		converged := true
+		for _, n := range nodes {
+			if want(n) != R {
+				converged = false
+			}
+		}
+		if converged {
+			return correct, rounds
+		}
+		for _, n := range nodes {
+			n.Stabilize(ctx)
+		}
+	}
+	t.Fatalf("ring of %d nodes did not converge", len(ids))
+	return
+}
+
+// TestJoinStrategies grows rings from one node with each join strategy. Looking each entry
+// up gives joiners a list at least as accurate as copying their successor's, which lags
+// the nodes that joined just before, and both converge.
+func TestJoinStrategies(t *testing.T) {
+	for _, size := range []int{3, 5, 8, 16} {
+		var copied, looked int
+		for seed := int64(1); seed <= 10; seed++ {
+			rng := rand.New(rand.NewSource(seed))
+			ids := make([]uint64, size)
+			for i := range ids {
+				ids[i] = rng.Uint64()
+			}
+			c, copyRounds := growRing(t, JoinCopy, ids)
+			l, lookupRounds := growRing(t, JoinLookup, ids)
+			copied, looked = copied+c, looked+l
+			t.Logf("%d nodes, seed %d: %d and %d entries right on join, converged in %d and %d rounds", size, seed, c, l, copyRounds, lookupRounds)
+		}
+		if looked < copied {
+			t.Errorf("%d nodes: joiners had %d entries right with JoinLookup, fewer than %d with JoinCopy", size, looked, copied)
+		}
+	}
+}
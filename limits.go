@@ -0,0 +1,51 @@
+package chord
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// limitBody caps req's body at MaxValueSize for a write to a single key and at
+// MaxTransferSize otherwise, reading past which fails with ErrTooLarge. A body declared
+// larger than that is refused with 413 up front, in which case it returns false.
+func (s *DHTServer) limitBody(w http.ResponseWriter, req *http.Request) bool {
+	limit := s.MaxTransferSize
+	if q := req.URL.Query(); q.Get("op") == "" && q.Get("key") != "" {
+		limit = s.MaxValueSize
+	}
+	if limit <= 0 {
+		return true
+	}
+	if req.ContentLength > limit {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return false
+	}
+	req.Body = &limitedBody{http.MaxBytesReader(w, req.Body, limit)}
+	return true
+}
+
+// limitedBody reports the error of an http.MaxBytesReader as ErrTooLarge, so that it keeps
+// its meaning through the stores and transports it is read by.
+type limitedBody struct {
+	io.ReadCloser
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		err = fmt.Errorf("%w: over %d bytes", ErrTooLarge, tooLarge.Limit)
+	}
+	return n, err
+}
+
+// bodyStatus is the status a request whose body could not be decoded answers with: 413 if
+// it was too large, or 400 if it was malformed.
+func bodyStatus(err error) int {
+	if errors.Is(err, ErrTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,105 @@
+package chord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Locate returns the node responsible for key without reading or writing it.
+func (s *DHTServer) Locate(key uint64) (Node, error) {
+	return s.lookup(key)
+}
+
+// LocateAll returns the node responsible for each of keys. Keys are resolved in ascending
+// order and a lookup is only made for a key past the last node found, since no node lies
+// between a key and its successor, so keys that share a node share a lookup.
+func (s *DHTServer) LocateAll(keys []uint64) (map[uint64]Node, error) {
+	return s.locateAll(context.Background(), keys)
+}
+
+// locateAll is LocateAll made with ctx.
+func (s *DHTServer) locateAll(ctx context.Context, keys []uint64) (map[uint64]Node, error) {
+	sorted := append([]uint64(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	out := make(map[uint64]Node, len(keys))
+	var known Node
+	var from uint64
+	for _, key := range sorted {
+		if known != nil && between(from-1, key, known.ID()) {
+			out[key] = known
+			continue
+		}
+		node, err := s.lookupContext(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		known, from = node, key
+		out[key] = node
+	}
+	return out, nil
+}
+
+// Replicas returns the nodes holding key: its owner followed by the successors the owner
+// replicates to, as given by the owner's current successor list. Successors sharing a host
+// with a node already listed are left out, since they share its store.
+func (s *DHTServer) Replicas(key uint64) ([]Node, error) {
+	owner, err := s.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.holders(context.Background(), owner)
+}
+
+// serveLocate answers GET /store?op=Locate&key=... with a JSON object mapping each key
+// given to the node responsible for it.
+func (s *DHTServer) serveLocate(w http.ResponseWriter, req *http.Request) {
+	var keys []uint64
+	for _, k := range req.URL.Query()["key"] {
+		key, err := strconv.ParseUint(k, 16, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		keys = append(keys, key)
+	}
+	nodes, err := s.LocateAll(keys)
+	if err != nil {
+		writeStoreError(w, s.node.logger, err)
+		return
+	}
+	out := make(map[string]*nodeJSON, len(nodes))
+	for key, node := range nodes {
+		out[fmt.Sprintf("%x", key)] = toJSON(node)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		s.node.logger.Warn("writing locations failed", "err", err)
+	}
+}
+
+// serveReplicas answers GET /store?op=Replicas&key=... with a JSON array of the nodes
+// holding key, owner first.
+func (s *DHTServer) serveReplicas(w http.ResponseWriter, req *http.Request) {
+	key, err := strconv.ParseUint(req.URL.Query().Get("key"), 16, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	nodes, err := s.Replicas(key)
+	if err != nil {
+		writeStoreError(w, s.node.logger, err)
+		return
+	}
+	out := make([]*nodeJSON, len(nodes))
+	for i, node := range nodes {
+		out[i] = toJSON(node)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		s.node.logger.Warn("writing replicas failed", "err", err)
+	}
+}
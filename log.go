@@ -0,0 +1,17 @@
+package chord
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardLogger is used when no logger is configured so that library users are not
+// spammed with routine errors from the background loops.
+var discardLogger = slog.New(discardHandler{})
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
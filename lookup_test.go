@@ -0,0 +1,315 @@
+package chord
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowStabilization delays the RPCs stabilization makes, as a slow peer would.
+func slowStabilization(delay time.Duration) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Query().Get("op") {
+			case "Ping", "Predecessor", "Predecessors", "Successors", "Notify":
+				time.Sleep(delay)
+			}
+			h.ServeHTTP(w, req)
+		})
+	}
+}
+
+// BenchmarkLookupDuringStabilization measures lookups from one node while, in the
+// stabilizing case, every node stabilizes in a loop against peers that take a millisecond
+// to answer each stabilization RPC. Stabilize holds no lock across those RPCs, so lookups
+// should take about as long as on an idle ring.
+func BenchmarkLookupDuringStabilization(b *testing.B) {
+	for _, stabilizing := range []bool{false, true} {
+		name := "idle"
+		if stabilizing {
+			name = "stabilizing"
+		}
+		b.Run(name, func(b *testing.B) {
+			config := quietConfig
+			config.Middleware = []func(http.Handler) http.Handler{slowStabilization(time.Millisecond)}
+			r := newTestRing(b, 16, config)
+			ctx, cancel := context.WithCancel(context.Background())
+			var wg sync.WaitGroup
+			if stabilizing {
+				for _, n := range r.Nodes {
+					wg.Add(1)
+					go func(n *LocalNode) {
+						defer wg.Done()
+						for ctx.Err() == nil {
+							n.Stabilize(ctx)
+						}
+					}(n)
+				}
+			}
+			keys := spread(256)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.Nodes[0].FindSuccessor(context.Background(), keys[i%len(keys)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			cancel()
+			wg.Wait()
+		})
+	}
+}
+
+// BenchmarkRemoteLookup measures lookups/sec from a RemoteNode into an 8-node ring served
+// over loopback TCP, with every RPC either drawing on the shared keep-alive transport or,
+// as before it, dialing a fresh connection.
+func BenchmarkRemoteLookup(b *testing.B) {
+	clients := map[string]func() *http.Client{
+		"shared": defaultClient,
+		"no-keepalive": func() *http.Client {
+			return &http.Client{Timeout: DefaultTimeout, Transport: &http.Transport{DisableKeepAlives: true}}
+		},
+	}
+	for _, name := range []string{"shared", "no-keepalive"} {
+		b.Run(name, func(b *testing.B) {
+			config := quietConfig
+			config.Client = clients[name]()
+			var nodes []*LocalNode
+			var seeds []string
+			for i := 0; i < 8; i++ {
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					b.Skipf("no loopback: %v", err)
+				}
+				n := serveNode(b, l, uint64(i)<<61+1, seeds, config)
+				nodes, seeds = append(nodes, n), []string{n.Host()}
+			}
+			ctx := context.Background()
+			for round := 0; round < 2*len(nodes); round++ {
+				for _, n := range nodes {
+					n.Stabilize(ctx)
+				}
+			}
+			for _, n := range nodes {
+				n.FixAllFingers(ctx)
+			}
+			m, err := NewRemoteNodeWithClient(nodes[0].Host(), clients[name]())
+			if err != nil {
+				b.Fatal(err)
+			}
+			keys := spread(256)
+			start := time.Now()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := m.FindSuccessor(ctx, keys[i%len(keys)]); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "lookups/s")
+		})
+	}
+}
+
+// inFlight counts the /node requests being served at once, and the most seen together.
+// Each is held for delay first, as a network would, so that requests overlap even on a
+// MemoryNetwork with a single CPU.
+type inFlight struct {
+	delay            time.Duration
+	now, peak, total atomic.Int64
+}
+
+func (c *inFlight) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.total.Add(1)
+		n := c.now.Add(1)
+		defer c.now.Add(-1)
+		for p := c.peak.Load(); n > p && !c.peak.CompareAndSwap(p, n); p = c.peak.Load() {
+		}
+		time.Sleep(c.delay)
+		h.ServeHTTP(w, req)
+	})
+}
+
+// noNextHop answers NextHop as peers that predate it do, so that lookups fall back to
+// asking each hop to resolve the rest recursively.
+func noNextHop(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("op") == "NextHop" {
+			w.Write([]byte("unsupported\n"))
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// BenchmarkConcurrentLookups runs 200 lookups at once from one node of a 16-node ring
+// whose every RPC takes a millisecond, and reports the most /node requests in flight
+// together and the requests made per lookup, for iterative lookups and for the recursive
+// ones older peers fall back to. An iterative lookup has one request open at a time,
+// while each hop of a recursive one holds its request open until the rest returns.
+func BenchmarkConcurrentLookups(b *testing.B) {
+	for _, recursive := range []bool{false, true} {
+		name := "iterative"
+		if recursive {
+			name = "recursive"
+		}
+		b.Run(name, func(b *testing.B) {
+			counts := inFlight{delay: time.Millisecond}
+			config := quietConfig
+			config.Middleware = []func(http.Handler) http.Handler{counts.middleware}
+			if recursive {
+				config.Middleware = append(config.Middleware, noNextHop)
+			}
+			r := newTestRing(b, 16, config)
+			ctx := context.Background()
+			keys := spread(200)
+			counts.peak.Store(0)
+			counts.total.Store(0)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for _, key := range keys {
+					wg.Add(1)
+					go func(key uint64) {
+						defer wg.Done()
+						if _, err := r.Nodes[0].FindSuccessor(ctx, key+uint64(i)); err != nil {
+							b.Error(err)
+						}
+					}(key)
+				}
+				wg.Wait()
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(counts.peak.Load()), "peak-in-flight")
+			b.ReportMetric(float64(counts.total.Load())/float64(b.N*len(keys)), "requests/lookup")
+		})
+	}
+}
+
+// TestLookupNodeKilledMidLookup crashes a node on a lookup's route just as the lookup is
+// about to be forwarded to it, and checks that the lookup routes around it.
+func TestLookupNodeKilledMidLookup(t *testing.T) {
+	var r *TestRing
+	var mu sync.Mutex
+	var at string
+	var victim = -1
+	config := quietConfig
+	config.Middleware = []func(http.Handler) http.Handler{func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			if req.URL.Query().Get("op") == "NextHop" && req.Host == at && victim >= 0 {
+				// the hop answering now is about to name the victim as the next one.
+				r.Crash(victim)
+				victim = -1
+			}
+			mu.Unlock()
+			h.ServeHTTP(w, req)
+		})
+	}}
+	r = newTestRing(t, 16, config)
+	ctx := context.Background()
+	index := map[uint64]int{}
+	for i, n := range r.Nodes {
+		index[n.ID()] = i
+	}
+	for _, key := range spread(64) {
+		_, route, err := r.Nodes[0].FindSuccessorRoute(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(route.Path) < 3 {
+			continue
+		}
+		killed := index[route.Path[1]]
+		mu.Lock()
+		at, victim = r.Nodes[index[route.Path[0]]].Host(), killed
+		mu.Unlock()
+		s, err := r.Nodes[0].FindSuccessor(ctx, key)
+		if !r.crashed[killed] {
+			t.Fatalf("node %d was not killed", killed)
+		}
+		if err != nil {
+			t.Fatalf("FindSuccessor(%x) with node %d killed mid-lookup: %v", key, killed, err)
+		}
+		if want := r.Nodes[r.owner(key)]; s.ID() != want.ID() {
+			t.Fatalf("FindSuccessor(%x) = %x, want %x", key, s.ID(), want.ID())
+		}
+		return
+	}
+	t.Fatal("no lookup took three hops")
+}
+
+// TestLookupAroundDeadNodes crashes nodes without letting the ring stabilize, so that
+// fingers and successor lists still name them, and checks that lookups for keys owned by
+// live nodes still reach them.
+func TestLookupAroundDeadNodes(t *testing.T) {
+	r := newTestRing(t, 16, quietConfig)
+	r.Crash(5)
+	r.Crash(11)
+	ctx := context.Background()
+	// the predecessor of a dead node still names it as the successor of its keys until
+	// stabilization runs, so only keys that were owned by live nodes are checked.
+	var keys []uint64
+	for _, key := range spread(64) {
+		if !between(r.Nodes[4].ID(), key, r.Nodes[5].ID()) && !between(r.Nodes[10].ID(), key, r.Nodes[11].ID()) {
+			keys = append(keys, key)
+		}
+	}
+	for _, i := range r.Live() {
+		for _, key := range keys {
+			s, err := r.Nodes[i].FindSuccessor(ctx, key)
+			if err != nil {
+				t.Fatalf("FindSuccessor(%x) from node %d: %v", key, i, err)
+			}
+			if want := r.Nodes[r.owner(key)]; s.ID() != want.ID() {
+				t.Errorf("FindSuccessor(%x) from node %d = %x, want %x", key, i, s.ID(), want.ID())
+			}
+		}
+	}
+}
+
+// TestSharedLookupOutlivesCaller cancels the request that started a lookup while a second
+// request is waiting on the same walk, which must still complete for the second.
+func TestSharedLookupOutlivesCaller(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	var armed int32
+	config := quietConfig
+	config.Middleware = []func(http.Handler) http.Handler{func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if atomic.LoadInt32(&armed) == 1 && req.URL.Query().Get("op") == "NextHop" {
+				once.Do(func() {
+					close(entered)
+					<-release
+				})
+			}
+			h.ServeHTTP(w, req)
+		})
+	}}
+	r := newTestRing(t, 8, config)
+	key := r.Nodes[5].ID() - 1
+	atomic.StoreInt32(&armed, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go r.Servers[0].getVersioned(ctx, key)
+	<-entered
+	done := make(chan error)
+	go func() {
+		_, _, err := r.Servers[0].getVersioned(context.Background(), key)
+		done <- err
+	}()
+	// give the second request time to join the walk in flight.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	close(release)
+	if err := <-done; !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get sharing a cancelled lookup = %v, want ErrKeyNotFound", err)
+	}
+}
@@ -0,0 +1,125 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// MemoryNetwork carries HTTP between nodes in one process without TCP, for tests and
+// simulations. Requests are dispatched by host to the handler registered for it and
+// served synchronously, so a ring on a MemoryNetwork behaves as it would over HTTP,
+// including its store transfers, while a removed host fails like a crashed one.
+type MemoryNetwork struct {
+	mu       sync.RWMutex
+	handlers map[string]http.Handler
+}
+
+// NewMemoryNetwork returns an empty network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{handlers: map[string]http.Handler{}}
+}
+
+// Handle serves requests for host, a host:port pair, with handler.
+func (m *MemoryNetwork) Handle(host string, handler http.Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[host] = handler
+}
+
+// Remove takes host off the network, so that requests to it fail.
+func (m *MemoryNetwork) Remove(host string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.handlers, host)
+}
+
+// Client returns a client whose requests are carried by the network.
+func (m *MemoryNetwork) Client() *http.Client {
+	return &http.Client{Timeout: DefaultTimeout, Transport: m}
+}
+
+func (m *MemoryNetwork) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.mu.RLock()
+	handler, ok := m.handlers[req.URL.Host]
+	m.mu.RUnlock()
+	if !ok {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, fmt.Errorf("dial %s: no such host on the memory network", req.URL.Host)
+	}
+	server := cloneRequest(req)
+	server.RequestURI, server.RemoteAddr = req.URL.RequestURI(), "memory"
+	if server.Body == nil {
+		server.Body = http.NoBody
+	}
+	w := &memoryResponse{header: http.Header{}}
+	handler.ServeHTTP(w, server)
+	server.Body.Close()
+	return w.response(req), nil
+}
+
+// memoryResponse buffers a response for MemoryNetwork as a server would send it: the
+// header as it stood when the status was written, and any trailers it declared as they
+// stood when the handler returned.
+type memoryResponse struct {
+	header http.Header
+	sent   http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *memoryResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *memoryResponse) WriteHeader(code int) {
+	if w.status != 0 {
+		return
+	}
+	w.status, w.sent = code, w.header.Clone()
+}
+
+func (w *memoryResponse) Write(b []byte) (int, error) {
+	if w.status == 0 && w.header.Get("Content-Type") == "" {
+		w.header.Set("Content-Type", http.DetectContentType(b))
+	}
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// Flush is a no-op, the response being delivered once the handler returns.
+func (w *memoryResponse) Flush() {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (w *memoryResponse) response(req *http.Request) *http.Response {
+	w.WriteHeader(http.StatusOK)
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.sent,
+		Body:          io.NopCloser(&w.body),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}
+	for _, declared := range w.sent.Values("Trailer") {
+		for _, key := range strings.Split(declared, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+			if value, ok := w.header[key]; ok {
+				if resp.Trailer == nil {
+					resp.Trailer = http.Header{}
+				}
+				resp.Trailer[key] = value
+			}
+		}
+	}
+	return resp
+}
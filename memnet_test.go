@@ -0,0 +1,56 @@
+package chord
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestMemoryNetworkResponse(t *testing.T) {
+	m := NewMemoryNetwork()
+	m.Handle("node:5000", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", ChecksumHeader)
+		w.Header().Set("X-Before", "1")
+		w.WriteHeader(http.StatusAccepted)
+		// set after the header was sent, so only the declared trailer is delivered.
+		w.Header().Set("X-After", "1")
+		io.WriteString(w, "body")
+		w.Header().Set(ChecksumHeader, "sum")
+	}))
+	resp, err := m.Client().Get("http://node:5000/store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusAccepted || string(b) != "body" {
+		t.Errorf("response = %d %q, want 202 \"body\"", resp.StatusCode, b)
+	}
+	if resp.Header.Get("X-Before") != "1" || resp.Header.Get("X-After") != "" {
+		t.Errorf("header = %v, want it as of WriteHeader", resp.Header)
+	}
+	if got := resp.Trailer.Get(ChecksumHeader); got != "sum" {
+		t.Errorf("trailer %s = %q, want \"sum\"", ChecksumHeader, got)
+	}
+	if _, err := m.Client().Get("http://other:5000/store"); err == nil {
+		t.Error("request to a host not on the network succeeded")
+	}
+}
+
+func TestMemoryNetworkImplicitStatus(t *testing.T) {
+	m := NewMemoryNetwork()
+	m.Handle("node:5000", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "<html></html>")
+	}))
+	resp, err := m.Client().Get("http://node:5000/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Errorf("response = %d %q, want 200 with a sniffed content type", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,172 @@
+package chord
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Metrics accumulates counters for a LocalNode. Counters are keyed by peer host rather than
+// by node so they survive the node objects being replaced during stabilization.
+type Metrics struct {
+	sync.Mutex
+	lookups uint64
+	hops    uint64
+	// cacheHits and cacheMisses count FindSuccessor calls answered from and missing the lookup cache.
+	cacheHits   uint64
+	cacheMisses uint64
+	// readHits and readMisses count remote reads answered from and missing the read cache.
+	readHits   uint64
+	readMisses uint64
+	requests   map[string]uint64
+	rpcErrors  map[string]uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{requests: map[string]uint64{}, rpcErrors: map[string]uint64{}}
+}
+
+// observeLookup records a FindSuccessor call that took the given number of hops from this node.
+func (m *Metrics) observeLookup(hops int) {
+	m.Lock()
+	defer m.Unlock()
+	m.lookups++
+	m.hops += uint64(hops)
+}
+
+func (m *Metrics) observeCache(hit bool) {
+	m.Lock()
+	defer m.Unlock()
+	if hit {
+		m.cacheHits++
+	} else {
+		m.cacheMisses++
+	}
+}
+
+func (m *Metrics) observeReadCache(hit bool) {
+	m.Lock()
+	defer m.Unlock()
+	if hit {
+		m.readHits++
+	} else {
+		m.readMisses++
+	}
+}
+
+func (m *Metrics) observeRPC(peer string, err bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.requests[peer]++
+	if err {
+		m.rpcErrors[peer]++
+	}
+}
+
+// Transport wraps next so that every request made through it is counted against its peer.
+func (m *Metrics) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = sharedTransport
+	}
+	return &instrumentedTransport{next: next, metrics: m}
+}
+
+type instrumentedTransport struct {
+	next    http.RoundTripper
+	metrics *Metrics
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	t.metrics.observeRPC(req.URL.Host, err != nil || resp.StatusCode >= 500)
+	return resp, err
+}
+
+// Export writes the counters followed by the live routing state of n and the size of store
+// in the Prometheus text exposition format.
+func (m *Metrics) Export(w io.Writer, n *LocalNode, store Store) {
+	m.Lock()
+	fmt.Fprintf(w, "# HELP chord_find_successor_total Number of FindSuccessor calls handled by this node.\n")
+	fmt.Fprintf(w, "# TYPE chord_find_successor_total counter\n")
+	fmt.Fprintf(w, "chord_find_successor_total %d\n", m.lookups)
+	fmt.Fprintf(w, "# HELP chord_lookup_hops Hops taken from this node to resolve a FindSuccessor call.\n")
+	fmt.Fprintf(w, "# TYPE chord_lookup_hops summary\n")
+	fmt.Fprintf(w, "chord_lookup_hops_sum %d\n", m.hops)
+	fmt.Fprintf(w, "chord_lookup_hops_count %d\n", m.lookups)
+	fmt.Fprintf(w, "# HELP chord_lookup_cache_hits_total Number of FindSuccessor calls answered from the lookup cache.\n")
+	fmt.Fprintf(w, "# TYPE chord_lookup_cache_hits_total counter\n")
+	fmt.Fprintf(w, "chord_lookup_cache_hits_total %d\n", m.cacheHits)
+	fmt.Fprintf(w, "# HELP chord_lookup_cache_misses_total Number of FindSuccessor calls that missed the lookup cache.\n")
+	fmt.Fprintf(w, "# TYPE chord_lookup_cache_misses_total counter\n")
+	fmt.Fprintf(w, "chord_lookup_cache_misses_total %d\n", m.cacheMisses)
+	fmt.Fprintf(w, "# HELP chord_read_cache_hits_total Number of reads of keys owned by other nodes answered from the read cache.\n")
+	fmt.Fprintf(w, "# TYPE chord_read_cache_hits_total counter\n")
+	fmt.Fprintf(w, "chord_read_cache_hits_total %d\n", m.readHits)
+	fmt.Fprintf(w, "# HELP chord_read_cache_misses_total Number of reads of keys owned by other nodes that missed the read cache.\n")
+	fmt.Fprintf(w, "# TYPE chord_read_cache_misses_total counter\n")
+	fmt.Fprintf(w, "chord_read_cache_misses_total %d\n", m.readMisses)
+	writePeerCounter(w, "chord_rpc_requests_total", "Number of RPCs sent to each peer.", m.requests)
+	writePeerCounter(w, "chord_rpc_errors_total", "Number of failed RPCs sent to each peer.", m.rpcErrors)
+	m.Unlock()
+
+	fmt.Fprintf(w, "# HELP chord_store_keys Number of keys held by this node.\n")
+	fmt.Fprintf(w, "# TYPE chord_store_keys gauge\n")
+	fmt.Fprintf(w, "chord_store_keys %d\n", store.Len())
+	fmt.Fprintf(w, "# HELP chord_store_bytes Total size of the values held by this node.\n")
+	fmt.Fprintf(w, "# TYPE chord_store_bytes gauge\n")
+	fmt.Fprintf(w, "chord_store_bytes %d\n", store.Size())
+	if bounded := boundedStore(store); bounded != nil {
+		fmt.Fprintf(w, "# HELP chord_store_evictions_total Number of keys evicted to keep the store within its limits.\n")
+		fmt.Fprintf(w, "# TYPE chord_store_evictions_total counter\n")
+		fmt.Fprintf(w, "chord_store_evictions_total %d\n", bounded.Evictions())
+	}
+	if guard := writeGuard(store); guard != nil {
+		readOnly := 0
+		if guard.ReadOnly() {
+			readOnly = 1
+		}
+		fmt.Fprintf(w, "# HELP chord_store_read_only Whether the store has turned read-only after failed writes.\n")
+		fmt.Fprintf(w, "# TYPE chord_store_read_only gauge\n")
+		fmt.Fprintf(w, "chord_store_read_only %d\n", readOnly)
+	}
+	inconsistent := 0
+	if n.Inconsistent() {
+		inconsistent = 1
+	}
+	fmt.Fprintf(w, "# HELP chord_ring_inconsistent Whether the successor's predecessor has stopped pointing back at this node.\n")
+	fmt.Fprintf(w, "# TYPE chord_ring_inconsistent gauge\n")
+	fmt.Fprintf(w, "chord_ring_inconsistent %d\n", inconsistent)
+	fmt.Fprintf(w, "# HELP chord_predecessor_info The current predecessor of this node.\n")
+	fmt.Fprintf(w, "# TYPE chord_predecessor_info gauge\n")
+	if p := n.currentPredecessor(); p != nil {
+		fmt.Fprintf(w, "chord_predecessor_info{id=\"%x\",host=%q} 1\n", p.ID(), p.Host())
+	}
+	fmt.Fprintf(w, "# HELP chord_successor_info The current successor list of this node.\n")
+	fmt.Fprintf(w, "# TYPE chord_successor_info gauge\n")
+	for i, s := range n.successorList() {
+		fmt.Fprintf(w, "chord_successor_info{index=\"%d\",id=\"%x\",host=%q} 1\n", i, s.ID(), s.Host())
+	}
+	fmt.Fprintf(w, "# HELP chord_finger_info The current finger table of this node.\n")
+	fmt.Fprintf(w, "# TYPE chord_finger_info gauge\n")
+	for i, f := range n.fingerTable() {
+		if f == nil {
+			continue
+		}
+		fmt.Fprintf(w, "chord_finger_info{index=\"%d\",id=\"%x\",host=%q} 1\n", i, f.ID(), f.Host())
+	}
+}
+
+func writePeerCounter(w io.Writer, name, help string, values map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	peers := make([]string, 0, len(values))
+	for peer := range values {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	for _, peer := range peers {
+		fmt.Fprintf(w, "%s{peer=%q} %d\n", name, peer, values[peer])
+	}
+}
@@ -0,0 +1,18 @@
+package chord
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExportEvictionsThroughWrappers(t *testing.T) {
+	r := newTestRing(t, 1, quietConfig)
+	bounded := NewBoundedStore(&MemoryStore{}, 1, 0, nil)
+	for _, store := range []Store{bounded, NewIndexedStore(bounded), &ChecksumStore{NewIndexedStore(bounded)}} {
+		var b strings.Builder
+		r.Nodes[0].metrics.Export(&b, r.Nodes[0], store)
+		if !strings.Contains(b.String(), "chord_store_evictions_total 0\n") {
+			t.Errorf("Export over %T has no evictions counter", store)
+		}
+	}
+}
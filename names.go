@@ -0,0 +1,297 @@
+package chord
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrNoNameIndex is returned when names are written or listed on a node whose store is
+// not an IndexedStore.
+var ErrNoNameIndex = errors.New("store has no name index")
+
+// NamedKey is a key along with the application-level name it was written under.
+type NamedKey struct {
+	Name string `json:"name"`
+	Key  uint64 `json:"key"`
+}
+
+// IndexedStore wraps a Store with a secondary index from the names written with
+// DHTServer.SetNamed to their keys, so that keys can be listed by name prefix. Names are
+// carried along with their values when keys migrate between nodes and dropped when their
+// keys are deleted or constrained away. It must be the outermost wrapper of a node's store
+// for the server to find it.
+//
+// The index costs every node memory for each name it holds, owned or replicated, and a
+// sorted insert, which is linear in the number of names, on every new name. A named write
+// costs a second round of requests to the owner and replicas after the value is written.
+// Since keys are hashes of their names, a prefix says nothing about where its keys live,
+// so every listing is sent to every node in the ring.
+type IndexedStore struct {
+	Store
+
+	mu    sync.RWMutex
+	names map[uint64]string
+	// sorted holds every name in order, for prefix scans.
+	sorted []string
+}
+
+var _ Store = (*IndexedStore)(nil)
+
+// NewIndexedStore wraps store with an empty name index.
+func NewIndexedStore(store Store) *IndexedStore {
+	return &IndexedStore{Store: store, names: map[uint64]string{}}
+}
+
+// SetName records that the key name hashes to was written under name.
+func (s *IndexedStore) SetName(name string) {
+	key := HashKey(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.names[key]; ok {
+		return
+	}
+	s.names[key] = name
+	i := sort.SearchStrings(s.sorted, name)
+	s.sorted = append(s.sorted, "")
+	copy(s.sorted[i+1:], s.sorted[i:])
+	s.sorted[i] = name
+}
+
+// Name returns the name key was written under.
+func (s *IndexedStore) Name(key uint64) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name, ok := s.names[key]
+	return name, ok
+}
+
+// unindex removes one occurrence of name from sorted. The caller holds mu.
+func (s *IndexedStore) unindex(name string) {
+	if i := sort.SearchStrings(s.sorted, name); i < len(s.sorted) && s.sorted[i] == name {
+		s.sorted = append(s.sorted[:i], s.sorted[i+1:]...)
+	}
+}
+
+func (s *IndexedStore) forget(key uint64) {
+	if name, ok := s.names[key]; ok {
+		delete(s.names, key)
+		s.unindex(name)
+	}
+}
+
+// Prefix returns the names starting with prefix whose keys are accepted by filter and
+// still held, in order.
+func (s *IndexedStore) Prefix(prefix string, filter func(uint64) bool) ([]NamedKey, error) {
+	keys, err := s.Store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	held := make(map[uint64]bool, len(keys))
+	for _, key := range keys {
+		held[key] = true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []NamedKey
+	for i := sort.SearchStrings(s.sorted, prefix); i < len(s.sorted) && strings.HasPrefix(s.sorted[i], prefix); i++ {
+		key := HashKey(s.sorted[i])
+		if held[key] && (filter == nil || filter(key)) {
+			out = append(out, NamedKey{Name: s.sorted[i], Key: key})
+		}
+	}
+	return out, nil
+}
+
+func (s *IndexedStore) Delete(key uint64) error {
+	if err := s.Store.Delete(key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forget(key)
+	return nil
+}
+
+func (s *IndexedStore) Constrain(a, b uint64) error {
+	if err := s.Store.Constrain(a, b); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.names {
+		if !between(a, key, b) {
+			s.forget(key)
+		}
+	}
+	return nil
+}
+
+// nameIndex returns the index of store, looking through a vnode's view of a shared store.
+func nameIndex(store Store) *IndexedStore {
+	if v, ok := store.(*vnodeStore); ok {
+		store = v.Store
+	}
+	index, _ := store.(*IndexedStore)
+	return index
+}
+
+// SetNamed writes value under the key name hashes to with HashKey, and records the name so
+// that ListPrefix can find it. The owner's store must be an IndexedStore. KeyHash is not
+// used, since every node's index must derive the same keys from names.
+func (s *DHTServer) SetNamed(name string, value io.Reader) error {
+	key := HashKey(name)
+	if err := s.Set(key, value); err != nil {
+		return err
+	}
+	node, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	if node.ID() == s.node.ID() {
+		return s.setNameLocal(name)
+	}
+	return s.postName(fmt.Sprintf("http://%s/store?op=Name&vnode=%x&name=%s", node.Host(), node.ID(), url.QueryEscape(name)))
+}
+
+// setNameLocal indexes name on this node and on each of its replicas.
+func (s *DHTServer) setNameLocal(name string) error {
+	index := nameIndex(s.store)
+	if index == nil {
+		return ErrNoNameIndex
+	}
+	index.SetName(name)
+	return s.replicate(s.replicas(), func(i int, m Node) error {
+		return s.postName(fmt.Sprintf("http://%s/store?op=Name&replica=true&name=%s", m.Host(), url.QueryEscape(name)))
+	})
+}
+
+func (s *DHTServer) postName(url string) error {
+	resp, err := s.client.Post(url, "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// ListPrefix returns every name in the ring starting with prefix, in order. Each node is
+// asked for the names in its own range, falling back to the replicas after it, so every
+// name is listed once.
+func (s *DHTServer) ListPrefix(ctx context.Context, prefix string) ([]NamedKey, error) {
+	members, err := s.Members(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []NamedKey
+	for i, m := range members {
+		start, end := members[(i+len(members)-1)%len(members)].ID()+1, m.ID()
+		var names []NamedKey
+		for j := 0; j < len(members) && j <= len(s.node.successorList()); j++ {
+			if names, err = s.listNames(ctx, members[(i+j)%len(members)], prefix, start, end); err == nil {
+				break
+			} else if ctx.Err() != nil {
+				return nil, err
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, names...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// listNames returns the names node holds starting with prefix whose keys are in [start, end].
+func (s *DHTServer) listNames(ctx context.Context, node Node, prefix string, start, end uint64) ([]NamedKey, error) {
+	if node.ID() == s.node.ID() {
+		index := nameIndex(s.store)
+		if index == nil {
+			return nil, ErrNoNameIndex
+		}
+		return index.Prefix(prefix, func(key uint64) bool { return between(start-1, key, end) })
+	}
+	query := url.Values{"op": {"Names"}, "prefix": {prefix}, "start": {fmt.Sprintf("%x", start)}, "end": {fmt.Sprintf("%x", end)}}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/store?%s", node.Host(), query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, statusError(resp)
+	}
+	var names []NamedKey
+	if err := json.NewDecoder(resp.Body).Decode(&names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// serveNames answers GET /store?op=Names&prefix=...&start=...&end=... with the names held
+// in [start, end] starting with prefix, as a JSON array.
+func (s *DHTServer) serveNames(w http.ResponseWriter, req *http.Request) {
+	index := nameIndex(s.store)
+	if index == nil {
+		w.WriteHeader(501)
+		return
+	}
+	query := req.URL.Query()
+	start, err := strconv.ParseUint(query.Get("start"), 16, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	end, err := strconv.ParseUint(query.Get("end"), 16, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	names, err := index.Prefix(query.Get("prefix"), func(key uint64) bool { return between(start-1, key, end) })
+	if err != nil {
+		s.node.logger.Error("listing names failed", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	if names == nil {
+		names = []NamedKey{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// serveName answers POST /store?op=Name&name=..., indexing name on this node and, unless
+// replica is set, on its replicas.
+func (s *DHTServer) serveName(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	index := nameIndex(s.store)
+	if index == nil {
+		w.WriteHeader(501)
+		return
+	}
+	if query.Get("replica") != "" {
+		index.SetName(query.Get("name"))
+		w.WriteHeader(200)
+		return
+	}
+	if err := s.setNameLocal(query.Get("name")); err != nil {
+		writeStoreError(w, s.node.logger, err)
+		return
+	}
+	w.WriteHeader(200)
+}
@@ -0,0 +1,143 @@
+package chord
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// nearestTTL is how long GetNearest reuses a measured round-trip time, or the holders of an
+// owner's keys, before asking again.
+const nearestTTL = 5 * time.Second
+
+// nearestCache remembers what GetNearest learns so that repeated reads need not wait on the
+// owner: the round-trip time to each host recently pinged, and the holders of each owner's
+// keys. Unreachable hosts are remembered with the longest possible time, so that they are
+// tried last until they are pinged again.
+type nearestCache struct {
+	sync.Mutex
+	rtts   map[string]rttEntry
+	owners map[uint64]holdersEntry
+}
+
+type rttEntry struct {
+	rtt     time.Duration
+	expires time.Time
+}
+
+type holdersEntry struct {
+	nodes   []Node
+	expires time.Time
+}
+
+// holders returns the holders of owner's keys as s.holders does, reusing a recent answer.
+func (c *nearestCache) holders(ctx context.Context, s *DHTServer, owner Node) ([]Node, error) {
+	c.Lock()
+	e, ok := c.owners[owner.ID()]
+	c.Unlock()
+	if ok && time.Now().Before(e.expires) && e.nodes[0].Host() == owner.Host() {
+		return e.nodes, nil
+	}
+	nodes, err := s.holders(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	if c.owners == nil {
+		c.owners = map[uint64]holdersEntry{}
+	}
+	c.owners[owner.ID()] = holdersEntry{nodes: nodes, expires: time.Now().Add(nearestTTL)}
+	c.Unlock()
+	return nodes, nil
+}
+
+// rank returns nodes ordered from the nearest to the furthest, pinging those without a
+// current measurement in parallel. The local node is always nearest.
+func (c *nearestCache) rank(ctx context.Context, local Node, nodes []Node) []Node {
+	rtts := make([]time.Duration, len(nodes))
+	var wg sync.WaitGroup
+	now := time.Now()
+	c.Lock()
+	if c.rtts == nil {
+		c.rtts = map[string]rttEntry{}
+	}
+	for i, m := range nodes {
+		if m.ID() == local.ID() || m.Host() == local.Host() {
+			continue
+		}
+		if e, ok := c.rtts[m.Host()]; ok && now.Before(e.expires) {
+			rtts[i] = e.rtt
+			continue
+		}
+		wg.Add(1)
+		go func(i int, m Node) {
+			defer wg.Done()
+			start := time.Now()
+			rtt := time.Duration(math.MaxInt64)
+			if m.Ping(ctx) == nil {
+				rtt = time.Since(start)
+			}
+			c.Lock()
+			c.rtts[m.Host()] = rttEntry{rtt: rtt, expires: time.Now().Add(nearestTTL)}
+			c.Unlock()
+			rtts[i] = rtt
+		}(i, m)
+	}
+	c.Unlock()
+	wg.Wait()
+	order := make([]int, len(nodes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return rtts[order[a]] < rtts[order[b]] })
+	ranked := make([]Node, len(nodes))
+	for i, j := range order {
+		ranked[i] = nodes[j]
+	}
+	return ranked
+}
+
+// GetNearest returns the value of key from whichever of its owner and replicas responds
+// fastest, for reads where latency matters more than freshness: a replica may briefly lag
+// the owner after a write. Round-trip times are measured with a ping and, like the list of
+// holders, reused for a few seconds. If the nearest holder fails, or lacks the key while
+// the owner may not, the next nearest is tried. Use GetQuorum when the newest value is
+// needed instead.
+func (s *DHTServer) GetNearest(key uint64) (io.Reader, error) {
+	value, _, err := s.getNearest(context.Background(), key)
+	return value, err
+}
+
+// getNearest is GetNearest that also returns the version read.
+func (s *DHTServer) getNearest(ctx context.Context, key uint64) (io.Reader, Version, error) {
+	owner, err := s.lookupContext(ctx, key)
+	if err != nil {
+		return nil, Version{}, err
+	}
+	nodes, err := s.nearest.holders(ctx, s, owner)
+	if err != nil {
+		// the owner alone is still worth asking.
+		nodes = []Node{owner}
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	var last error
+	for _, m := range s.nearest.rank(pingCtx, s.node, nodes) {
+		value, version, _, err := s.getReplica(ctx, m, key)
+		if err == nil {
+			return value, version, nil
+		}
+		if m.ID() == owner.ID() && errors.Is(err, ErrKeyNotFound) {
+			// the owner is up, so its answer is authoritative.
+			return nil, Version{}, err
+		}
+		if last == nil || !errors.Is(last, ErrKeyNotFound) {
+			last = err
+		}
+	}
+	return nil, Version{}, last
+}
@@ -0,0 +1,87 @@
+package chord
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+)
+
+// candidate returns a node with id on host, reachable over r's network if host is served.
+func candidate(r *TestRing, id uint64, host string) *RemoteNode {
+	return &RemoteNode{id: id, host: host, client: r.Network.Client()}
+}
+
+func TestNotifyNilPredecessor(t *testing.T) {
+	r := newTestRing(t, 4, quietConfig)
+	n := r.Nodes[2]
+	n.mu.Lock()
+	n.predecessor = nil
+	n.mu.Unlock()
+	// anything is accepted, even a node that is not the closest.
+	m := r.Nodes[0]
+	if err := n.Notify(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if p := n.currentPredecessor(); p == nil || p.ID() != m.ID() {
+		t.Fatalf("predecessor = %v, want %x", p, m.ID())
+	}
+}
+
+func TestNotifyLivePredecessor(t *testing.T) {
+	r := newTestRing(t, 4, quietConfig)
+	ctx := context.Background()
+	n, p := r.Nodes[2], r.Nodes[1]
+	// a node behind the live predecessor is refused.
+	behind := candidate(r, p.ID()-1, "behind:5000")
+	if err := n.Notify(ctx, behind); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.currentPredecessor(); got.ID() != p.ID() {
+		t.Fatalf("predecessor = %x after a node behind it notified, want %x", got.ID(), p.ID())
+	}
+	// as is the predecessor's own id, held by the live predecessor.
+	if err := n.Notify(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.currentPredecessor(); got.ID() != p.ID() {
+		t.Fatalf("predecessor = %x after it notified again, want %x", got.ID(), p.ID())
+	}
+	// a node strictly between the predecessor and this node takes over.
+	closer := candidate(r, p.ID()+(n.ID()-p.ID())/2, "closer:5000")
+	if err := n.Notify(ctx, closer); err != nil {
+		t.Fatal(err)
+	}
+	if got := n.currentPredecessor(); got.ID() != closer.ID() {
+		t.Fatalf("predecessor = %x, want %x", got.ID(), closer.ID())
+	}
+	if ps := n.predecessorList(); len(ps) < 2 || ps[1].ID() != p.ID() {
+		t.Errorf("predecessor list does not continue with the replaced predecessor %x", p.ID())
+	}
+}
+
+func TestNotifyDeadPredecessor(t *testing.T) {
+	r := newTestRing(t, 4, quietConfig)
+	n := r.Nodes[2]
+	r.Crash(1)
+	// node 0 is behind the dead predecessor, but the closest live node.
+	m := r.Nodes[0]
+	if err := n.Notify(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if p := n.currentPredecessor(); p.ID() != m.ID() {
+		t.Fatalf("predecessor = %x, want %x", p.ID(), m.ID())
+	}
+}
+
+func TestNotifyDeadPredecessorWhileDraining(t *testing.T) {
+	r := newTestRing(t, 4, quietConfig)
+	n := r.Nodes[2]
+	r.Crash(1)
+	atomic.StoreInt32(&n.drain, draining)
+	if err := n.Notify(context.Background(), r.Nodes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if p := n.currentPredecessor(); p.ID() != r.Nodes[1].ID() {
+		t.Fatalf("draining node took %x as predecessor, want to keep %x", p.ID(), r.Nodes[1].ID())
+	}
+}
@@ -0,0 +1,131 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// quorumRead is one node's answer to GetQuorum.
+type quorumRead struct {
+	node    Node
+	value   []byte
+	version Version
+	ttl     time.Duration
+	err     error
+}
+
+// GetQuorum returns the newest value of key held by ReadQuorum of the nodes storing it,
+// rather than trusting the owner's copy alone. With ReadRepair set, nodes whose copy
+// differs from the winner are brought up to date in the background.
+func (s *DHTServer) GetQuorum(key uint64) (io.Reader, error) {
+	ctx := context.Background()
+	owner, err := s.node.FindSuccessor(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := s.holders(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+	quorum := s.ReadQuorum
+	if quorum <= 0 {
+		quorum = len(nodes)/2 + 1
+	}
+	if quorum > len(nodes) {
+		quorum = len(nodes)
+	}
+	reads := make(chan quorumRead, len(nodes))
+	for _, m := range nodes {
+		go func(m Node) {
+			r := quorumRead{node: m}
+			value, version, ttl, err := s.getReplica(ctx, m, key)
+			if err == nil {
+				r.value, err = io.ReadAll(value)
+				closeReader(value)
+			}
+			r.version, r.ttl, r.err = version, ttl, err
+			reads <- r
+		}(m)
+	}
+	var winner *quorumRead
+	acks := 0
+	var last error
+	for range nodes {
+		r := <-reads
+		if r.err != nil && !errors.Is(r.err, ErrKeyNotFound) {
+			last = r.err
+			continue
+		}
+		acks++
+		if r.err == nil && (winner == nil || winner.version.Less(r.version)) {
+			winner = &r
+		}
+		if acks == quorum {
+			break
+		}
+	}
+	if acks < quorum {
+		return nil, fmt.Errorf("%w: heard from %d of %d required nodes: %v", ErrQuorumNotReached, acks, quorum, last)
+	}
+	if winner == nil {
+		return nil, ErrKeyNotFound
+	}
+	if s.ReadRepair {
+		go s.repair(ctx, key, winner.value, winner.version, winner.ttl, nodes, winner.node)
+	}
+	return bytes.NewReader(winner.value), nil
+}
+
+// holders returns owner followed by the distinct successors replicating its keys. Nodes
+// sharing a host with one already listed are skipped since they share its store. If
+// owner cannot be asked for its successors, they are looked up past it instead, leaving
+// owner listed to fail like any other unreachable holder.
+func (s *DHTServer) holders(ctx context.Context, owner Node) ([]Node, error) {
+	var successors []Node
+	if owner.ID() == s.node.ID() {
+		successors = s.node.successorList()
+	} else {
+		var err error
+		if successors, err = owner.Successors(ctx); err != nil {
+			if successors, err = s.successorsPast(ctx, owner); err != nil {
+				return nil, err
+			}
+		}
+	}
+	hosts := map[string]bool{owner.Host(): true}
+	nodes := []Node{owner}
+	for _, m := range successors {
+		if !hosts[m.Host()] {
+			hosts[m.Host()] = true
+			nodes = append(nodes, m)
+		}
+	}
+	return nodes, nil
+}
+
+// successorsPast returns the nodes following owner as this node sees them: the successor
+// of owner's ID and its own successors, as many as owner would list.
+func (s *DHTServer) successorsPast(ctx context.Context, owner Node) ([]Node, error) {
+	next, err := s.node.FindSuccessor(ctx, owner.ID()+1)
+	if err != nil {
+		return nil, err
+	}
+	if next.ID() == owner.ID() {
+		return nil, nil
+	}
+	var successors []Node
+	if next.ID() == s.node.ID() {
+		successors = s.node.successorList()
+	} else if successors, err = next.Successors(ctx); err != nil {
+		successors = nil
+	}
+	successors = append([]Node{next}, successors...)
+	if r := len(s.node.successorList()); len(successors) > r {
+		successors = successors[:r]
+	}
+	return successors, nil
+}
@@ -0,0 +1,197 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RangeStore is implemented by stores that can read part of a value without reading the
+// rest, such as MemoryStore and DiskStore. Other stores are read whole and sliced.
+type RangeStore interface {
+	// GetRange returns up to length bytes of key's value starting at offset, along with the
+	// length of the whole value. A negative length reads to the end, and a negative offset
+	// reads the last -offset bytes. It returns ErrInvalidRange if the range starts past
+	// the end of the value.
+	GetRange(key uint64, offset, length int64) (io.Reader, int64, error)
+}
+
+// span resolves offset and length against a value of size bytes as GetRange describes,
+// returning where the range starts and how long it is.
+func span(offset, length, size int64) (int64, int64, error) {
+	if offset < 0 {
+		offset = max(size+offset, 0)
+		length = -1
+	}
+	if offset >= size || length == 0 {
+		return 0, 0, fmt.Errorf("%w: %d bytes from %d of %d", ErrInvalidRange, length, offset, size)
+	}
+	if length < 0 || length > size-offset {
+		length = size - offset
+	}
+	return offset, length, nil
+}
+
+// getRange reads part of key's value from store, as RangeStore.GetRange does.
+func getRange(store Store, key uint64, offset, length int64) (io.Reader, int64, error) {
+	if v, ok := store.(*vnodeStore); ok {
+		store = v.Store
+	}
+	if r, ok := store.(RangeStore); ok {
+		return r.GetRange(key, offset, length)
+	}
+	value, err := store.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := io.ReadAll(value)
+	closeReader(value)
+	if err != nil {
+		return nil, 0, err
+	}
+	start, n, err := span(offset, length, int64(len(b)))
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(b[start : start+n]), int64(len(b)), nil
+}
+
+// GetRange reads up to length bytes of key's value starting at offset, transferring only
+// those bytes from the owner. A negative length reads to the end of the value, and a
+// negative offset reads its last -offset bytes. It returns ErrInvalidRange if the value
+// ends before offset. Unlike Get, it does not fall back to the replicas.
+func (s *DHTServer) GetRange(key uint64, offset, length int64) (io.Reader, error) {
+	value, _, err := s.getRange(key, offset, length)
+	return value, err
+}
+
+// getRange is GetRange that also returns the length of the whole value.
+func (s *DHTServer) getRange(key uint64, offset, length int64) (io.Reader, int64, error) {
+	node, err := s.lookup(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if node.ID() == s.node.ID() {
+		return getRange(s.store, key, offset, length)
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("http://%s/store?key=%x&vnode=%x", node.Host(), key, node.ID()), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Range", rangeHeader(offset, length))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		size, err := contentRangeSize(resp.Header.Get("Content-Range"))
+		if err != nil {
+			resp.Body.Close()
+			return nil, 0, err
+		}
+		return verifyResponse(resp), size, nil
+	case http.StatusOK:
+		// the owner ignored the range, so slice the whole value here.
+		defer resp.Body.Close()
+		b, err := io.ReadAll(verifyResponse(resp))
+		if err != nil {
+			return nil, 0, err
+		}
+		start, n, err := span(offset, length, int64(len(b)))
+		if err != nil {
+			return nil, 0, err
+		}
+		return bytes.NewReader(b[start : start+n]), int64(len(b)), nil
+	}
+	resp.Body.Close()
+	return nil, 0, statusError(resp)
+}
+
+// rangeHeader formats offset and length as the value of a Range header.
+func rangeHeader(offset, length int64) string {
+	switch {
+	case offset < 0:
+		return fmt.Sprintf("bytes=%d", offset)
+	case length < 0:
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// parseRange parses a Range header for a single byte range into an offset and length as
+// GetRange takes them. Other ranges, including several at once, are reported as not ok,
+// in which case the whole value is served.
+func parseRange(h string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(h, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		if n == 0 {
+			// an empty suffix can never be satisfied.
+			return 0, 0, true
+		}
+		return -n, -1, true
+	}
+	offset, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, false
+	}
+	if last == "" {
+		return offset, -1, true
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < offset {
+		return 0, 0, false
+	}
+	return offset, end - offset + 1, true
+}
+
+// contentRangeSize returns the length of the whole value from a Content-Range header.
+func contentRangeSize(h string) (int64, error) {
+	_, size, ok := strings.Cut(h, "/")
+	if !ok {
+		return 0, fmt.Errorf("malformed Content-Range %q", h)
+	}
+	return strconv.ParseInt(size, 10, 64)
+}
+
+// serveRange answers GET /store?key=... with a Range header with 206 and the requested
+// bytes, or 416 if the value ends before the range starts.
+func (s *DHTServer) serveRange(w http.ResponseWriter, req *http.Request, key uint64, offset, length int64) {
+	get := s.getRange
+	if req.URL.Query().Get("replica") != "" {
+		get = func(key uint64, offset, length int64) (io.Reader, int64, error) {
+			return getRange(s.store, key, offset, length)
+		}
+	}
+	value, size, err := get(key, offset, length)
+	if err != nil {
+		writeStoreError(w, s.node.logger, err)
+		return
+	}
+	defer closeReader(value)
+	start, n, _ := span(offset, length, size)
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+n-1, size))
+	w.Header().Set("Trailer", ChecksumHeader)
+	w.WriteHeader(http.StatusPartialContent)
+	value = &checksumReader{Reader: value, done: func(sum string) error {
+		w.Header().Set(ChecksumHeader, sum)
+		return nil
+	}}
+	if _, err := io.Copy(w, value); err != nil {
+		s.node.logger.Error("store request failed", "err", err)
+	}
+}
@@ -0,0 +1,131 @@
+package chord
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit allows Rate requests per second on average, with bursts of up to Burst. A zero
+// Rate is unlimited, and a zero Burst allows a burst of one second's worth.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// tokenBucket is a token bucket, refilled at the limit's rate as it is drawn on.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take draws a token from b, reporting whether one was available.
+func (b *tokenBucket) take(limit RateLimit, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = limit.burst()
+	} else {
+		b.tokens = math.Min(limit.burst(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// maxPeerBuckets bounds how many peers are tracked before idle ones are forgotten.
+const maxPeerBuckets = 10000
+
+// rateLimiter holds the buckets a DHTServer draws on for PeerRateLimit and GlobalRateLimit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	global tokenBucket
+	peers  map[string]*tokenBucket
+}
+
+// allow reports whether a request from peer fits within both limits.
+func (r *rateLimiter) allow(peer string, perPeer, global RateLimit) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if perPeer.Rate > 0 {
+		if r.peers == nil {
+			r.peers = map[string]*tokenBucket{}
+		}
+		if len(r.peers) >= maxPeerBuckets {
+			// a bucket that has refilled is indistinguishable from a new one.
+			for p, b := range r.peers {
+				if now.Sub(b.last).Seconds()*perPeer.Rate >= perPeer.burst() {
+					delete(r.peers, p)
+				}
+			}
+		}
+		b, ok := r.peers[peer]
+		if !ok {
+			b = &tokenBucket{}
+			r.peers[peer] = b
+		}
+		if !b.take(perPeer, now) {
+			return false
+		}
+	}
+	return global.Rate <= 0 || r.global.take(global, now)
+}
+
+// rateLimitHandler answers 429 to requests beyond PeerRateLimit or GlobalRateLimit. Ring
+// members are exempt so that stabilization keeps running under load, as are signed
+// requests when the ring has a secret, since only members and trusted clients hold it.
+func (s *DHTServer) rateLimitHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if s.PeerRateLimit.Rate <= 0 && s.GlobalRateLimit.Rate <= 0 {
+			next.ServeHTTP(w, req)
+			return
+		}
+		peer, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			peer = req.RemoteAddr
+		}
+		if s.member(peer) || (s.node.secret != nil && verifyRequest(req, s.node.secret)) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if !s.limiter.allow(peer, s.PeerRateLimit, s.GlobalRateLimit) {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// member reports whether addr is the address of a node in this node's routing state.
+// Members are matched by the host they advertise, so one advertised by name is only
+// recognized if requests from it come from that name.
+func (s *DHTServer) member(addr string) bool {
+	nodes := append(s.node.successorList(), s.node.predecessorList()...)
+	for _, f := range s.node.fingerTable() {
+		if f != nil {
+			nodes = append(nodes, f)
+		}
+	}
+	for _, m := range nodes {
+		if m.ID() == s.node.ID() {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(strings.TrimSuffix(m.Host(), basePath(m.Host()))); err == nil && host == addr {
+			return true
+		}
+	}
+	return false
+}
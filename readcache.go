@@ -0,0 +1,90 @@
+package chord
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DefaultReadCacheTTL is how long a cached remote value is served when DHTServer.ReadCacheTTL
+// is unset.
+const DefaultReadCacheTTL = time.Second
+
+// readCache holds values recently read from other nodes, evicting the least recently used
+// beyond its bounds. It is sized from the server's fields on first use.
+type readCache struct {
+	sync.Mutex
+	order   *list.List
+	entries map[uint64]*list.Element
+	bytes   int64
+}
+
+type readEntry struct {
+	key     uint64
+	value   []byte
+	version Version
+	expires time.Time
+}
+
+// cachedRead returns the cached value of key, if it has not expired.
+func (s *DHTServer) cachedRead(key uint64) ([]byte, Version, bool) {
+	c := &s.reads
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, Version{}, false
+	}
+	entry := e.Value.(*readEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		return nil, Version{}, false
+	}
+	c.order.MoveToFront(e)
+	return entry.value, entry.version, true
+}
+
+// cacheRead caches value as key's, evicting older entries to stay within ReadCacheSize
+// entries and ReadCacheBytes bytes. A value larger than ReadCacheBytes is not cached.
+func (s *DHTServer) cacheRead(key uint64, value []byte, version Version) {
+	if s.ReadCacheBytes > 0 && int64(len(value)) > s.ReadCacheBytes {
+		return
+	}
+	ttl := s.ReadCacheTTL
+	if ttl <= 0 {
+		ttl = DefaultReadCacheTTL
+	}
+	c := &s.reads
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.order, c.entries = list.New(), map[uint64]*list.Element{}
+	}
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.order.PushFront(&readEntry{key: key, value: value, version: version, expires: time.Now().Add(ttl)})
+	c.bytes += int64(len(value))
+	for len(c.entries) > s.ReadCacheSize || (s.ReadCacheBytes > 0 && c.bytes > s.ReadCacheBytes) {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *readCache) remove(e *list.Element) {
+	entry := c.order.Remove(e).(*readEntry)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.value))
+}
+
+// InvalidateCached drops key from the read cache, so that the next Get reads it from its
+// owner. Writes and deletes made through this server invalidate the keys they touch; others
+// are only seen once the cached value expires, unless they are passed here, for instance
+// from a Subscribe on the owners.
+func (s *DHTServer) InvalidateCached(key uint64) {
+	c := &s.reads
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
@@ -0,0 +1,81 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+)
+
+// Rebalance copies this node's value of key to the key's owner and the owner's replicas,
+// then deletes the local copy unless this node is one of them. It repairs keys left on
+// the wrong node, for instance by a routing bug. Copies are written at the local version,
+// so a holder with a newer write keeps it.
+func (s *DHTServer) Rebalance(key uint64) error {
+	ctx := context.Background()
+	owner, err := s.lookupContext(ctx, key)
+	if err != nil {
+		return err
+	}
+	return s.rebalance(ctx, key, owner)
+}
+
+// RebalanceAll rebalances every key stored on this node, returning a BatchError with the
+// keys that could not be.
+func (s *DHTServer) RebalanceAll() error {
+	return s.rebalanceAll(context.Background())
+}
+
+// rebalanceAll is RebalanceAll made with ctx.
+func (s *DHTServer) rebalanceAll(ctx context.Context) error {
+	keys, err := sortedKeys(s.store, nil)
+	if err != nil {
+		return err
+	}
+	owners, err := s.locateAll(ctx, keys)
+	if err != nil {
+		return err
+	}
+	failed := BatchError{}
+	for _, key := range keys {
+		if err := s.rebalance(ctx, key, owners[key]); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			failed[key] = err
+		}
+	}
+	return failed.err()
+}
+
+func (s *DHTServer) rebalance(ctx context.Context, key uint64, owner Node) error {
+	ttl, err := s.store.TTL(key)
+	if err != nil {
+		return err
+	}
+	value, version, err := s.store.GetVersioned(key)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(value)
+	closeReader(value)
+	if err != nil {
+		return err
+	}
+	holders, err := s.holders(ctx, owner)
+	if err != nil {
+		return err
+	}
+	held := false
+	for _, m := range holders {
+		if m.Host() == s.node.Host() {
+			// this node, or a vnode sharing its store, is meant to hold the key.
+			held = true
+			continue
+		}
+		if err := s.setReplica(ctx, m, key, bytes.NewReader(b), version, ttl); err != nil {
+			return err
+		}
+	}
+	if held {
+		return nil
+	}
+	return s.store.Delete(key)
+}
@@ -0,0 +1,51 @@
+package chord
+
+import "sort"
+
+// OnRelease sets fn to be called before this node drops keys it no longer owns or
+// replicates, which happens when its predecessor changes. fn is called once per node that
+// now owns some of the keys, with those keys in ascending order, while they can still be
+// read from the store. The keys are only dropped once fn has returned nil for every owner;
+// on an error they are kept and offered again on the next predecessor change, so fn may
+// see a key more than once. fn runs off the stabilization path and may block.
+func (s *DHTServer) OnRelease(fn func(owner Node, keys []uint64) error) {
+	s.releaseMu.Lock()
+	defer s.releaseMu.Unlock()
+	s.onRelease = fn
+}
+
+// release hands the keys outside (a, b] to the OnRelease handler, grouped by owner.
+func (s *DHTServer) release(a, b uint64) error {
+	s.releaseMu.Lock()
+	fn := s.onRelease
+	s.releaseMu.Unlock()
+	if fn == nil {
+		return nil
+	}
+	keys, err := sortedKeys(s.store, func(key uint64) bool { return !between(a, key, b) })
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	owners, err := s.LocateAll(keys)
+	if err != nil {
+		return err
+	}
+	byOwner := map[uint64][]uint64{}
+	nodes := map[uint64]Node{}
+	for _, key := range keys {
+		owner := owners[key]
+		byOwner[owner.ID()] = append(byOwner[owner.ID()], key)
+		nodes[owner.ID()] = owner
+	}
+	ids := make([]uint64, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if err := fn(nodes[id], byOwner[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
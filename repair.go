@@ -0,0 +1,316 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// digest returns the hex-encoded SHA-256 of everything read from r.
+func digest(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getDigest returns the digest of node's local copy of key without transferring the value.
+func (s *DHTServer) getDigest(ctx context.Context, node Node, key uint64) (string, error) {
+	sum, _, err := s.getVersionedDigest(ctx, node, key)
+	return sum, err
+}
+
+// getVersionedDigest is getDigest that also returns the version of node's copy.
+func (s *DHTServer) getVersionedDigest(ctx context.Context, node Node, key uint64) (string, Version, error) {
+	if node.ID() == s.node.ID() {
+		value, version, err := s.store.GetVersioned(key)
+		if err != nil {
+			return "", Version{}, err
+		}
+		defer closeReader(value)
+		sum, err := digest(value)
+		return sum, version, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/store?key=%x&op=Digest", node.Host(), key), nil)
+	if err != nil {
+		return "", Version{}, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", Version{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", Version{}, statusError(resp)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", Version{}, err
+	}
+	return strings.TrimSpace(string(body)), headerVersion(resp.Header), nil
+}
+
+// repair writes value back at version and with the given lifetime to every node other
+// than source whose copy of key differs. Nodes holding a newer write keep it.
+func (s *DHTServer) repair(ctx context.Context, key uint64, value []byte, version Version, ttl time.Duration, nodes []Node, source Node) {
+	sum, err := digest(bytes.NewReader(value))
+	if err != nil {
+		return
+	}
+	seen := map[uint64]bool{source.ID(): true}
+	for _, m := range nodes {
+		if seen[m.ID()] {
+			continue
+		}
+		seen[m.ID()] = true
+		if d, err := s.getDigest(ctx, m, key); err == nil && d == sum {
+			continue
+		}
+		if err := s.setReplica(ctx, m, key, bytes.NewReader(value), version, ttl); err != nil {
+			s.node.logger.Warn("read repair failed", "key", fmt.Sprintf("%x", key), "peer", m.Host(), "err", err)
+		}
+	}
+}
+
+// treeWidth is the number of buckets the owned keyspace is divided into when comparing
+// replicas, so that only buckets whose digests differ need their keys compared.
+const treeWidth = 64
+
+func bucket(start, end, key uint64) int {
+	width := (end-start)/treeWidth + 1
+	return int((key - start) / width)
+}
+
+// entryDigest summarizes both the value and the version of key in store.
+func entryDigest(store Store, key uint64) (string, error) {
+	value, version, err := store.GetVersioned(key)
+	if err != nil {
+		return "", err
+	}
+	defer closeReader(value)
+	d, err := digest(value)
+	if err != nil {
+		return "", err
+	}
+	return d + " " + version.String(), nil
+}
+
+// bucketDigests returns the entry digest of each key in store that falls in bucket i of [start, end].
+func bucketDigests(store Store, start, end uint64, i int) (map[uint64]string, error) {
+	keys, err := sortedKeys(store, func(key uint64) bool {
+		return between(start-1, key, end) && bucket(start, end, key) == i
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[uint64]string, len(keys))
+	for _, key := range keys {
+		d, err := entryDigest(store, key)
+		if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrCorrupt) {
+			// a damaged value is treated as missing, so that it is restored from a replica.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		out[key] = d
+	}
+	return out, nil
+}
+
+// summarize hashes the keys in store within [start, end] into treeWidth bucket digests,
+// leaving empty buckets blank.
+func summarize(store Store, start, end uint64) ([]string, error) {
+	keys, err := sortedKeys(store, func(key uint64) bool {
+		return between(start-1, key, end)
+	})
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]hash.Hash, treeWidth)
+	for _, key := range keys {
+		d, err := entryDigest(store, key)
+		if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrCorrupt) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		i := bucket(start, end, key)
+		if hashes[i] == nil {
+			hashes[i] = sha256.New()
+		}
+		fmt.Fprintf(hashes[i], "%x:%s\n", key, d)
+	}
+	out := make([]string, treeWidth)
+	for i, h := range hashes {
+		if h != nil {
+			out[i] = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+	return out, nil
+}
+
+// StartAntiEntropy periodically reconciles the keys this node owns with each of its
+// replicas until the node leaves the ring.
+func (s *DHTServer) StartAntiEntropy(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.node.ctx.Done():
+				return
+			case <-ticker.C:
+				s.antiEntropy(s.node.ctx)
+			}
+		}
+	}()
+}
+
+func (s *DHTServer) antiEntropy(ctx context.Context) {
+	predecessor := s.node.currentPredecessor()
+	if predecessor == nil {
+		return
+	}
+	start, end := predecessor.ID()+1, s.node.ID()
+	for _, m := range s.replicas() {
+		if err := s.reconcile(ctx, m, start, end); err != nil {
+			s.node.logger.Warn("anti-entropy failed", "peer", m.Host(), "err", err)
+		}
+	}
+}
+
+// reconcile pushes every key in [start, end] that node is missing or holds a different
+// version of, comparing bucket digests first so that matching buckets cost nothing. The
+// replica keeps whichever version is newer.
+func (s *DHTServer) reconcile(ctx context.Context, node Node, start, end uint64) error {
+	local, err := summarize(s.store, start, end)
+	if err != nil {
+		return err
+	}
+	query := url.Values{"op": {"Tree"}, "start": {fmt.Sprintf("%x", start)}, "end": {fmt.Sprintf("%x", end)}}
+	remote, err := s.fetchLines(ctx, node, query)
+	if err != nil {
+		return err
+	}
+	if len(remote) != treeWidth {
+		return fmt.Errorf("expected %d buckets, got %d", treeWidth, len(remote))
+	}
+	for i := range local {
+		if local[i] == remote[i] || local[i] == "" {
+			continue
+		}
+		ours, err := bucketDigests(s.store, start, end, i)
+		if err != nil {
+			return err
+		}
+		query.Set("op", "Digests")
+		query.Set("bucket", strconv.Itoa(i))
+		lines, err := s.fetchLines(ctx, node, query)
+		if err != nil {
+			return err
+		}
+		theirs := map[uint64]string{}
+		for _, line := range lines {
+			tokens := strings.SplitN(line, " ", 2)
+			if len(tokens) != 2 {
+				continue
+			}
+			if key, err := strconv.ParseUint(tokens[0], 16, 64); err == nil {
+				theirs[key] = tokens[1]
+			}
+		}
+		for key, d := range ours {
+			if theirs[key] == d {
+				continue
+			}
+			ttl, err := s.store.TTL(key)
+			if err != nil {
+				return err
+			}
+			value, version, err := s.store.GetVersioned(key)
+			if errors.Is(err, ErrKeyNotFound) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			err = s.setReplica(ctx, node, key, value, version, ttl)
+			closeReader(value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fetchLines issues a /store GET against node and splits the response into lines.
+func (s *DHTServer) fetchLines(ctx context.Context, node Node, query url.Values) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/store?%s", node.Host(), query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, statusError(resp)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(body), "\n"), nil
+}
+
+// serveTree answers the anti-entropy queries: op=Tree returns the bucket digests of
+// [start, end] and op=Digests returns the key digests within one bucket.
+func (s *DHTServer) serveTree(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	start, err := strconv.ParseUint(query.Get("start"), 16, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	end, err := strconv.ParseUint(query.Get("end"), 16, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	if query.Get("op") == "Tree" {
+		buckets, err := summarize(s.store, start, end)
+		if err != nil {
+			s.node.logger.Error("tree request failed", "err", err)
+			w.WriteHeader(500)
+			return
+		}
+		io.WriteString(w, strings.Join(buckets, "\n"))
+		return
+	}
+	i, err := strconv.Atoi(query.Get("bucket"))
+	if err != nil || i < 0 || i >= treeWidth {
+		w.WriteHeader(400)
+		return
+	}
+	digests, err := bucketDigests(s.store, start, end, i)
+	if err != nil {
+		s.node.logger.Error("tree request failed", "err", err)
+		w.WriteHeader(500)
+		return
+	}
+	for key, d := range digests {
+		fmt.Fprintf(w, "%x %s\n", key, d)
+	}
+}
@@ -0,0 +1,72 @@
+package chord
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Route describes how a lookup was resolved.
+type Route struct {
+	// Hops is the number of nodes the lookup was forwarded to, zero if it was answered by
+	// the node it started at.
+	Hops int
+	// Path lists the ids of the nodes forwarded to, in order, including any found dead.
+	Path []uint64
+	// Cached is set if the answer came from the lookup cache.
+	Cached bool
+}
+
+func (r *Route) hop(m Node) {
+	r.Hops++
+	r.Path = append(r.Path, m.ID())
+}
+
+// recentLookups is the number of lookups a node keeps for Info.
+const recentLookups = 16
+
+// LookupInfo is a lookup made from a node, as listed by Info.
+type LookupInfo struct {
+	ID        string    `json:"id"`
+	Successor *nodeJSON `json:"successor"`
+	Hops      int       `json:"hops"`
+	Path      []string  `json:"path,omitempty"`
+	Cached    bool      `json:"cached,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// recentRoutes is a ring buffer of the last recentLookups lookups.
+type recentRoutes struct {
+	sync.Mutex
+	lookups [recentLookups]LookupInfo
+	next    int
+	n       int
+}
+
+func lookupInfo(id uint64, successor Node, route Route) LookupInfo {
+	info := LookupInfo{ID: fmt.Sprintf("%x", id), Successor: toJSON(successor), Hops: route.Hops, Cached: route.Cached, Time: time.Now().UTC()}
+	for _, m := range route.Path {
+		info.Path = append(info.Path, fmt.Sprintf("%x", m))
+	}
+	return info
+}
+
+func (r *recentRoutes) add(id uint64, successor Node, route Route) {
+	info := lookupInfo(id, successor, route)
+	r.Lock()
+	defer r.Unlock()
+	r.lookups[r.next] = info
+	r.next = (r.next + 1) % recentLookups
+	r.n = min(r.n+1, recentLookups)
+}
+
+// list returns the recorded lookups, most recent first.
+func (r *recentRoutes) list() []LookupInfo {
+	r.Lock()
+	defer r.Unlock()
+	out := make([]LookupInfo, 0, r.n)
+	for i := 1; i <= r.n; i++ {
+		out = append(out, r.lookups[(r.next-i+recentLookups)%recentLookups])
+	}
+	return out
+}
@@ -0,0 +1,100 @@
+package chord
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// selfCalls counts the requests a node sends to its own host.
+type selfCalls struct {
+	next  http.RoundTripper
+	host  string
+	calls int32
+}
+
+func (s *selfCalls) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == s.host {
+		atomic.AddInt32(&s.calls, 1)
+	}
+	return s.next.RoundTrip(req)
+}
+
+// TestSmallRings stabilizes rings of one and two nodes, in which successor lists repeat
+// the nodes over and over, and checks that each node's entries for itself are the
+// LocalNode rather than a RemoteNode that would be called over HTTP.
+func TestSmallRings(t *testing.T) {
+	for _, size := range []int{1, 2} {
+		t.Run(fmt.Sprintf("%d nodes", size), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			network := NewMemoryNetwork()
+			var nodes []*LocalNode
+			var calls []*selfCalls
+			for i := 0; i < size; i++ {
+				host := fmt.Sprintf("node%d:5000", i)
+				self := &selfCalls{next: network, host: host}
+				config := quietConfig
+				config.Client = &http.Client{Transport: self}
+				var seeds []string
+				if i > 0 {
+					seeds = []string{nodes[0].Host()}
+				}
+				n, err := NewLocalNodeWithSeeds(ctx, uint64(i)<<63+1, host, seeds, config)
+				if err != nil {
+					t.Fatal(err)
+				}
+				s, err := NewDHTServer(n, &MemoryStore{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				network.Handle(host, s.HTTPServeMux())
+				nodes, calls = append(nodes, n), append(calls, self)
+			}
+			for round := 0; round < 2*R; round++ {
+				for _, n := range nodes {
+					n.Stabilize(ctx)
+					n.FixAllFingers(ctx)
+				}
+			}
+			for i, n := range nodes {
+				for _, key := range spread(16) {
+					s, err := n.FindSuccessor(ctx, key)
+					if err != nil {
+						t.Fatalf("FindSuccessor(%x) from node %d: %v", key, i, err)
+					}
+					want := nodes[0]
+					for _, m := range nodes {
+						if key <= m.ID() {
+							want = m
+							break
+						}
+					}
+					if s.ID() != want.ID() {
+						t.Errorf("FindSuccessor(%x) from node %d = %x, want %x", key, i, s.ID(), want.ID())
+					}
+				}
+				successors := n.successorList()
+				for j, s := range successors {
+					want := nodes[(i+1+j)%len(nodes)]
+					if s.ID() != want.ID() {
+						t.Errorf("node %d successor %d = %x, want %x", i, j, s.ID(), want.ID())
+					}
+					if s.ID() == n.ID() && s != Node(n) {
+						t.Errorf("node %d successor %d is a %T for itself, want the LocalNode", i, j, s)
+					}
+				}
+				for j, f := range n.fingerTable() {
+					if f != nil && f.ID() == n.ID() && f != Node(n) {
+						t.Errorf("node %d finger %d is a %T for itself, want the LocalNode", i, j, f)
+					}
+				}
+				if c := atomic.LoadInt32(&calls[i].calls); c != 0 {
+					t.Errorf("node %d made %d requests to itself", i, c)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package chord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Snapshot is a LocalNode's routing state, saved with Snapshot and reloaded with Restore so
+// that a restarted node need not rebuild its finger table with a lookup per finger. It is
+// meant to be stored as JSON.
+type Snapshot struct {
+	ID   string `json:"id"`
+	Host string `json:"host"`
+	// Predecessors lists the predecessor and the nodes preceding it, nearest first.
+	Predecessors []nodeJSON `json:"predecessors"`
+	Successors   []nodeJSON `json:"successors"`
+	// Fingers lists the fingers by index, with null for any that point at the node itself.
+	Fingers []*nodeJSON `json:"fingers"`
+}
+
+// NodeID returns the id of the node the snapshot was taken of, which a restarted node must
+// keep for the snapshot to be of use.
+func (s Snapshot) NodeID() (uint64, error) {
+	return strconv.ParseUint(s.ID, 16, 64)
+}
+
+// Snapshot returns the node's current routing state. Entries pointing at the node itself
+// are left out, as they carry nothing a fresh node does not already know.
+func (n *LocalNode) Snapshot() Snapshot {
+	snap := Snapshot{ID: fmt.Sprintf("%x", n.id), Host: n.host, Fingers: make([]*nodeJSON, M)}
+	for _, p := range n.predecessorList() {
+		if p.ID() != n.id {
+			snap.Predecessors = append(snap.Predecessors, *toJSON(p))
+		}
+	}
+	for _, s := range n.successorList() {
+		if s.ID() != n.id {
+			snap.Successors = append(snap.Successors, *toJSON(s))
+		}
+	}
+	for i, f := range n.fingerTable() {
+		if f != nil && f.ID() != n.id {
+			snap.Fingers[i] = toJSON(f)
+		}
+	}
+	return snap
+}
+
+// Restore reloads routing state saved by Snapshot, typically before the node restarted.
+// Every entry is pinged first and those that do not respond are dropped. The node then
+// rejoins through the nearest live successor, which takes a single lookup, or if that
+// fails takes the live successors as saved. It keeps the live fingers and predecessors
+// rather than looking them up again; a dead finger falls back to the one before it, as in
+// FixFingers. Whatever has gone stale without dying is corrected by stabilization as
+// usual. It returns ErrStaleSnapshot if the snapshot is of another node or none of its
+// successors and fingers respond.
+func (n *LocalNode) Restore(ctx context.Context, snap Snapshot) error {
+	if id, err := snap.NodeID(); err != nil || id != n.id {
+		return fmt.Errorf("%w: snapshot of %q, not %x", ErrStaleSnapshot, snap.ID, n.id)
+	}
+	var entries []nodeJSON
+	entries = append(entries, snap.Predecessors...)
+	entries = append(entries, snap.Successors...)
+	live := n.pingEntries(ctx, append(entries, deref(snap.Fingers)...))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var via Node
+	for _, s := range entries[len(snap.Predecessors):] {
+		if m := live[s]; m != nil {
+			via = m
+			break
+		}
+	}
+	if via == nil {
+		return fmt.Errorf("%w: none of its %d nodes respond", ErrStaleSnapshot, len(live))
+	}
+	if err := n.join(ctx, via); errors.Is(err, ErrDuplicateID) || ctx.Err() != nil {
+		return err
+	} else if err != nil {
+		// the ring has yet to notice a node fail, so lookups still lead to it. take the
+		// live successors as they were instead, and let stabilization refill the list.
+		var successors []Node
+		for _, s := range snap.Successors {
+			if m := live[s]; m != nil {
+				successors = append(successors, m)
+			}
+		}
+		if len(successors) == 0 {
+			return err
+		}
+		n.logger.Warn("rejoining failed, restoring the successor list as saved", "err", err)
+		n.mu.Lock()
+		for i := range n.successors {
+			if i < len(successors) {
+				n.successors[i] = successors[i]
+			} else {
+				n.successors[i] = n
+			}
+		}
+		n.mu.Unlock()
+	}
+	var predecessors []Node
+	for _, p := range snap.Predecessors {
+		if m := live[p]; m != nil {
+			predecessors = append(predecessors, m)
+		}
+	}
+	n.mu.Lock()
+	prev := n.successors[0]
+	for i := 0; i < M && i < len(snap.Fingers); i++ {
+		if f := snap.Fingers[i]; f != nil && live[*f] != nil {
+			prev = live[*f]
+		}
+		n.finger[i] = prev
+	}
+	if len(predecessors) > 0 {
+		n.predecessor = predecessors[0]
+		n.predecessors = predecessors[1:min(len(predecessors), len(n.successors))]
+	}
+	n.mu.Unlock()
+	n.cache.clear()
+	if len(predecessors) > 0 {
+		n.emit(Event{Type: PredecessorChanged, Node: predecessors[0]})
+	}
+	n.logger.Info("restored routing state", "live", countLive(live), "entries", len(live), "via", via.Host())
+	return nil
+}
+
+// pingEntries pings each distinct node in entries, fingerConcurrency at a time, mapping
+// each to the node if it responded or nil if not.
+func (n *LocalNode) pingEntries(ctx context.Context, entries []nodeJSON) map[nodeJSON]Node {
+	live := make(map[nodeJSON]Node, len(entries))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, fingerConcurrency)
+	for _, e := range entries {
+		mu.Lock()
+		_, seen := live[e]
+		if !seen {
+			live[e] = nil
+		}
+		mu.Unlock()
+		if seen {
+			continue
+		}
+		m := &RemoteNode{client: n.client}
+		if err := m.Deserialize(e.ID + ":" + e.Host); err != nil || m.id == n.id {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(e nodeJSON) {
+			defer func() { <-sem; wg.Done() }()
+			if m.Ping(ctx) == nil {
+				mu.Lock()
+				live[e] = m
+				mu.Unlock()
+			}
+		}(e)
+	}
+	wg.Wait()
+	return live
+}
+
+// deref returns the entries of nodes that are set.
+func deref(nodes []*nodeJSON) []nodeJSON {
+	var out []nodeJSON
+	for _, m := range nodes {
+		if m != nil {
+			out = append(out, *m)
+		}
+	}
+	return out
+}
+
+func countLive(live map[nodeJSON]Node) int {
+	count := 0
+	for _, m := range live {
+		if m != nil {
+			count++
+		}
+	}
+	return count
+}
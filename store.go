@@ -2,51 +2,292 @@ package chord
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"sync"
+	"time"
 )
 
+// Store holds the values for the keys a node owns or replicates. Get may return an
+// io.ReadCloser for stores that stream from disk, in which case the caller closes it.
+// Expired keys behave as if they had been deleted. Get and GetVersioned return
+// ErrKeyNotFound for keys that are absent.
 type Store interface {
 	Set(key uint64, value io.Reader) error
 	Get(key uint64) (io.Reader, error)
+	// SetVersioned writes value unless the store already holds a newer version of key, so
+	// that replicas converge on the latest write regardless of the order they receive them.
+	SetVersioned(key uint64, value io.Reader, version Version) error
+	// GetVersioned is Get that also returns the version the value was written at.
+	GetVersioned(key uint64) (io.Reader, Version, error)
+	// SetWithTTL is Set for a value that expires after ttl.
+	SetWithTTL(key uint64, value io.Reader, ttl time.Duration) error
+	// SetVersionedWithTTL is SetVersioned for a value that expires after ttl, or never if
+	// ttl is zero. Replication and migration use it to carry both.
+	SetVersionedWithTTL(key uint64, value io.Reader, version Version, ttl time.Duration) error
+	// TTL returns the remaining lifetime of key, or zero if it never expires.
+	TTL(key uint64) (time.Duration, error)
+	// CompareAndSwap atomically writes new at version if key holds old, or is absent if old
+	// is nil, and no newer version has been written, reporting whether it did.
+	CompareAndSwap(key uint64, old, new []byte, version Version) (bool, error)
+	Delete(key uint64) error
+	Keys() ([]uint64, error)
+	// All copies out every value, so it is only suited to small stores and debugging.
 	All() map[uint64][]byte
+	// Len returns the number of keys held, and Size their total value bytes, without
+	// reading the values.
+	Len() int
+	Size() int64
+	// Constrain deletes every key outside (a, b] as defined by between, keeping b but not
+	// a, wrapping around zero when a > b and keeping everything when a == b.
 	Constrain(a, b uint64) error
 }
 
-type MemoryStore map[uint64][]byte
+// TTLHeader carries a value's remaining lifetime on /store requests and responses.
+const TTLHeader = "X-Chord-TTL"
 
-func (s MemoryStore) Set(key uint64, value io.Reader) error {
+// expiry returns the deadline for a value written now with the given ttl.
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+// remaining returns the lifetime left before deadline, rounding an expired value up to
+// a nanosecond so that it is never mistaken for one that does not expire.
+func remaining(deadline time.Time) time.Duration {
+	if deadline.IsZero() {
+		return 0
+	}
+	if ttl := time.Until(deadline); ttl > 0 {
+		return ttl
+	}
+	return time.Nanosecond
+}
+
+// MemoryStore keeps every value in memory. Set writes unconditionally at the zero version.
+type MemoryStore struct {
+	mu       sync.Mutex
+	values   map[uint64][]byte
+	versions map[uint64]Version
+	expires  map[uint64]time.Time
+	// size is the total length of values.
+	size int64
+	// Logger receives a debug record for each key removed by Constrain. Nothing is logged if nil.
+	Logger *slog.Logger
+}
+
+var (
+	_ Store      = (*MemoryStore)(nil)
+	_ RangeStore = (*MemoryStore)(nil)
+)
+
+func (s *MemoryStore) Set(key uint64, value io.Reader) error {
+	return s.set(key, value, Version{}, 0, true)
+}
+
+func (s *MemoryStore) Get(key uint64) (io.Reader, error) {
+	value, _, err := s.GetVersioned(key)
+	return value, err
+}
+
+func (s *MemoryStore) SetVersioned(key uint64, value io.Reader, version Version) error {
+	return s.set(key, value, version, 0, false)
+}
+
+func (s *MemoryStore) SetWithTTL(key uint64, value io.Reader, ttl time.Duration) error {
+	return s.set(key, value, Version{}, ttl, true)
+}
+
+func (s *MemoryStore) SetVersionedWithTTL(key uint64, value io.Reader, version Version, ttl time.Duration) error {
+	return s.set(key, value, version, ttl, false)
+}
+
+func (s *MemoryStore) set(key uint64, value io.Reader, version Version, ttl time.Duration, force bool) error {
 	b, err := io.ReadAll(value)
 	if err != nil {
 		return err
 	}
-	s[key] = b;
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values, s.versions, s.expires = map[uint64][]byte{}, map[uint64]Version{}, map[uint64]time.Time{}
+	}
+	if !force && !s.expire(key, time.Now()) && version.Less(s.versions[key]) {
+		return nil
+	}
+	s.size += int64(len(b) - len(s.values[key]))
+	s.values[key], s.versions[key] = b, version
+	if ttl > 0 {
+		s.expires[key] = expiry(ttl)
+	} else {
+		delete(s.expires, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) CompareAndSwap(key uint64, old, new []byte, version Version) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values, s.versions, s.expires = map[uint64][]byte{}, map[uint64]Version{}, map[uint64]time.Time{}
+	}
+	s.expire(key, time.Now())
+	current, ok := s.values[key]
+	if ok != (old != nil) || !bytes.Equal(current, old) || version.Less(s.versions[key]) {
+		return false, nil
+	}
+	s.size += int64(len(new) - len(current))
+	s.values[key], s.versions[key] = append([]byte{}, new...), version
+	delete(s.expires, key)
+	return true, nil
+}
+
+func (s *MemoryStore) GetVersioned(key uint64) (io.Reader, Version, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(key, time.Now())
+	value, ok := s.values[key]
+	if !ok {
+		return nil, Version{}, ErrKeyNotFound
+	}
+	return bytes.NewReader(value), s.versions[key], nil
+}
+
+func (s *MemoryStore) GetRange(key uint64, offset, length int64) (io.Reader, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(key, time.Now())
+	value, ok := s.values[key]
+	if !ok {
+		return nil, 0, ErrKeyNotFound
+	}
+	start, n, err := span(offset, length, int64(len(value)))
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewReader(value[start : start+n]), int64(len(value)), nil
+}
+
+func (s *MemoryStore) TTL(key uint64) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expire(key, time.Now()) {
+		return 0, nil
+	}
+	return remaining(s.expires[key]), nil
+}
+
+// expire deletes key if it has expired by now, reporting whether it did. The caller holds mu.
+func (s *MemoryStore) expire(key uint64, now time.Time) bool {
+	deadline, ok := s.expires[key]
+	if !ok || now.Before(deadline) {
+		return false
+	}
+	s.drop(key)
+	return true
+}
+
+// drop deletes key. The caller holds mu.
+func (s *MemoryStore) drop(key uint64) {
+	s.size -= int64(len(s.values[key]))
+	delete(s.values, key)
+	delete(s.versions, key)
+	delete(s.expires, key)
+}
+
+// purge deletes every expired key. The caller holds mu.
+func (s *MemoryStore) purge() {
+	now := time.Now()
+	for key := range s.expires {
+		s.expire(key, now)
+	}
+}
+
+// Sweep purges expired keys every interval until ctx is cancelled, so that keys which are
+// never read again do not linger.
+func (s *MemoryStore) Sweep(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			s.purge()
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *MemoryStore) Delete(key uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drop(key)
 	return nil
 }
 
-func (s MemoryStore) Get(key uint64) (io.Reader, error) {
-	return bytes.NewReader(s[key]), nil
+func (s *MemoryStore) Keys() ([]uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge()
+	keys := make([]uint64, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	return keys, nil
 }
 
-func (s MemoryStore) All() map[uint64][]byte {
-	return s
+func (s *MemoryStore) All() map[uint64][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge()
+	out := make(map[uint64][]byte, len(s.values))
+	for k, v := range s.values {
+		out[k] = v
+	}
+	return out
+}
+
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge()
+	return len(s.values)
 }
 
-func (s MemoryStore) Constrain(a, b uint64) error {
-	for k := range s {
+func (s *MemoryStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge()
+	return s.size
+}
+
+func (s *MemoryStore) Constrain(a, b uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purge()
+	for k := range s.values {
 		if !between(a, k, b) {
-			log.Printf("deleting %x", k)
-			delete(s, k)
+			if s.Logger != nil {
+				s.Logger.Debug("deleting key", "key", fmt.Sprintf("%x", k))
+			}
+			s.drop(k)
 		}
 	}
 	return nil
 }
 
-func (s MemoryStore) String() string {
+func (s *MemoryStore) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	out := ""
-	for k, v := range s {
+	for k, v := range s.values {
 		out += fmt.Sprintf("%x: %v\n", k, v)
 	}
 	return out
-}
\ No newline at end of file
+}
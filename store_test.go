@@ -0,0 +1,129 @@
+package chord
+
+import (
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConstrain(t *testing.T) {
+	const last = math.MaxUint64
+	tests := []struct {
+		name string
+		a, b uint64
+		keys []uint64
+		want []uint64
+	}{
+		{
+			name: "interval",
+			a:    100, b: 200,
+			keys: []uint64{0, 99, 100, 101, 150, 199, 200, 201, last},
+			want: []uint64{101, 150, 199, 200},
+		},
+		{
+			name: "wrap-around",
+			a:    last - 100, b: 100,
+			keys: []uint64{0, 1, 99, 100, 101, 5000, last - 101, last - 100, last - 99, last},
+			want: []uint64{0, 1, 99, 100, last - 99, last},
+		},
+		{
+			name: "wrap-around from the last id",
+			a:    last, b: 100,
+			keys: []uint64{0, 100, 101, last - 1, last},
+			want: []uint64{0, 100},
+		},
+		{
+			name: "wrap-around to zero",
+			a:    last - 100, b: 0,
+			keys: []uint64{0, 1, last - 100, last - 99, last},
+			want: []uint64{0, last - 99, last},
+		},
+		{
+			name: "single key",
+			a:    100, b: 101,
+			keys: []uint64{100, 101, 102},
+			want: []uint64{101},
+		},
+		{
+			name: "full circle",
+			a:    100, b: 100,
+			keys: []uint64{0, 99, 100, 101, last},
+			want: []uint64{0, 99, 100, 101, last},
+		},
+	}
+	stores := map[string]func(t *testing.T) Store{
+		"MemoryStore": func(t *testing.T) Store { return &MemoryStore{} },
+		"DiskStore": func(t *testing.T) Store {
+			s, err := NewDiskStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+		"BoundedStore": func(t *testing.T) Store { return NewBoundedStore(&MemoryStore{}, 100, 0, NewLRU()) },
+		"IndexedStore": func(t *testing.T) Store { return NewIndexedStore(&MemoryStore{}) },
+	}
+	for name, newStore := range stores {
+		for _, tt := range tests {
+			s := newStore(t)
+			for _, key := range tt.keys {
+				if err := s.Set(key, strings.NewReader("v")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Constrain(tt.a, tt.b); err != nil {
+				t.Fatalf("%s %s: %v", name, tt.name, err)
+			}
+			keys, err := s.Keys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+			if !equalKeys(keys, tt.want) {
+				t.Errorf("%s %s: Constrain(%x, %x) kept %x, want %x", name, tt.name, tt.a, tt.b, keys, tt.want)
+			}
+		}
+	}
+}
+
+func TestDiskStoreExpireKeepsNewValue(t *testing.T) {
+	s, err := NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetWithTTL(1, strings.NewReader("old"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// a fresh value lands after a read or sweep found the old one expired, but before it
+	// got to deleting it.
+	if err := s.SetVersioned(1, strings.NewReader("new"), Version{Timestamp: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.expire(1); err != nil {
+		t.Fatal(err)
+	}
+	value, err := s.Get(1)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer closeReader(value)
+	if b, _ := io.ReadAll(value); string(b) != "new" {
+		t.Errorf("Get = %q, want %q", b, "new")
+	}
+}
+
+func equalKeys(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package chord
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// checkSuccessors fails t unless node i's successor list holds the live nodes following
+// it in ring order, wrapping around to repeat them if there are too few to fill it.
+func checkSuccessors(t *testing.T, r *TestRing, i int) {
+	t.Helper()
+	live := r.Live()
+	at := -1
+	for j, k := range live {
+		if k == i {
+			at = j
+		}
+	}
+	for j, s := range r.Nodes[i].successorList() {
+		want := r.Nodes[live[(at+1+j)%len(live)]]
+		if s == nil || s.ID() != want.ID() {
+			t.Errorf("node %d successor %d = %v, want %x", i, j, s, want.ID())
+		}
+	}
+}
+
+// settle stabilizes r until each node's pointers are right, then enough rounds more for
+// the successor lists, which are refilled from the successor and so propagate back one
+// node a round, to catch up.
+func settle(t *testing.T, r *TestRing) {
+	t.Helper()
+	ctx := context.Background()
+	if err := r.Stabilize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < R; round++ {
+		for _, i := range r.Live() {
+			r.Nodes[i].Stabilize(ctx)
+		}
+	}
+}
+
+func TestRepeatedSuccessorDeaths(t *testing.T) {
+	r := newTestRing(t, 12, quietConfig)
+	dead := map[string]bool{}
+	// kill more successors of node 0 than its list holds, one at a time.
+	for k := 1; k <= 2*R; k++ {
+		r.Crash(k)
+		dead[r.Nodes[k].Host()] = true
+		// a single round on node 0 replaces the dead successor and refills the list from
+		// the next one, rather than shifting it up and leaving stale or self entries.
+		r.Nodes[0].Stabilize(context.Background())
+		seen := map[uint64]bool{}
+		for j, s := range r.Nodes[0].successorList() {
+			if dead[s.Host()] || (len(r.Live()) > R && (s.ID() == r.Nodes[0].ID() || seen[s.ID()])) {
+				t.Errorf("after killing node %d, node 0 successor %d is %s", k, j, s.Host())
+			}
+			seen[s.ID()] = true
+		}
+		settle(t, r)
+		for _, i := range r.Live() {
+			checkSuccessors(t, r, i)
+		}
+	}
+}
+
+func TestSuccessorDeathsAtOnce(t *testing.T) {
+	r := newTestRing(t, 12, quietConfig)
+	// every successor of node 0 but the last dies before it notices.
+	for k := 1; k < R; k++ {
+		r.Crash(k)
+	}
+	settle(t, r)
+	for _, i := range r.Live() {
+		checkSuccessors(t, r, i)
+	}
+}
+
+// TestPartialSuccessorList has a successor answer with fewer successors than the list
+// holds, and checks that the rest is padded with the successor itself.
+func TestPartialSuccessorList(t *testing.T) {
+	var r *TestRing
+	var mu sync.Mutex
+	var short *string
+	config := quietConfig
+	config.Middleware = []func(http.Handler) http.Handler{func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			body := short
+			mu.Unlock()
+			if body != nil && req.Host == r.Nodes[2].Host() && req.URL.Query().Get("op") == "Successors" {
+				w.Write([]byte(*body))
+				return
+			}
+			h.ServeHTTP(w, req)
+		})
+	}}
+	r = newTestRing(t, 8, config)
+	for _, answer := range [][]int{{3}, {3, 4}, {}} {
+		body := ""
+		for j, k := range answer {
+			if j > 0 {
+				body += "\n"
+			}
+			body += r.Nodes[k].Serialize()
+		}
+		mu.Lock()
+		short = &body
+		mu.Unlock()
+		if err := r.Nodes[1].Stabilize(context.Background()); err != nil {
+			t.Fatalf("Stabilize with %d successors from node 2: %v", len(answer), err)
+		}
+		want := append([]int{2}, answer...)
+		for len(want) < R {
+			want = append(want, 2)
+		}
+		for j, s := range r.Nodes[1].successorList() {
+			if s.ID() != r.Nodes[want[j]].ID() {
+				t.Errorf("with %d successors from node 2, node 1 successor %d = %x, want node %d", len(answer), j, s.ID(), want[j])
+			}
+		}
+	}
+	mu.Lock()
+	short = nil
+	mu.Unlock()
+	settle(t, r)
+	for _, i := range r.Live() {
+		checkSuccessors(t, r, i)
+	}
+}
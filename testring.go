@@ -0,0 +1,120 @@
+package chord
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// TestRing is a ring of nodes in one process, each with a DHTServer over a MemoryStore,
+// connected by a MemoryNetwork. It is meant for tests of routing, churn and migration.
+type TestRing struct {
+	Network *MemoryNetwork
+	Nodes   []*LocalNode
+	Servers []*DHTServer
+	Stores  []*MemoryStore
+
+	cancel  context.CancelFunc
+	crashed map[int]bool
+}
+
+// NewTestRing starts n nodes with evenly spaced ids, named node0:5000 and up, and
+// stabilizes them with Stabilize before returning.
+func NewTestRing(n int) (*TestRing, error) {
+	return NewTestRingWithConfig(n, Config{})
+}
+
+// NewTestRingWithConfig is NewTestRing with every node created from config. Its Client is
+// replaced with one on the ring's network.
+func NewTestRingWithConfig(n int, config Config) (*TestRing, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("%w: ring of %d nodes", ErrInvalidConfig, n)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &TestRing{Network: NewMemoryNetwork(), cancel: cancel, crashed: map[int]bool{}}
+	config.Client = r.Network.Client()
+	spacing := math.MaxUint64 / uint64(n)
+	for i := 0; i < n; i++ {
+		host := fmt.Sprintf("node%d:5000", i)
+		var seeds []string
+		if i > 0 {
+			seeds = []string{r.Nodes[0].Host()}
+		}
+		node, err := NewLocalNodeWithSeeds(ctx, uint64(i)*spacing+spacing/2, host, seeds, config)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		store := &MemoryStore{}
+		server, err := NewDHTServer(node, store)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.Network.Handle(host, server.HTTPServeMux())
+		r.Nodes, r.Servers, r.Stores = append(r.Nodes, node), append(r.Servers, server), append(r.Stores, store)
+		if err := r.Stabilize(ctx); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Crash takes node i off the network and stops its stabilization, without it handing
+// anything over to its neighbours.
+func (r *TestRing) Crash(i int) {
+	r.Network.Remove(r.Nodes[i].Host())
+	r.Nodes[i].cancel()
+	r.crashed[i] = true
+}
+
+// Live returns the indexes of the nodes that have not crashed, in ring order.
+func (r *TestRing) Live() []int {
+	var live []int
+	for i := range r.Nodes {
+		if !r.crashed[i] {
+			live = append(live, i)
+		}
+	}
+	sort.Slice(live, func(a, b int) bool { return r.Nodes[live[a]].ID() < r.Nodes[live[b]].ID() })
+	return live
+}
+
+// Stabilize runs stabilization and finger repair on every live node, round after round,
+// until each points at its true successor and predecessor, failing if that takes more
+// rounds than there are nodes, plus a few to spare.
+func (r *TestRing) Stabilize(ctx context.Context) error {
+	live := r.Live()
+	for round := 0; round < 2*len(live)+4; round++ {
+		for _, i := range live {
+			r.Nodes[i].Stabilize(ctx)
+		}
+		if r.stable(live) {
+			for _, i := range live {
+				r.Nodes[i].FixAllFingers(ctx)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("ring of %d nodes did not stabilize", len(live))
+}
+
+// stable reports whether every live node's successor and predecessor are its neighbours.
+func (r *TestRing) stable(live []int) bool {
+	for j, i := range live {
+		successor := r.Nodes[live[(j+1)%len(live)]]
+		predecessor := r.Nodes[live[(j+len(live)-1)%len(live)]]
+		p := r.Nodes[i].currentPredecessor()
+		if r.Nodes[i].successor().ID() != successor.ID() || p == nil || p.ID() != predecessor.ID() {
+			return false
+		}
+	}
+	return true
+}
+
+// Close stops every node.
+func (r *TestRing) Close() {
+	r.cancel()
+}
@@ -0,0 +1,80 @@
+package chord
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// quietConfig leaves stabilization to the test, so that the background loops do not
+// repair what a test breaks on purpose.
+var quietConfig = Config{StabilizeInterval: time.Hour, FixFingersInterval: time.Hour}
+
+// newTestRing starts a ring of n nodes from config, closed when the test ends.
+func newTestRing(t testing.TB, n int, config Config) *TestRing {
+	t.Helper()
+	r, err := NewTestRingWithConfig(n, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return r
+}
+
+// owner returns the index of the live node that owns key: the first at or after it.
+func (r *TestRing) owner(key uint64) int {
+	live := r.Live()
+	for _, i := range live {
+		if key <= r.Nodes[i].ID() {
+			return i
+		}
+	}
+	return live[0]
+}
+
+// checkLookups fails t unless node i finds the owner of each of keys.
+func checkLookups(t *testing.T, r *TestRing, i int, keys []uint64) {
+	t.Helper()
+	for _, key := range keys {
+		s, err := r.Nodes[i].FindSuccessor(context.Background(), key)
+		if err != nil {
+			t.Fatalf("FindSuccessor(%x) from node %d: %v", key, i, err)
+		}
+		if want := r.Nodes[r.owner(key)]; s.ID() != want.ID() {
+			t.Errorf("FindSuccessor(%x) from node %d = %x, want %x", key, i, s.ID(), want.ID())
+		}
+	}
+}
+
+// spread returns n keys spaced evenly around the ring, offset so that none is a node id.
+func spread(n int) []uint64 {
+	keys := make([]uint64, n)
+	for i := range keys {
+		keys[i] = uint64(i)*(^uint64(0)/uint64(n)) + 12345
+	}
+	return keys
+}
+
+// serveNode starts a node with a DHTServer over a MemoryStore, serving HTTP on l, and
+// stops both when the test ends.
+func serveNode(t testing.TB, l net.Listener, id uint64, seeds []string, config Config) *LocalNode {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	n, err := NewLocalNodeWithSeeds(ctx, id, l.Addr().String(), seeds, config)
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	s, err := NewDHTServer(n, &MemoryStore{})
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: s.HTTPServeMux()}
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return n
+}
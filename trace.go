@@ -0,0 +1,122 @@
+package chord
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Tracer starts the spans a node records, so that a lookup can be followed as a single
+// trace across the nodes it hops through. It is shaped to be implemented over an
+// OpenTelemetry TracerProvider and propagator, with Inject and Extract carrying span
+// contexts in W3C traceparent and tracestate headers, without this module depending on
+// OpenTelemetry. Nodes record nothing unless Config.Tracer is set.
+type Tracer interface {
+	// Start begins a span named name, a child of the span carried by ctx if any, and
+	// returns ctx carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+	// Inject writes the span context carried by ctx to the headers of an outgoing request.
+	Inject(ctx context.Context, h http.Header)
+	// Extract returns ctx carrying the span context from the headers of an incoming
+	// request, if any, for Start to continue.
+	Extract(ctx context.Context, h http.Header) context.Context
+}
+
+// Span is a unit of work started by a Tracer.
+type Span interface {
+	// SetAttribute annotates the span, such as with the peer or key involved.
+	SetAttribute(key, value string)
+	// End finishes the span, recording err if the work failed.
+	End(err error)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+func (noopTracer) Inject(ctx context.Context, h http.Header) {}
+
+func (noopTracer) Extract(ctx context.Context, h http.Header) context.Context {
+	return ctx
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key, value string) {}
+
+func (noopSpan) End(err error) {}
+
+// rpcName names the RPC req makes, such as node.FindSuccessor, or store.GET for a store
+// request without an op.
+func rpcName(req *http.Request) string {
+	op := req.URL.Query().Get("op")
+	if strings.HasSuffix(req.URL.Path, "/node") {
+		return "node." + op
+	}
+	if op == "" {
+		op = req.Method
+	}
+	return "store." + op
+}
+
+// tracingTransport starts a client span for each request made through it and injects its
+// span context into the request, so that the peer's span continues the same trace.
+type tracingTransport struct {
+	next   http.RoundTripper
+	tracer Tracer
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := t.tracer.Start(req.Context(), "chord.call "+rpcName(req))
+	span.SetAttribute("peer", req.URL.Host)
+	req = cloneRequest(req).WithContext(ctx)
+	t.tracer.Inject(ctx, req.Header)
+	resp, err := t.next.RoundTrip(req)
+	if err == nil && resp.StatusCode >= 500 {
+		span.End(fmt.Errorf("%w: %s", ErrUnexpectedStatus, resp.Status))
+	} else {
+		span.End(err)
+	}
+	return resp, err
+}
+
+// traceHandler starts a server span for each request h serves, continuing the caller's
+// trace, and serves it with the span in its context so that the RPCs h makes in turn are
+// part of the same trace.
+func (n *LocalNode) traceHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := n.tracer.Extract(req.Context(), req.Header)
+		ctx, span := n.tracer.Start(ctx, "chord.serve "+rpcName(req))
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, req.WithContext(ctx))
+		if sw.status >= 500 {
+			span.End(fmt.Errorf("%w: %d %s", ErrUnexpectedStatus, sw.status, http.StatusText(sw.status)))
+		} else {
+			span.End(nil)
+		}
+	})
+}
+
+// statusWriter records the status a handler responded with.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
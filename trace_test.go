@@ -0,0 +1,127 @@
+package chord
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type traceKey struct{}
+
+// recordingTracer records the trace and name of each span, propagating only the trace.
+type recordingTracer struct {
+	mu     sync.Mutex
+	next   int
+	spans  []recordedSpan
+	record bool
+}
+
+type recordedSpan struct {
+	trace int
+	name  string
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	trace, ok := ctx.Value(traceKey{}).(int)
+	if !ok {
+		t.next++
+		trace = t.next
+	}
+	if t.record {
+		t.spans = append(t.spans, recordedSpan{trace, name})
+	}
+	return context.WithValue(ctx, traceKey{}, trace), noopSpan{}
+}
+
+func (t *recordingTracer) Inject(ctx context.Context, h http.Header) {
+	if trace, ok := ctx.Value(traceKey{}).(int); ok {
+		h.Set("X-Trace", fmt.Sprint(trace))
+	}
+}
+
+func (t *recordingTracer) Extract(ctx context.Context, h http.Header) context.Context {
+	var trace int
+	if _, err := fmt.Sscan(h.Get("X-Trace"), &trace); err == nil {
+		return context.WithValue(ctx, traceKey{}, trace)
+	}
+	return ctx
+}
+
+// trace runs fn with spans recorded, returning them.
+func (t *recordingTracer) trace(fn func()) []recordedSpan {
+	t.mu.Lock()
+	t.spans, t.record = nil, true
+	t.mu.Unlock()
+	fn()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record = false
+	return t.spans
+}
+
+// TestTraceCoversRPCs checks that every RPC made for a store request, however the request
+// is served, belongs to the trace of the request.
+func TestTraceCoversRPCs(t *testing.T) {
+	tracer := &recordingTracer{}
+	config := quietConfig
+	config.Tracer = tracer
+	r := newTestRing(t, 8, config)
+	// node 2 must not hold the key, so that ReadNearest reads it from another node.
+	settle(t, r)
+	key := r.Nodes[5].ID() - 1
+	if err := r.Servers[0].Set(key, strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		fn   func(ctx context.Context) error
+	}{
+		{"Get", func(ctx context.Context) error {
+			_, _, err := r.Servers[1].getVersioned(ctx, key)
+			return err
+		}},
+		{"Get with ReadNearest", func(ctx context.Context) error {
+			r.Servers[2].ReadNearest = true
+			defer func() { r.Servers[2].ReadNearest = false }()
+			_, _, err := r.Servers[2].getVersioned(ctx, key)
+			return err
+		}},
+		{"Set", func(ctx context.Context) error {
+			return r.Servers[3].set(ctx, key, strings.NewReader("new"), Version{}, 0)
+		}},
+		{"CompareAndSwap", func(ctx context.Context) error {
+			_, err := r.Servers[4].compareAndSwap(ctx, key, []byte("new"), []byte("newer"))
+			return err
+		}},
+		{"Rebalance", func(ctx context.Context) error {
+			return r.Servers[5].rebalanceAll(ctx)
+		}},
+	}
+	for _, tt := range tests {
+		var root int
+		spans := tracer.trace(func() {
+			ctx, _ := tracer.Start(context.Background(), "test")
+			root = ctx.Value(traceKey{}).(int)
+			if err := tt.fn(ctx); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		})
+		calls := 0
+		for _, s := range spans {
+			if s.trace != root {
+				t.Errorf("%s: span %s is in trace %d, want %d", tt.name, s.name, s.trace, root)
+			}
+			if strings.HasPrefix(s.name, "chord.call") {
+				calls++
+			}
+		}
+		if calls == 0 {
+			t.Errorf("%s made no RPCs", tt.name)
+		}
+	}
+}
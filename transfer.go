@@ -0,0 +1,306 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBatchSize is the number of records sent per request when migrating keys.
+const DefaultBatchSize = 1000
+
+// migrateAttempts is how many times a single batch is tried before a migration gives up.
+const migrateAttempts = 3
+
+// TransferCodec selects how records are encoded in bulk store transfers, the migrations
+// sent when nodes join and leave and the listings read from GET /store.
+type TransferCodec int
+
+const (
+	// TransferJSON encodes records as newline-delimited JSON, which base64-encodes values.
+	TransferJSON TransferCodec = iota
+	// TransferGob encodes records with encoding/gob, which sends values as raw bytes.
+	// Listings are only served in it to nodes that ask for it, but migrations are sent
+	// unasked, and nodes that predate it only decode JSON, so it must not be enabled until
+	// the whole ring has been upgraded.
+	TransferGob
+)
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+	gobContentType    = "application/x-gob"
+	// acceptTransfers is the Accept header of requests for listings, any codec of which
+	// can be read.
+	acceptTransfers = gobContentType + ", " + ndjsonContentType
+)
+
+// contentType returns the Content-Type of a transfer encoded with c.
+func (c TransferCodec) contentType() string {
+	if c == TransferGob {
+		return gobContentType
+	}
+	return ndjsonContentType
+}
+
+// acceptCodec returns the codec to answer a listing with: c, if the request's Accept header
+// shows the client can decode it, and TransferJSON otherwise.
+func acceptCodec(req *http.Request, c TransferCodec) TransferCodec {
+	if c == TransferGob && strings.Contains(req.Header.Get("Accept"), gobContentType) {
+		return TransferGob
+	}
+	return TransferJSON
+}
+
+// recordEncoder and recordDecoder are satisfied by both the JSON and gob codecs.
+type recordEncoder interface {
+	Encode(v any) error
+}
+
+type recordDecoder interface {
+	Decode(v any) error
+}
+
+// newRecordDecoder returns a decoder for records sent with the given Content-Type.
+func newRecordDecoder(r io.Reader, contentType string) recordDecoder {
+	if contentType == gobContentType {
+		return gob.NewDecoder(r)
+	}
+	return json.NewDecoder(r)
+}
+
+// record is a single key/value pair in a bulk store transfer. Transfers are encoded as a
+// stream of records so that neither side holds more than one value at a time.
+type record struct {
+	Key     uint64  `json:"key"`
+	Value   []byte  `json:"value"`
+	Version Version `json:"version"`
+	// TTL is the lifetime remaining when the record was sent, so that clock skew between
+	// nodes does not shorten or extend it.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// Name is the name the key was written under, if the sender indexes names.
+	Name string `json:"name,omitempty"`
+	// Checksum is the hex CRC-32C of Value, checked by receivers when present.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// sortedKeys returns the keys in store accepted by filter in ascending order.
+func sortedKeys(store Store, filter func(uint64) bool) ([]uint64, error) {
+	keys, err := store.Keys()
+	if err != nil {
+		return nil, err
+	}
+	selected := keys[:0]
+	for _, key := range keys {
+		if filter == nil || filter(key) {
+			selected = append(selected, key)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i] < selected[j] })
+	return selected, nil
+}
+
+// writeRecords streams the given keys from store to w, encoded with codec, stopping after
+// limit records unless limit is negative. Keys that cannot be sent are skipped without
+// counting towards limit, so that a batch is only short if keys ran out.
+func writeRecords(w io.Writer, codec TransferCodec, store Store, keys []uint64, limit int) error {
+	var enc recordEncoder = json.NewEncoder(w)
+	if codec == TransferGob {
+		enc = gob.NewEncoder(w)
+	}
+	index := nameIndex(store)
+	for _, key := range keys {
+		if limit == 0 {
+			return nil
+		}
+		value, version, err := store.GetVersioned(key)
+		if errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrCorrupt) {
+			// expired since it was listed, or damaged and left for the replicas to restore.
+			continue
+		} else if err != nil {
+			return err
+		}
+		b, err := io.ReadAll(value)
+		closeReader(value)
+		if err != nil {
+			return err
+		}
+		ttl, err := store.TTL(key)
+		if err != nil {
+			return err
+		}
+		rec := record{Key: key, Value: b, Version: version, TTL: ttl, Checksum: checksum(b)}
+		if index != nil {
+			rec.Name, _ = index.Name(key)
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+		limit--
+	}
+	return nil
+}
+
+// readRecords writes every record read from r into store, returning how many were read
+// and the last key written. The codec is chosen by contentType, the Content-Type r was sent
+// with. Records older than the value already held are skipped.
+func readRecords(r io.Reader, contentType string, store Store) (int, uint64, error) {
+	dec := newRecordDecoder(r, contentType)
+	index := nameIndex(store)
+	n, last := 0, uint64(0)
+	for {
+		var rec record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return n, last, nil
+		} else if err != nil {
+			return n, last, err
+		}
+		if err := rec.verify(); err != nil {
+			return n, last, err
+		}
+		if err := store.SetVersionedWithTTL(rec.Key, bytes.NewReader(rec.Value), rec.Version, rec.TTL); err != nil {
+			return n, last, err
+		}
+		if index != nil && rec.Name != "" && HashKey(rec.Name) == rec.Key {
+			index.SetName(rec.Name)
+		}
+		n, last = n+1, rec.Key
+	}
+}
+
+// pushRecords sends keys from store to host in batches of batchSize, encoded with codec,
+// retrying each batch so that a transient failure does not restart the migration. It
+// returns the number of keys delivered, all of which precede any that were not.
+func pushRecords(ctx context.Context, logger *slog.Logger, client *http.Client, host string, store Store, keys []uint64, batchSize int, codec TransferCodec) (int, error) {
+	sent := 0
+	for sent < len(keys) {
+		end := sent + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		var err error
+		for attempt := 0; attempt < migrateAttempts; attempt++ {
+			if err = pushBatch(ctx, client, host, store, keys[sent:end], codec); err == nil || ctx.Err() != nil {
+				break
+			}
+		}
+		if err != nil {
+			return sent, err
+		}
+		sent = end
+		logger.Info("migrated keys", "sent", sent, "total", len(keys), "peer", host)
+	}
+	return sent, nil
+}
+
+func pushBatch(ctx context.Context, client *http.Client, host string, store Store, keys []uint64, codec TransferCodec) error {
+	body, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeRecords(w, codec, store, keys, -1))
+	}()
+	defer body.Close()
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("http://%s/store", host), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", codec.contentType())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return statusError(resp)
+	}
+	return nil
+}
+
+// pullRecords copies every record held by host into store in batches of batchSize,
+// resuming after the last key received if a batch fails part way through. Batches are
+// read in whichever codec host answers with. Hosts fill each batch past keys they skip,
+// such as ones that expired or are damaged, so a short batch is the last.
+func pullRecords(ctx context.Context, logger *slog.Logger, client *http.Client, host string, store Store, batchSize int) error {
+	query := url.Values{"limit": {strconv.Itoa(batchSize)}}
+	total, attempt := 0, 0
+	for {
+		n, last, err := pullBatch(ctx, client, host, store, query)
+		total += n
+		if n > 0 {
+			query.Set("after", fmt.Sprintf("%x", last))
+			attempt = 0
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			attempt++
+			if attempt == migrateAttempts {
+				return err
+			}
+			continue
+		}
+		if n < batchSize {
+			return nil
+		}
+		logger.Info("migrated keys", "received", total, "peer", host)
+	}
+}
+
+func pullBatch(ctx context.Context, client *http.Client, host string, store Store, query url.Values) (int, uint64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s/store?%s", host, query.Encode()), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Accept", acceptTransfers)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return 0, 0, statusError(resp)
+	}
+	return readRecords(resp.Body, resp.Header.Get("Content-Type"), store)
+}
+
+// closeReader closes r if the store or transport handed back something closeable.
+func closeReader(r io.Reader) {
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// fanout copies each write to every pipe that is still accepting data, dropping any that
+// fail so that one dead replica does not abort the write to the others.
+type fanout []*io.PipeWriter
+
+func (f fanout) Write(p []byte) (int, error) {
+	for i, w := range f {
+		if w == nil {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			f[i] = nil
+		}
+	}
+	return len(p), nil
+}
+
+// CloseWithError closes every remaining pipe, propagating err to the readers.
+func (f fanout) CloseWithError(err error) {
+	for _, w := range f {
+		if w != nil {
+			w.CloseWithError(err)
+		}
+	}
+}
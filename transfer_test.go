@@ -0,0 +1,183 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// binaryStore returns a store of n random values of size bytes, and its sorted keys.
+func binaryStore(t testing.TB, n, size int) (*MemoryStore, []uint64) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	store := &MemoryStore{}
+	for i := 0; i < n; i++ {
+		value := make([]byte, size)
+		rng.Read(value)
+		if err := store.Set(rng.Uint64(), bytes.NewReader(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := sortedKeys(store, func(uint64) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, keys
+}
+
+func TestTransferCodecs(t *testing.T) {
+	store, keys := binaryStore(t, 100, 1024)
+	sizes := map[TransferCodec]int{}
+	for _, codec := range []TransferCodec{TransferJSON, TransferGob} {
+		var b bytes.Buffer
+		if err := writeRecords(&b, codec, store, keys, -1); err != nil {
+			t.Fatal(err)
+		}
+		sizes[codec] = b.Len()
+		got := &MemoryStore{}
+		if n, _, err := readRecords(&b, codec.contentType(), got); err != nil || n != len(keys) {
+			t.Fatalf("readRecords(%s) = %d, %v, want %d records", codec.contentType(), n, err, len(keys))
+		}
+		all := got.All()
+		for key, value := range store.All() {
+			if !bytes.Equal(all[key], value) {
+				t.Errorf("%s: key %x did not survive the transfer", codec.contentType(), key)
+			}
+		}
+	}
+	// gob sends values as they are, rather than base64-encoded.
+	if sizes[TransferGob] >= sizes[TransferJSON]*4/5 {
+		t.Errorf("gob transfer is %d bytes, json %d", sizes[TransferGob], sizes[TransferJSON])
+	}
+}
+
+// BenchmarkTransferSize encodes and decodes a migration of 1000 random 1 KiB values in
+// each codec, reporting the bytes sent per transfer and per value byte.
+func BenchmarkTransferSize(b *testing.B) {
+	store, keys := binaryStore(b, 1000, 1024)
+	for _, codec := range []TransferCodec{TransferJSON, TransferGob} {
+		name := "json"
+		if codec == TransferGob {
+			name = "gob"
+		}
+		b.Run(name, func(b *testing.B) {
+			var buf bytes.Buffer
+			b.SetBytes(int64(len(keys) * 1024))
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := writeRecords(&buf, codec, store, keys, -1); err != nil {
+					b.Fatal(err)
+				}
+				if _, _, err := readRecords(bytes.NewReader(buf.Bytes()), codec.contentType(), &MemoryStore{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(buf.Len()), "bytes/transfer")
+			b.ReportMetric(float64(buf.Len())/float64(len(keys)*1024), "bytes/value-byte")
+		})
+	}
+}
+
+// servePeer serves store from a node alone on a network, returning the network's client
+// and the node's host.
+func servePeer(t *testing.T, store Store) (*http.Client, string) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	network := NewMemoryNetwork()
+	config := quietConfig
+	config.Client = network.Client()
+	n, err := NewLocalNodeWithSeeds(ctx, 1, "peer:5000", nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewDHTServer(n, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.Handle(n.Host(), s.HTTPServeMux())
+	return network.Client(), n.Host()
+}
+
+// TestPullPastCorruptKey pulls several batches from a peer with a damaged value in the
+// first, which is left behind without cutting the pull short.
+func TestPullPastCorruptKey(t *testing.T) {
+	inner := &MemoryStore{}
+	peer := &ChecksumStore{Store: inner}
+	const n = 2*DefaultBatchSize + 10
+	for key := uint64(0); key < n; key++ {
+		if err := peer.Set(key, strings.NewReader(fmt.Sprint(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const corrupt = 10
+	if err := inner.Set(corrupt, strings.NewReader("damaged")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Get(corrupt); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("Get of the damaged key = %v, want ErrCorrupt", err)
+	}
+	client, host := servePeer(t, peer)
+	got := &MemoryStore{}
+	if err := pullRecords(context.Background(), slog.Default(), client, host, got, DefaultBatchSize); err != nil {
+		t.Fatal(err)
+	}
+	all := got.All()
+	if len(all) != n-1 {
+		t.Errorf("pulled %d keys, want %d", len(all), n-1)
+	}
+	for key := uint64(0); key < n; key++ {
+		if _, ok := all[key]; ok == (key == corrupt) {
+			t.Errorf("key %d pulled: %v", key, ok)
+		}
+	}
+}
+
+// slowKeys pauses after listing its keys, as a store with many of them would.
+type slowKeys struct {
+	Store
+	delay time.Duration
+}
+
+func (s *slowKeys) Keys() ([]uint64, error) {
+	keys, err := s.Store.Keys()
+	time.Sleep(s.delay)
+	return keys, err
+}
+
+// TestPullPastExpiredKey pulls several batches from a peer with a key in the first that
+// expires after it is listed and before it is sent.
+func TestPullPastExpiredKey(t *testing.T) {
+	inner := &MemoryStore{}
+	const n = 2*DefaultBatchSize + 10
+	for key := uint64(0); key < n; key++ {
+		if err := inner.Set(key, strings.NewReader(fmt.Sprint(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const expiring = 10
+	client, host := servePeer(t, &slowKeys{Store: inner, delay: 100 * time.Millisecond})
+	if err := inner.SetWithTTL(expiring, strings.NewReader("brief"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	got := &MemoryStore{}
+	if err := pullRecords(context.Background(), slog.Default(), client, host, got, DefaultBatchSize); err != nil {
+		t.Fatal(err)
+	}
+	all := got.All()
+	if len(all) != n-1 {
+		t.Errorf("pulled %d keys, want %d", len(all), n-1)
+	}
+	for key := uint64(0); key < n; key++ {
+		if _, ok := all[key]; ok == (key == expiring) {
+			t.Errorf("key %d pulled: %v", key, ok)
+		}
+	}
+}
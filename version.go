@@ -0,0 +1,62 @@
+package chord
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VersionHeader carries a value's version on /store requests and responses.
+const VersionHeader = "X-Chord-Version"
+
+// Version orders the writes to a key so that replicas agree on which one wins. Timestamps
+// come from the clock of the owner that accepted the write and the owner's id breaks ties.
+// The zero Version precedes every write.
+type Version struct {
+	Timestamp int64  `json:"timestamp"`
+	Node      uint64 `json:"node"`
+}
+
+// Less reports whether v was written before w.
+func (v Version) Less(w Version) bool {
+	if v.Timestamp != w.Timestamp {
+		return v.Timestamp < w.Timestamp
+	}
+	return v.Node < w.Node
+}
+
+func (v Version) IsZero() bool {
+	return v == Version{}
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%x.%x", v.Timestamp, v.Node)
+}
+
+// ParseVersion parses the form produced by Version.String.
+func ParseVersion(s string) (Version, error) {
+	tokens := strings.SplitN(s, ".", 2)
+	if len(tokens) != 2 {
+		return Version{}, fmt.Errorf("invalid version %q", s)
+	}
+	ts, err := strconv.ParseInt(tokens[0], 16, 64)
+	if err != nil {
+		return Version{}, err
+	}
+	node, err := strconv.ParseUint(tokens[1], 16, 64)
+	if err != nil {
+		return Version{}, err
+	}
+	return Version{Timestamp: ts, Node: node}, nil
+}
+
+// nextVersion returns a version for a new write by node that supersedes prev even if the
+// clock has gone backwards since prev was assigned.
+func nextVersion(node uint64, prev Version) Version {
+	ts := time.Now().UnixNano()
+	if ts <= prev.Timestamp {
+		ts = prev.Timestamp + 1
+	}
+	return Version{Timestamp: ts, Node: node}
+}
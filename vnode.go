@@ -0,0 +1,228 @@
+package chord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// VirtualHost runs several vnodes, each with its own id and place in the ring, behind one
+// HTTP server and one store. Spreading a host over many ids evens out how much of the
+// keyspace each host owns.
+type VirtualHost struct {
+	nodes   []*LocalNode
+	servers []*DHTServer
+	store   Store
+
+	// mu guards ranges, the range each vnode last constrained the store to.
+	mu     sync.Mutex
+	ranges []*[2]uint64
+}
+
+// NewWeightedVirtualHost starts vnodes times config.Weight vnodes with random ids, rounded
+// and at least one. Each vnode owns 1/N of the keyspace on average for a ring of N vnodes,
+// so a host's expected share of the keys, and of the load, is its weight over the total
+// weight of the ring. The share varies around that by roughly 1/sqrt(vnodes * weight)
+// relative to itself, so more vnodes per unit of weight track the weights more closely at
+// the cost of more stabilization traffic.
+func NewWeightedVirtualHost(ctx context.Context, host string, vnodes int, seeds []string, store Store, config Config) (*VirtualHost, error) {
+	if config.Weight == 0 {
+		config.Weight = 1
+	} else if config.Weight < 0 {
+		return nil, fmt.Errorf("%w: weight %v", ErrInvalidConfig, config.Weight)
+	}
+	if vnodes < 1 {
+		return nil, fmt.Errorf("%w: %d vnodes per weight", ErrInvalidConfig, vnodes)
+	}
+	ids := make([]uint64, max(1, int(math.Round(float64(vnodes)*config.Weight))))
+	if config.HostIDs {
+		canonical, err := canonicalHost(host)
+		if err != nil {
+			return nil, err
+		}
+		for i := range ids {
+			ids[i] = HashKey(fmt.Sprintf("%s#%d", canonical, i))
+		}
+		return NewVirtualHost(ctx, host, ids, seeds, store, config)
+	}
+	for attempt := 1; ; attempt++ {
+		for i := range ids {
+			ids[i] = rand.Uint64()
+		}
+		h, err := NewVirtualHost(ctx, host, ids, seeds, store, config)
+		if !errors.Is(err, ErrDuplicateID) || attempt == joinIDAttempts {
+			return h, err
+		}
+	}
+}
+
+// NewVirtualHost starts a vnode for each of ids on host. The first joins the ring through
+// seeds, or starts a new one if there are none, and the rest join through it.
+func NewVirtualHost(ctx context.Context, host string, ids []uint64, seeds []string, store Store, config Config) (*VirtualHost, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no vnode ids")
+	}
+	seen := map[uint64]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			return nil, fmt.Errorf("%w: vnode id %x given twice", ErrDuplicateID, id)
+		}
+		seen[id] = true
+	}
+	h := &VirtualHost{store: store, ranges: make([]*[2]uint64, len(ids))}
+	for i, id := range ids {
+		var node *LocalNode
+		var err error
+		if i == 0 {
+			node, err = NewLocalNodeWithSeeds(ctx, id, host, seeds, config)
+		} else {
+			node, err = NewLocalNodeWithConfig(ctx, id, host, h.nodes[0], config)
+		}
+		if err != nil {
+			h.Leave(ctx)
+			return nil, err
+		}
+		server, err := NewDHTServer(node, &vnodeStore{Store: store, host: h, index: i})
+		if err != nil {
+			node.Leave(ctx)
+			h.Leave(ctx)
+			return nil, err
+		}
+		h.nodes = append(h.nodes, node)
+		h.servers = append(h.servers, server)
+	}
+	siblings := make(map[uint64]*LocalNode, len(h.nodes))
+	for _, n := range h.nodes {
+		siblings[n.ID()] = n
+	}
+	for _, n := range h.nodes {
+		n.mu.Lock()
+		n.siblings = siblings
+		n.mu.Unlock()
+	}
+	return h, nil
+}
+
+// Servers returns the DHTServer of each vnode so that they can be tuned individually.
+func (h *VirtualHost) Servers() []*DHTServer {
+	return h.servers
+}
+
+// HTTPServeMux serves every vnode. Node RPCs, and store requests forwarded to a key's owner,
+// are dispatched by their vnode parameter. Other store requests go to the vnode that owns
+// the key, so a request for a key owned by a sibling vnode is handled without another lookup.
+func (h *VirtualHost) HTTPServeMux() *http.ServeMux {
+	muxes := make([]*http.ServeMux, len(h.servers))
+	for i, s := range h.servers {
+		muxes[i] = s.HTTPServeMux()
+	}
+	mux := http.NewServeMux()
+	// the host is only ready once all of its vnodes are.
+	mux.Handle(basePath(h.nodes[0].host)+"/readyz", readyzHandler(h.nodes...))
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		muxes[h.route(req)].ServeHTTP(w, req)
+	}))
+	return mux
+}
+
+// AdminServeMux serves the admin RPCs of the vnode named by the vnode parameter, or of
+// the first vnode without one.
+func (h *VirtualHost) AdminServeMux() *http.ServeMux {
+	muxes := make([]*http.ServeMux, len(h.servers))
+	for i, s := range h.servers {
+		muxes[i] = s.AdminServeMux()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		muxes[h.route(req)].ServeHTTP(w, req)
+	}))
+	return mux
+}
+
+func (h *VirtualHost) route(req *http.Request) int {
+	query := req.URL.Query()
+	if id, err := strconv.ParseUint(query.Get("vnode"), 16, 64); err == nil {
+		for i, n := range h.nodes {
+			if n.ID() == id {
+				return i
+			}
+		}
+	}
+	if key, err := strconv.ParseUint(query.Get("key"), 16, 64); err == nil {
+		for i, n := range h.nodes {
+			if p := n.currentPredecessor(); p != nil && between(p.ID(), key, n.ID()) {
+				return i
+			}
+		}
+	}
+	return 0
+}
+
+// Leave removes every vnode from the ring, handing their keys to their successors.
+func (h *VirtualHost) Leave(ctx context.Context) error {
+	var first error
+	for _, s := range h.servers {
+		if err := s.Leave(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (h *VirtualHost) String() string {
+	var b strings.Builder
+	for _, n := range h.nodes {
+		fmt.Fprintf(&b, "--- vnode %x ---\n%v\n", n.ID(), n)
+	}
+	fmt.Fprintf(&b, "--- store ---\n%v", h.store)
+	return b.String()
+}
+
+// constrain records that vnode i now holds (a, b] and deletes the keys that no vnode holds.
+// Nothing is deleted until every vnode has reported its range.
+func (h *VirtualHost) constrain(i int, a, b uint64) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ranges[i] = &[2]uint64{a, b}
+	for _, r := range h.ranges {
+		if r == nil {
+			return nil
+		}
+	}
+	keys, err := h.store.Keys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		held := false
+		for _, r := range h.ranges {
+			if between(r[0], key, r[1]) {
+				held = true
+				break
+			}
+		}
+		if !held {
+			if err := h.store.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// vnodeStore is a vnode's view of the store it shares with its siblings.
+type vnodeStore struct {
+	Store
+	host  *VirtualHost
+	index int
+}
+
+func (s *vnodeStore) Constrain(a, b uint64) error {
+	return s.host.constrain(s.index, a, b)
+}
@@ -0,0 +1,45 @@
+package chord
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestVirtualHostRoutesAtOnce starts a virtual host whose vnodes stabilize and repair
+// their fingers every millisecond, so that they route through each other while the host
+// is still telling them about their siblings, for go test -race to check the two do not
+// race.
+func TestVirtualHostRoutesAtOnce(t *testing.T) {
+	r := newTestRing(t, 4, quietConfig)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := Config{Client: r.Network.Client(), StabilizeInterval: time.Millisecond, FixFingersInterval: time.Millisecond, Jitter: -1}
+	ids := make([]uint64, 8)
+	for i := range ids {
+		ids[i] = uint64(i)<<61 + 1<<60
+	}
+	h, err := NewVirtualHost(ctx, "vhost:5000", ids, []string{r.Nodes[0].Host()}, &MemoryStore{}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the vnodes route among themselves before this goroutine does anything more that
+	// would order their reads after the host's writes.
+	time.Sleep(20 * time.Millisecond)
+	r.Network.Handle("vhost:5000", h.HTTPServeMux())
+	for i, n := range h.nodes {
+		next := h.nodes[(i+1)%len(ids)]
+		if s := n.sibling(&RemoteNode{id: next.ID(), host: n.Host()}); s != Node(next) {
+			t.Errorf("vnode %x does not know its sibling %x", n.ID(), next.ID())
+		}
+	}
+	for _, key := range spread(64) {
+		s, err := h.nodes[0].FindSuccessor(ctx, key)
+		if err != nil {
+			t.Fatalf("FindSuccessor(%x): %v", key, err)
+		}
+		if s.Host() == "vhost:5000" && s != Node(h.nodes[0]) && s != h.nodes[0].sibling(s) {
+			t.Errorf("FindSuccessor(%x) = %x, not resolved to the sibling", key, s.ID())
+		}
+	}
+}
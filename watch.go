@@ -0,0 +1,150 @@
+package chord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ChangeType identifies the write a Change reports.
+type ChangeType int
+
+const (
+	// KeySet is published when a key is written.
+	KeySet ChangeType = iota
+	// KeyDeleted is published when a key is deleted.
+	KeyDeleted
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case KeySet:
+		return "Set"
+	case KeyDeleted:
+		return "Delete"
+	}
+	return "ChangeType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// Change reports a write to a key owned by the node that published it. Values are not
+// included, so subscribers read the ones they want.
+type Change struct {
+	Type ChangeType
+	Key  uint64
+	// Version is the version written, for KeySet.
+	Version Version
+}
+
+// watchBuffer is how many changes a subscriber may fall behind before it is dropped.
+const watchBuffer = 256
+
+type watcher struct {
+	start, end uint64
+	c          chan Change
+}
+
+// Subscribe returns a channel of the changes this node makes as the owner of keys in the
+// inclusive interval [start, end], which wraps around zero when start > end. Writes that
+// only replicate or migrate keys are not reported, so subscribing to every member whose
+// range overlaps the interval reports each write once. The channel is closed when ctx is
+// done, or early if the subscriber falls more than watchBuffer changes behind, since
+// stalling writes for a slow subscriber would stall the ring.
+func (s *DHTServer) Subscribe(ctx context.Context, start, end uint64) <-chan Change {
+	w := &watcher{start: start, end: end, c: make(chan Change, watchBuffer)}
+	s.watchMu.Lock()
+	if s.watchers == nil {
+		s.watchers = map[*watcher]bool{}
+	}
+	s.watchers[w] = true
+	s.watchMu.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.watchMu.Lock()
+		defer s.watchMu.Unlock()
+		s.unwatch(w)
+	}()
+	return w.c
+}
+
+// unwatch removes w and closes its channel if it has not been already. The caller holds watchMu.
+func (s *DHTServer) unwatch(w *watcher) {
+	if s.watchers[w] {
+		delete(s.watchers, w)
+		close(w.c)
+	}
+}
+
+// publish sends each of changes to the subscribers whose interval holds its key.
+func (s *DHTServer) publish(changes ...Change) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	for w := range s.watchers {
+		for _, c := range changes {
+			if !between(w.start-1, c.Key, w.end) {
+				continue
+			}
+			select {
+			case w.c <- c:
+				continue
+			default:
+			}
+			s.node.logger.Warn("dropping slow subscriber", "start", fmt.Sprintf("%x", w.start), "end", fmt.Sprintf("%x", w.end))
+			s.unwatch(w)
+			break
+		}
+	}
+}
+
+// changeJSON is the data of a server-sent event for a Change.
+type changeJSON struct {
+	Key     string `json:"key"`
+	Version string `json:"version,omitempty"`
+}
+
+// serveWatch answers GET /store?op=Watch&start=...&end=... with a text/event-stream of the
+// changes Subscribe reports, one Set or Delete event per change. The stream ends with a
+// Dropped event if the client falls behind, after which it should resubscribe and reread
+// the keys it cares about.
+func (s *DHTServer) serveWatch(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	start, err := strconv.ParseUint(query.Get("start"), 16, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	end, err := strconv.ParseUint(query.Get("end"), 16, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(501)
+		return
+	}
+	changes := s.Subscribe(req.Context(), start, end)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+	for c := range changes {
+		data := changeJSON{Key: fmt.Sprintf("%x", c.Key)}
+		if c.Type == KeySet {
+			data.Version = c.Version.String()
+		}
+		b, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", c.Type, b); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+	if req.Context().Err() == nil {
+		fmt.Fprint(w, "event: Dropped\ndata: {}\n\n")
+		flusher.Flush()
+	}
+}
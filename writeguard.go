@@ -0,0 +1,203 @@
+package chord
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// WriteGuard wraps a Store, such as a DiskStore on a failing disk, so that after a run of
+// failed writes it turns read-only: reads are served as before, but writes are refused with
+// ErrReadOnly, which the /store endpoint answers with 503, rather than half applied. Recover
+// turns it writable again once the store can be written.
+//
+// A write only counts as failed if the store itself failed, not if the value could not be
+// read from the caller or the store is full.
+type WriteGuard struct {
+	Store
+	// Logger receives a record each time the store turns read-only or recovers. Nothing is
+	// logged if nil.
+	Logger *slog.Logger
+
+	failures int
+	mu       sync.Mutex
+	failed   int
+	readOnly bool
+}
+
+var _ Store = (*WriteGuard)(nil)
+
+// NewWriteGuard wraps store, turning it read-only after failures consecutive failed writes.
+func NewWriteGuard(store Store, failures int) *WriteGuard {
+	return &WriteGuard{Store: store, failures: max(failures, 1)}
+}
+
+// ReadOnly reports whether writes are being refused.
+func (s *WriteGuard) ReadOnly() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readOnly
+}
+
+func (s *WriteGuard) Set(key uint64, value io.Reader) error {
+	return s.writeValue(value, func(value io.Reader) error { return s.Store.Set(key, value) })
+}
+
+func (s *WriteGuard) SetVersioned(key uint64, value io.Reader, version Version) error {
+	return s.writeValue(value, func(value io.Reader) error { return s.Store.SetVersioned(key, value, version) })
+}
+
+func (s *WriteGuard) SetWithTTL(key uint64, value io.Reader, ttl time.Duration) error {
+	return s.writeValue(value, func(value io.Reader) error { return s.Store.SetWithTTL(key, value, ttl) })
+}
+
+func (s *WriteGuard) SetVersionedWithTTL(key uint64, value io.Reader, version Version, ttl time.Duration) error {
+	return s.writeValue(value, func(value io.Reader) error {
+		return s.Store.SetVersionedWithTTL(key, value, version, ttl)
+	})
+}
+
+func (s *WriteGuard) CompareAndSwap(key uint64, old, new []byte, version Version) (bool, error) {
+	var ok bool
+	err := s.write(func() (err error) {
+		ok, err = s.Store.CompareAndSwap(key, old, new, version)
+		return err
+	})
+	return ok, err
+}
+
+func (s *WriteGuard) Delete(key uint64) error {
+	return s.write(func() error { return s.Store.Delete(key) })
+}
+
+func (s *WriteGuard) Constrain(a, b uint64) error {
+	return s.write(func() error { return s.Store.Constrain(a, b) })
+}
+
+// writeValue is write for a write of value, not counting a failure to read value against
+// the store.
+func (s *WriteGuard) writeValue(value io.Reader, fn func(io.Reader) error) error {
+	source := &sourceReader{Reader: value}
+	var err error
+	if guarded := s.write(func() error {
+		if err = fn(source); source.err != nil {
+			return nil
+		}
+		return err
+	}); guarded != nil {
+		return guarded
+	}
+	return err
+}
+
+// write runs fn unless the store is read-only, turning it read-only if fn fails and makes
+// too many failures in a row.
+func (s *WriteGuard) write(fn func() error) error {
+	if s.ReadOnly() {
+		return ErrReadOnly
+	}
+	err := fn()
+	if errors.Is(err, ErrStoreFull) {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.failed = 0
+		return nil
+	}
+	if s.failed++; s.failed >= s.failures && !s.readOnly {
+		s.readOnly = true
+		if s.Logger != nil {
+			s.Logger.Error("store turned read-only", "failures", s.failed, "err", err)
+		}
+	}
+	return err
+}
+
+// Recover checks a read-only store every interval until ctx is cancelled, turning it
+// writable again once it can be written. Stores with a Probe method, such as DiskStore,
+// are probed with it. Others are assumed to have recovered, so that the next writes
+// decide whether the store stays writable.
+func (s *WriteGuard) Recover(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.ReadOnly() {
+				continue
+			}
+			if p, ok := s.Store.(interface{ Probe() error }); ok {
+				if err := p.Probe(); err != nil {
+					continue
+				}
+			}
+			s.mu.Lock()
+			s.readOnly, s.failed = false, 0
+			s.mu.Unlock()
+			if s.Logger != nil {
+				s.Logger.Info("store writable again")
+			}
+		}
+	}
+}
+
+// sourceReader records an error reading from its Reader, so that it can be told apart
+// from the store failing.
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// writeGuard returns the WriteGuard store is or wraps, or nil if there is none.
+func writeGuard(store Store) *WriteGuard {
+	for ; store != nil; store = unwrapStore(store) {
+		if guard, ok := store.(*WriteGuard); ok {
+			return guard
+		}
+	}
+	return nil
+}
+
+// boundedStore returns the BoundedStore store is or wraps, or nil if there is none.
+func boundedStore(store Store) *BoundedStore {
+	for ; store != nil; store = unwrapStore(store) {
+		if bounded, ok := store.(*BoundedStore); ok {
+			return bounded
+		}
+	}
+	return nil
+}
+
+// unwrapStore returns the store that store wraps, or nil if it wraps none.
+func unwrapStore(store Store) Store {
+	switch s := store.(type) {
+	case *WriteGuard:
+		return s.Store
+	case *vnodeStore:
+		return s.Store
+	case *IndexedStore:
+		return s.Store
+	case *BoundedStore:
+		return s.Store
+	case *EncryptedStore:
+		return s.Store
+	case *ChecksumStore:
+		return s.Store
+	}
+	return nil
+}